@@ -0,0 +1,53 @@
+package boringproxy
+
+import (
+	"context"
+	"crypto/x509"
+	"sync"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// reloadableIssuer is the certmagic issuer for the server. certmagic reads
+// Config.Issuers from its own goroutines, so the slice can't be replaced when
+// the ACME settings are reloaded. Instead it holds this issuer, which passes
+// every call on to the current ACMEManager, and reloads swap that.
+type reloadableIssuer struct {
+	mut  *sync.RWMutex
+	acme *certmagic.ACMEManager
+}
+
+func newReloadableIssuer(acme *certmagic.ACMEManager) *reloadableIssuer {
+	return &reloadableIssuer{
+		mut:  &sync.RWMutex{},
+		acme: acme,
+	}
+}
+
+func (i *reloadableIssuer) set(acme *certmagic.ACMEManager) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	i.acme = acme
+}
+
+func (i *reloadableIssuer) get() *certmagic.ACMEManager {
+	i.mut.RLock()
+	defer i.mut.RUnlock()
+	return i.acme
+}
+
+func (i *reloadableIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	return i.get().Issue(ctx, csr)
+}
+
+func (i *reloadableIssuer) IssuerKey() string {
+	return i.get().IssuerKey()
+}
+
+func (i *reloadableIssuer) PreCheck(ctx context.Context, names []string, interactive bool) error {
+	return i.get().PreCheck(ctx, names, interactive)
+}
+
+func (i *reloadableIssuer) Revoke(ctx context.Context, cert certmagic.CertificateResource, reason int) error {
+	return i.get().Revoke(ctx, cert, reason)
+}
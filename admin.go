@@ -0,0 +1,589 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Version of the export file format. Bump it if the layout of DatabaseExport
+// changes in a way older versions can't read.
+const exportFormatVersion = 1
+
+// Actor and source recorded in the audit log for changes made with Admin
+const auditActorCli = "(cli)"
+const auditSourceCli = "local"
+
+const (
+	AuditDatabaseImport = "database.import"
+
+	ImportModeMerge   = "merge"
+	ImportModeReplace = "replace"
+)
+
+// Admin manages a database directly, without going through a running server.
+// It's used by the 'boringproxy admin' commands. The server must be stopped
+// first, since it would overwrite any changes. OpenAdmin refuses to open a
+// database the server is still using.
+type Admin struct {
+	db       *Database
+	tunMan   *TunnelManager
+	auditLog *AuditLog
+}
+
+// DatabaseExport is the whole state of a server, as written by Export.
+type DatabaseExport struct {
+	FormatVersion int                  `json:"format_version"`
+	SchemaVersion int                  `json:"schema_version"`
+	ExportedAt    time.Time            `json:"exported_at"`
+	AdminDomain   string               `json:"admin_domain"`
+	Users         map[string]User      `json:"users"`
+	Tokens        map[string]TokenData `json:"tokens"`
+	Tunnels       map[string]Tunnel    `json:"tunnels"`
+	Orgs          map[string]Org       `json:"orgs"`
+}
+
+// ImportStats counts what Import added, and what it skipped because it
+// already existed.
+type ImportStats struct {
+	Users   int
+	Orgs    int
+	Tokens  int
+	Tunnels int
+	Skipped int
+}
+
+// OpenAdmin opens the database in dbDir for offline administration. Unlike
+// NewDatabase, it doesn't back up or migrate the database, so it refuses to
+// work with one which isn't at the current schema version.
+func OpenAdmin(dbDir, backend string, masterKey []byte) (*Admin, error) {
+
+	db, existed, err := openDatabase(dbDir, backend, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if !existed {
+		db.Close()
+		return nil, fmt.Errorf("No database found in %s", dbDir)
+	}
+
+	var version int
+	db.view(func(tx StoreTx) {
+		version = tx.GetSchemaVersion()
+	})
+
+	if version != currentSchemaVersion {
+		db.Close()
+		return nil, fmt.Errorf("Database schema version is %d, but this version of boringproxy uses %d. Run 'boringproxy db migrate' first", version, currentSchemaVersion)
+	}
+
+	auditLog, err := NewAuditLog(DBFolderPath + auditLogFileName)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	tunMan := &TunnelManager{
+		config: &Config{},
+		db:     db,
+	}
+
+	return &Admin{db, tunMan, auditLog}, nil
+}
+
+func (a *Admin) Close() error {
+	a.auditLog.Close()
+	return a.db.Close()
+}
+
+func (a *Admin) audit(action, target string, err error) {
+	entry := AuditEntry{
+		Time:     time.Now().UTC(),
+		Actor:    auditActorCli,
+		Action:   action,
+		Target:   target,
+		SourceIp: auditSourceCli,
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	// The change has already been made, so failing to record it isn't
+	// worth failing the command for.
+	a.auditLog.Record(entry)
+}
+
+func (a *Admin) GetUsers() map[string]User {
+	return a.db.GetUsers()
+}
+
+func (a *Admin) CreateUser(username, role string) error {
+	err := a.db.AddUser(username, role)
+	a.audit(AuditUserCreate, username, err)
+	return err
+}
+
+func (a *Admin) SetUserRole(username, role string) error {
+	err := a.db.SetUserRole(username, role)
+	a.audit(AuditUserUpdate, username, err)
+	return err
+}
+
+// DeleteUser deletes a user. See Database.DeleteUser.
+func (a *Admin) DeleteUser(username string) error {
+	err := a.db.DeleteUser(username)
+	a.audit(AuditUserDelete, username, err)
+	return err
+}
+
+func (a *Admin) GetTokens() map[string]TokenData {
+	return a.db.GetTokens()
+}
+
+// CreateToken creates a token, which is returned since it can't be recovered
+// later. Only the owner, org, client, description, expiry and scopes in
+// tokenData are used.
+func (a *Admin) CreateToken(tokenData TokenData) (string, error) {
+
+	scopes, err := parseScopes(TokenData{}, tokenData.Scopes)
+	if err != nil {
+		return "", err
+	}
+
+	owner, exists := a.db.GetUser(tokenData.Owner)
+	if !exists {
+		return "", errors.New("Owner doesn't exist")
+	}
+
+	clients := owner.Clients
+	clientsOf := "user " + tokenData.Owner
+
+	if tokenData.Org != "" {
+		org, exists := a.db.GetOrg(tokenData.Org)
+		if !exists {
+			return "", errors.New("Org doesn't exist")
+		}
+
+		if _, member := org.Members[tokenData.Owner]; !member {
+			return "", fmt.Errorf("User %s isn't a member of org %s", tokenData.Owner, tokenData.Org)
+		}
+
+		clients = org.Clients
+		clientsOf = "org " + tokenData.Org
+	}
+
+	if tokenData.Client != "" {
+		if _, exists := clients[tokenData.Client]; !exists {
+			return "", fmt.Errorf("Client %s does not exist for %s", tokenData.Client, clientsOf)
+		}
+	}
+
+	token, err := a.db.AddToken(TokenData{
+		Owner:       tokenData.Owner,
+		Client:      tokenData.Client,
+		Description: tokenData.Description,
+		ExpiresAt:   tokenData.ExpiresAt,
+		Scopes:      scopes,
+		Org:         tokenData.Org,
+	})
+
+	target := tokenData.Owner
+	if err == nil {
+		target = tokenId(token)
+	}
+	a.audit(AuditTokenCreate, target, err)
+
+	return token, err
+}
+
+func (a *Admin) DeleteToken(id string) error {
+	err := a.db.Update(func(tx StoreTx) error {
+		_, exists := tx.GetToken(id)
+		if !exists {
+			return errors.New("Token doesn't exist")
+		}
+
+		return tx.DeleteToken(id)
+	})
+	a.audit(AuditTokenDelete, id, err)
+	return err
+}
+
+// RotateAdminToken creates a new full access token for an admin user, then
+// deletes their other full access tokens, ie the ones used to log in to the
+// web UI. Tokens limited to a client or scopes are left alone, so clients keep
+// working. It returns the new token and the number of tokens deleted.
+func (a *Admin) RotateAdminToken(username string) (string, int, error) {
+
+	user, exists := a.db.GetUser(username)
+	if !exists {
+		return "", 0, errors.New("User doesn't exist")
+	}
+
+	if user.Role != RoleAdmin {
+		return "", 0, fmt.Errorf("%s is not an admin", username)
+	}
+
+	token, err := a.CreateToken(TokenData{
+		Owner:       username,
+		Description: "Created by rotate-admin-token",
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	newId := tokenId(token)
+	deleted := 0
+
+	for id, tokenData := range a.db.GetTokens() {
+		if id == newId || tokenData.Owner != username {
+			continue
+		}
+
+		if tokenData.Client != "" || tokenData.Org != "" || len(tokenData.Scopes) != 0 {
+			continue
+		}
+
+		err := a.DeleteToken(id)
+		if err != nil {
+			return token, deleted, err
+		}
+
+		deleted++
+	}
+
+	return token, deleted, nil
+}
+
+func (a *Admin) GetTunnels() map[string]Tunnel {
+	return a.db.GetTunnels()
+}
+
+// CreateTunnel creates a tunnel like the API does. The owner can be a user or
+// an org. Certificates for tunnels with server TLS termination are obtained
+// when the server next starts.
+func (a *Admin) CreateTunnel(tunReq Tunnel) (Tunnel, error) {
+
+	_, userExists := a.db.GetUser(tunReq.Owner)
+	_, orgExists := a.db.GetOrg(tunReq.Owner)
+	if !userExists && !orgExists {
+		err := errors.New("Owner doesn't exist")
+		a.audit(AuditTunnelCreate, tunReq.Domain, err)
+		return Tunnel{}, err
+	}
+
+	if !validTlsTermination(tunReq.TlsTermination) {
+		err := errors.New("Invalid tls-termination parameter")
+		a.audit(AuditTunnelCreate, tunReq.Domain, err)
+		return Tunnel{}, err
+	}
+
+	if tunReq.ClientAddress == "" {
+		tunReq.ClientAddress = "127.0.0.1"
+	}
+
+	tun, err := a.tunMan.RequestCreateTunnel(tunReq)
+	a.audit(AuditTunnelCreate, tunReq.Domain, err)
+	return tun, err
+}
+
+func (a *Admin) DeleteTunnel(domain string) error {
+	err := a.tunMan.DeleteTunnel(domain)
+	a.audit(AuditTunnelDelete, domain, err)
+	return err
+}
+
+// SetClient registers a client for owner, which is a user or an org.
+func (a *Admin) SetClient(owner, clientName string) error {
+	err := a.db.Update(func(tx StoreTx) error {
+		return updateClients(tx, owner, func(clients map[string]DbClient) error {
+			clients[clientName] = DbClient{}
+			return nil
+		})
+	})
+	a.audit(AuditClientSet, owner+"/"+clientName, err)
+	return err
+}
+
+func (a *Admin) DeleteClient(owner, clientName string) error {
+	err := a.db.Update(func(tx StoreTx) error {
+		return updateClients(tx, owner, func(clients map[string]DbClient) error {
+			if _, exists := clients[clientName]; !exists {
+				return errors.New("Client doesn't exist")
+			}
+
+			delete(clients, clientName)
+			return nil
+		})
+	})
+	a.audit(AuditClientDelete, owner+"/"+clientName, err)
+	return err
+}
+
+func (a *Admin) GetOrgs() map[string]Org {
+	return a.db.GetOrgs()
+}
+
+func (a *Admin) CreateOrg(name string) error {
+	err := a.db.AddOrg(name)
+	a.audit(AuditOrgCreate, name, err)
+	return err
+}
+
+// DeleteOrg deletes an org along with the tokens limited to it. Orgs which
+// still own tunnels can't be deleted.
+func (a *Admin) DeleteOrg(name string) error {
+	err := a.db.DeleteOrg(name)
+	a.audit(AuditOrgDelete, name, err)
+	return err
+}
+
+func (a *Admin) SetOrgMember(name, username string) error {
+	err := a.db.SetOrgMember(name, username)
+	a.audit(AuditOrgMemberSet, name+"/"+username, err)
+	return err
+}
+
+func (a *Admin) DeleteOrgMember(name, username string) error {
+	err := a.db.DeleteOrgMember(name, username)
+	a.audit(AuditOrgMemberDelete, name+"/"+username, err)
+	return err
+}
+
+// Export writes the whole database to w as JSON. Tunnel private keys and
+// passwords are included decrypted, so the export needs to be kept as safe as
+// the master key. Tokens are only stored hashed, so they stay that way.
+func (a *Admin) Export(w io.Writer) error {
+
+	export := DatabaseExport{
+		FormatVersion: exportFormatVersion,
+		ExportedAt:    time.Now().UTC(),
+	}
+
+	err := a.db.View(func(tx StoreTx) error {
+		export.SchemaVersion = tx.GetSchemaVersion()
+		export.AdminDomain = tx.GetAdminDomain()
+		export.Users = tx.GetUsers()
+		export.Tokens = tx.GetTokens()
+		export.Tunnels = tx.GetTunnels()
+		export.Orgs = tx.GetOrgs()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+// Import loads an export written by Export, after backing up the database.
+//
+// With ImportModeReplace, everything in the database is replaced by the
+// export. With ImportModeMerge, users, orgs, tokens and tunnels from the
+// export are added, but ones which already exist are skipped, and the admin
+// domain is only set if there isn't one already.
+//
+// Either way it happens in a single transaction, which fails if the result
+// would have tokens or tunnels without an owner, orgs with members who don't
+// exist, or tunnels sharing a port.
+func (a *Admin) Import(r io.Reader, mode string) (ImportStats, error) {
+
+	stats := ImportStats{}
+
+	if mode != ImportModeMerge && mode != ImportModeReplace {
+		return stats, fmt.Errorf("Invalid import mode %s. Must be %s or %s", mode, ImportModeMerge, ImportModeReplace)
+	}
+
+	var export DatabaseExport
+	err := json.NewDecoder(r).Decode(&export)
+	if err != nil {
+		return stats, fmt.Errorf("Failed to parse export: %v", err)
+	}
+
+	if export.FormatVersion != exportFormatVersion {
+		return stats, fmt.Errorf("Unsupported export format version %d", export.FormatVersion)
+	}
+
+	if export.SchemaVersion != currentSchemaVersion {
+		return stats, fmt.Errorf("Export has schema version %d, but this version of boringproxy uses %d. Import it with the version it was exported from, then migrate and export again", export.SchemaVersion, currentSchemaVersion)
+	}
+
+	err = a.db.backup()
+	if err != nil {
+		return stats, fmt.Errorf("Failed to back up database: %v", err)
+	}
+
+	err = a.db.Update(func(tx StoreTx) error {
+
+		if mode == ImportModeReplace {
+			err := clearStore(tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		if mode == ImportModeReplace || tx.GetAdminDomain() == "" {
+			err := tx.SetAdminDomain(export.AdminDomain)
+			if err != nil {
+				return err
+			}
+		}
+
+		for username, user := range export.Users {
+			if _, exists := tx.GetUser(username); exists {
+				stats.Skipped++
+				continue
+			}
+
+			err := tx.SetUser(username, user)
+			if err != nil {
+				return err
+			}
+			stats.Users++
+		}
+
+		for name, org := range export.Orgs {
+			if _, exists := tx.GetOrg(name); exists {
+				stats.Skipped++
+				continue
+			}
+
+			err := tx.SetOrg(name, org)
+			if err != nil {
+				return err
+			}
+			stats.Orgs++
+		}
+
+		for id, tokenData := range export.Tokens {
+			if _, exists := tx.GetToken(id); exists {
+				stats.Skipped++
+				continue
+			}
+
+			err := tx.SetToken(id, tokenData)
+			if err != nil {
+				return err
+			}
+			stats.Tokens++
+		}
+
+		for domain, tun := range export.Tunnels {
+			if _, exists := tx.GetTunnel(domain); exists {
+				stats.Skipped++
+				continue
+			}
+
+			err := tx.SetTunnel(domain, tun)
+			if err != nil {
+				return err
+			}
+			stats.Tunnels++
+		}
+
+		return checkConsistency(tx)
+	})
+	a.audit(AuditDatabaseImport, mode, err)
+	if err != nil {
+		return ImportStats{}, err
+	}
+
+	return stats, nil
+}
+
+// clearStore deletes everything except the schema version.
+func clearStore(tx StoreTx) error {
+
+	for id := range tx.GetTokens() {
+		err := tx.DeleteToken(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	for domain := range tx.GetTunnels() {
+		err := tx.DeleteTunnel(domain)
+		if err != nil {
+			return err
+		}
+	}
+
+	for username := range tx.GetUsers() {
+		err := tx.DeleteUser(username)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name := range tx.GetOrgs() {
+		err := tx.DeleteOrg(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	for requestId := range tx.GetDomainRequests() {
+		err := tx.DeleteDomainRequest(requestId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.SetAdminDomain("")
+}
+
+// checkConsistency makes sure every token and tunnel has an owner, orgs
+// don't share names with users and only have members who exist, and no two
+// tunnels use the same port.
+func checkConsistency(tx StoreTx) error {
+
+	users := tx.GetUsers()
+	orgs := tx.GetOrgs()
+
+	for name, org := range orgs {
+		if _, exists := users[name]; exists {
+			return fmt.Errorf("Org %s has the same name as a user", name)
+		}
+
+		for username := range org.Members {
+			if _, exists := users[username]; !exists {
+				return fmt.Errorf("Org %s has member %s, who doesn't exist", name, username)
+			}
+		}
+	}
+
+	for id, tokenData := range tx.GetTokens() {
+		if _, exists := users[tokenData.Owner]; !exists {
+			return fmt.Errorf("Token %s belongs to user %s, who doesn't exist", id, tokenData.Owner)
+		}
+
+		if tokenData.Org != "" {
+			if _, member := orgs[tokenData.Org].Members[tokenData.Owner]; !member {
+				return fmt.Errorf("Token %s is limited to org %s, which user %s isn't a member of", id, tokenData.Org, tokenData.Owner)
+			}
+		}
+	}
+
+	ports := make(map[int]string)
+
+	for domain, tun := range tx.GetTunnels() {
+		_, userExists := users[tun.Owner]
+		_, orgExists := orgs[tun.Owner]
+		if !userExists && !orgExists {
+			return fmt.Errorf("Tunnel %s belongs to %s, which isn't a user or org", domain, tun.Owner)
+		}
+
+		if other, exists := ports[tun.TunnelPort]; exists {
+			return fmt.Errorf("Tunnels %s and %s both use port %d", domain, other, tun.TunnelPort)
+		}
+		ports[tun.TunnelPort] = domain
+	}
+
+	return nil
+}
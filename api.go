@@ -1,34 +1,48 @@
 package boringproxy
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boringproxy/boringproxy/apiclient"
 )
 
+// Longest time a GET /tunnels request with the wait parameter is held open.
+const maxTunnelsWait = 60 * time.Second
+
 type Api struct {
-	config *Config
-	db     *Database
-	auth   *Auth
-	tunMan *TunnelManager
-	mux    *http.ServeMux
+	config   *Config
+	db       *Database
+	auth     *Auth
+	tunMan   *TunnelManager
+	auditLog *AuditLog
+	mux      *http.ServeMux
 }
 
-func NewApi(config *Config, db *Database, auth *Auth, tunMan *TunnelManager) *Api {
+func NewApi(config *Config, db *Database, auth *Auth, tunMan *TunnelManager, auditLog *AuditLog) *Api {
 
 	mux := http.NewServeMux()
 
-	api := &Api{config, db, auth, tunMan, mux}
+	api := &Api{config, db, auth, tunMan, auditLog, mux}
 
 	mux.Handle("/tunnels", http.StripPrefix("/tunnels", http.HandlerFunc(api.handleTunnels)))
+	mux.Handle("/tunnels/", http.StripPrefix("/tunnels/", http.HandlerFunc(api.handleTunnel)))
 	mux.Handle("/users/", http.StripPrefix("/users", http.HandlerFunc(api.handleUsers)))
 	mux.Handle("/tokens/", http.StripPrefix("/tokens", http.HandlerFunc(api.handleTokens)))
 	mux.Handle("/clients/", http.StripPrefix("/clients", http.HandlerFunc(api.handleClients)))
+	mux.HandleFunc("/audit", api.handleAudit)
+	mux.HandleFunc("/me", api.handleMe)
+	mux.Handle("/v1/", http.StripPrefix("/v1", http.HandlerFunc(api.handleV1)))
 
 	return api
 }
@@ -37,19 +51,35 @@ func (a *Api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	a.mux.ServeHTTP(w, r)
 }
 
-func (a *Api) handleTunnels(w http.ResponseWriter, r *http.Request) {
+// authenticate returns the data for the token in r. If the token is missing,
+// invalid or expired, it responds with an error and returns false.
+func (a *Api) authenticate(w http.ResponseWriter, r *http.Request) (TokenData, bool) {
 
 	token, err := extractToken("access_token", r)
 	if err != nil {
 		w.WriteHeader(401)
 		w.Write([]byte("No token provided"))
-		return
+		return TokenData{}, false
 	}
 
-	tokenData, exists := a.db.GetTokenData(token)
-	if !exists {
+	tokenData, err := a.db.ValidateToken(token)
+	if err == errExpiredToken {
+		w.WriteHeader(401)
+		w.Write([]byte("Token expired"))
+		return TokenData{}, false
+	} else if err != nil {
 		w.WriteHeader(403)
 		w.Write([]byte("Not authorized"))
+		return TokenData{}, false
+	}
+
+	return tokenData, true
+}
+
+func (a *Api) handleTunnels(w http.ResponseWriter, r *http.Request) {
+
+	tokenData, ok := a.authenticate(w, r)
+	if !ok {
 		return
 	}
 
@@ -57,18 +87,6 @@ func (a *Api) handleTunnels(w http.ResponseWriter, r *http.Request) {
 	case "GET":
 		query := r.URL.Query()
 
-		tunnels := a.GetTunnels(tokenData)
-
-		// If the token is limited to a specific client, filter out
-		// tunnels for any other clients.
-		if tokenData.Client != "" {
-			for k, tun := range tunnels {
-				if tokenData.Client != tun.ClientName {
-					delete(tunnels, k)
-				}
-			}
-		}
-
 		clientName := query.Get("client-name")
 		if clientName != "" && tokenData.Client != "" && clientName != tokenData.Client {
 			w.WriteHeader(403)
@@ -76,30 +94,33 @@ func (a *Api) handleTunnels(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if clientName != "" {
-			for k, tun := range tunnels {
-				if tun.ClientName != clientName {
-					delete(tunnels, k)
-				} else {
-					tun.ServerPort = a.config.SshServerPort
-					tunnels[k] = tun
-				}
-			}
+		wait, err := parseWait(query)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
 		}
 
-		body, err := json.Marshal(tunnels)
+		body, etag, notModified, err := a.watchTunnels(r.Context(), tokenData, query.Get("owner"), clientName, wait, r.Header.Get("If-None-Match"))
 		if err != nil {
+			if r.Context().Err() != nil {
+				// Client went away
+				return
+			}
+
 			w.WriteHeader(500)
 			w.Write([]byte("Error encoding tunnels"))
 			return
 		}
 
-		hash := md5.Sum(body)
-		hashStr := fmt.Sprintf("%x", hash)
+		w.Header()["ETag"] = []string{etag}
 
-		w.Header()["ETag"] = []string{hashStr}
+		if notModified {
+			w.WriteHeader(304)
+			return
+		}
 
-		w.Write([]byte(body))
+		w.Write(body)
 	case "POST":
 
 		if tokenData.Client != "" {
@@ -109,10 +130,9 @@ func (a *Api) handleTunnels(w http.ResponseWriter, r *http.Request) {
 		}
 
 		r.ParseForm()
-		_, err := a.CreateTunnel(tokenData, r.Form)
+		_, err := a.CreateTunnel(tokenData, sourceIp(r), r.Form)
 		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
+			writeLegacyError(w, err)
 		}
 	case "DELETE":
 		if tokenData.Client != "" {
@@ -122,10 +142,9 @@ func (a *Api) handleTunnels(w http.ResponseWriter, r *http.Request) {
 		}
 
 		r.ParseForm()
-		err := a.DeleteTunnel(tokenData, r.Form)
+		err := a.DeleteTunnel(tokenData, sourceIp(r), r.Form)
 		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
+			writeLegacyError(w, err)
 		}
 	default:
 		w.WriteHeader(405)
@@ -133,18 +152,166 @@ func (a *Api) handleTunnels(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (a *Api) handleUsers(w http.ResponseWriter, r *http.Request) {
-	token, err := extractToken("access_token", r)
-	if err != nil {
-		w.WriteHeader(401)
-		io.WriteString(w, "Invalid token")
+// handleTunnel serves /tunnels/{domain}
+func (a *Api) handleTunnel(w http.ResponseWriter, r *http.Request) {
+
+	tokenData, ok := a.authenticate(w, r)
+	if !ok {
 		return
 	}
 
-	tokenData, exists := a.db.GetTokenData(token)
-	if !exists {
-		w.WriteHeader(401)
-		io.WriteString(w, "Failed to get token")
+	domain := r.URL.Path
+	if domain == "" || strings.Contains(domain, "/") {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid domain")
+		return
+	}
+
+	if tokenData.Client != "" {
+		w.WriteHeader(403)
+		io.WriteString(w, "Token cannot be used to manage tunnels")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		params := url.Values{}
+		params.Set("domain", domain)
+
+		tun, err := a.GetTunnel(tokenData, params)
+		if err != nil {
+			writeLegacyError(w, err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(tun)
+	case "PATCH":
+		r.ParseForm()
+
+		tun, err := a.UpdateTunnel(tokenData, sourceIp(r), domain, r.Form)
+		if err != nil {
+			writeLegacyError(w, err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(tun)
+	default:
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /tunnels/{domain}")
+	}
+}
+
+// parseWait reads the wait parameter for watching tunnels.
+func parseWait(query url.Values) (time.Duration, error) {
+
+	waitParam := query.Get("wait")
+	if waitParam == "" {
+		return 0, nil
+	}
+
+	waitSeconds, err := strconv.Atoi(waitParam)
+	if err != nil || waitSeconds < 0 {
+		return 0, badRequest("Invalid wait parameter")
+	}
+
+	wait := time.Duration(waitSeconds) * time.Second
+	if wait > maxTunnelsWait {
+		wait = maxTunnelsWait
+	}
+
+	return wait, nil
+}
+
+// watchTunnels is tunnelsJson for clients watching for changes. If wait is
+// set and etag is still current, it holds the request until something
+// changes or the wait times out, in which case notModified is true.
+func (a *Api) watchTunnels(ctx context.Context, tokenData TokenData, owner, clientName string, wait time.Duration, etag string) ([]byte, string, bool, error) {
+
+	timeout := time.After(wait)
+
+	for {
+		// Get the channel before reading the tunnels, so changes
+		// made in between aren't missed.
+		changes := a.db.Changes()
+
+		body, newEtag, err := a.tunnelsJson(tokenData, owner, clientName)
+		if err != nil {
+			return nil, "", false, err
+		}
+
+		if wait == 0 || newEtag != etag {
+			return body, newEtag, false, nil
+		}
+
+		select {
+		case <-changes:
+		case <-timeout:
+			return nil, newEtag, true, nil
+		case <-ctx.Done():
+			return nil, "", false, ctx.Err()
+		}
+	}
+}
+
+// tunnelsJson returns the tunnels visible to a token, along with an ETag that
+// changes whenever they do. If owner isn't empty, only the tunnels belonging
+// to that user or org are included. Client names are only unique for an
+// owner, so clients should always set it.
+func (a *Api) tunnelsJson(tokenData TokenData, owner, clientName string) ([]byte, string, error) {
+
+	tunnels := a.GetTunnels(tokenData)
+
+	// Tunnels created before the embedded SSH server existed don't
+	// have the host key stored, so always fill in the current one.
+	serverPublicKey := a.tunMan.ServerPublicKey()
+	for k, tun := range tunnels {
+		tun.ServerPublicKey = serverPublicKey
+		tunnels[k] = tun
+	}
+
+	if owner != "" {
+		for k, tun := range tunnels {
+			if tun.Owner != owner {
+				delete(tunnels, k)
+			}
+		}
+	}
+
+	// If the token is limited to a specific client, filter out
+	// tunnels for any other clients.
+	if tokenData.Client != "" {
+		for k, tun := range tunnels {
+			if tokenData.Client != tun.ClientName {
+				delete(tunnels, k)
+			}
+		}
+	}
+
+	if clientName != "" {
+		for k, tun := range tunnels {
+			if tun.ClientName != clientName {
+				delete(tunnels, k)
+			} else {
+				tun.ServerPort = a.config.SshServerPort
+				tunnels[k] = tun
+			}
+		}
+	}
+
+	body, err := json.Marshal(tunnels)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := md5.Sum(body)
+	hashStr := fmt.Sprintf("%x", hash)
+
+	return body, hashStr, nil
+}
+
+func (a *Api) handleUsers(w http.ResponseWriter, r *http.Request) {
+	tokenData, ok := a.authenticate(w, r)
+	if !ok {
 		return
 	}
 
@@ -161,10 +328,21 @@ func (a *Api) handleUsers(w http.ResponseWriter, r *http.Request) {
 		users := a.GetUsers(tokenData, r.Form)
 		json.NewEncoder(w).Encode(users)
 	case "POST":
-		err := a.CreateUser(tokenData, r.Form)
+		err := a.CreateUser(tokenData, sourceIp(r), r.Form)
 		if err != nil {
-			w.WriteHeader(500)
-			io.WriteString(w, err.Error())
+			writeLegacyError(w, err)
+			return
+		}
+	case "PATCH":
+		err := a.SetUserRole(tokenData, sourceIp(r), r.Form)
+		if err != nil {
+			writeLegacyError(w, err)
+			return
+		}
+	case "DELETE":
+		err := a.DeleteUser(tokenData, sourceIp(r), r.Form)
+		if err != nil {
+			writeLegacyError(w, err)
 			return
 		}
 	default:
@@ -175,17 +353,8 @@ func (a *Api) handleUsers(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *Api) handleTokens(w http.ResponseWriter, r *http.Request) {
-	token, err := extractToken("access_token", r)
-	if err != nil {
-		w.WriteHeader(401)
-		w.Write([]byte("No token provided"))
-		return
-	}
-
-	tokenData, exists := a.db.GetTokenData(token)
-	if !exists {
-		w.WriteHeader(403)
-		w.Write([]byte("Not authorized"))
+	tokenData, ok := a.authenticate(w, r)
+	if !ok {
 		return
 	}
 
@@ -201,13 +370,19 @@ func (a *Api) handleTokens(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(tokens)
 	case "POST":
 		r.ParseForm()
-		token, err := a.CreateToken(tokenData, r.Form)
+		token, err := a.CreateToken(tokenData, sourceIp(r), r.Form)
 		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
+			writeLegacyError(w, err)
+			return
 		}
 
 		io.WriteString(w, token)
+	case "DELETE":
+		r.ParseForm()
+		err := a.DeleteToken(tokenData, sourceIp(r), r.Form)
+		if err != nil {
+			writeLegacyError(w, err)
+		}
 	default:
 		w.WriteHeader(405)
 		fmt.Fprintf(w, "Invalid method for /api/tokens")
@@ -218,17 +393,8 @@ func (a *Api) handleClients(w http.ResponseWriter, r *http.Request) {
 
 	r.ParseForm()
 
-	token, err := extractToken("access_token", r)
-	if err != nil {
-		w.WriteHeader(401)
-		w.Write([]byte("No token provided"))
-		return
-	}
-
-	tokenData, exists := a.db.GetTokenData(token)
-	if !exists {
-		w.WriteHeader(403)
-		w.Write([]byte("Not authorized"))
+	tokenData, ok := a.authenticate(w, r)
+	if !ok {
 		return
 	}
 
@@ -251,21 +417,19 @@ func (a *Api) handleClients(w http.ResponseWriter, r *http.Request) {
 
 	user := r.Form.Get("user")
 	if user == "" {
-		user = tokenData.Owner
+		user = tokenData.Account()
 	}
 
 	switch r.Method {
 	case "POST":
-		err := a.SetClient(tokenData, r.Form, user, clientName)
+		err := a.SetClient(tokenData, sourceIp(r), r.Form, user, clientName)
 		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
+			writeLegacyError(w, err)
 		}
 	case "DELETE":
-		err := a.DeleteClient(tokenData, user, clientName)
+		err := a.DeleteClient(tokenData, sourceIp(r), user, clientName)
 		if err != nil {
-			w.WriteHeader(500)
-			io.WriteString(w, err.Error())
+			writeLegacyError(w, err)
 			return
 		}
 	default:
@@ -274,64 +438,171 @@ func (a *Api) handleClients(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (a *Api) handleMe(w http.ResponseWriter, r *http.Request) {
+	tokenData, ok := a.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /api/me")
+		return
+	}
+
+	token, _ := extractToken("access_token", r)
+
+	json.NewEncoder(w).Encode(a.Whoami(tokenData, token))
+}
+
+func (a *Api) handleAudit(w http.ResponseWriter, r *http.Request) {
+	tokenData, ok := a.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /api/audit")
+		return
+	}
+
+	r.ParseForm()
+
+	entries, err := a.GetAuditEntries(tokenData, r.Form)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
 func (a *Api) GetTunnel(tokenData TokenData, params url.Values) (Tunnel, error) {
 	domain := params.Get("domain")
 	if domain == "" {
-		return Tunnel{}, errors.New("Invalid domain parameter")
+		return Tunnel{}, badRequest("Invalid domain parameter")
 	}
 
 	tun, exists := a.db.GetTunnel(domain)
 	if !exists {
-		return Tunnel{}, errors.New("Tunnel doesn't exist for domain")
+		return Tunnel{}, notFound("Tunnel doesn't exist for domain")
 	}
 
-	user, _ := a.db.GetUser(tokenData.Owner)
-	if user.IsAdmin || tun.Owner == tokenData.Owner {
-		return tun, nil
+	if a.actsFor(tokenData, tun.Owner) || a.canViewAll(tokenData) {
+		tunnels := map[string]Tunnel{domain: tun}
+		a.redactTunnels(tokenData, tunnels)
+		return tunnels[domain], nil
 	} else {
-		return Tunnel{}, errors.New("Unauthorized")
+		return Tunnel{}, errUnauthorized
 	}
 }
 
+// GetTunnels returns the tunnels belonging to the users and orgs the token
+// acts for, or all of them for users who can see everything.
 func (a *Api) GetTunnels(tokenData TokenData) map[string]Tunnel {
 
-	user, _ := a.db.GetUser(tokenData.Owner)
-
 	var tunnels map[string]Tunnel
 
-	if user.IsAdmin {
+	if a.canViewAll(tokenData) {
 		tunnels = a.db.GetTunnels()
 	} else {
 		tunnels = make(map[string]Tunnel)
 
+		accounts := a.accounts(tokenData)
+
 		for domain, tun := range a.db.GetTunnels() {
-			if tokenData.Owner == tun.Owner {
+			if accounts[tun.Owner] {
 				tunnels[domain] = tun
 			}
 		}
 	}
 
+	a.redactTunnels(tokenData, tunnels)
+
 	return tunnels
 }
 
-func (a *Api) CreateTunnel(tokenData TokenData, params url.Values) (*Tunnel, error) {
+// redactTunnels clears the private keys and passwords of the tunnels the
+// token is only allowed to see. Anyone with a tunnel's key can connect as its
+// client and take it over, so they're only left in for tokens limited to the
+// tunnel's client, and for tokens which can change the tunnel.
+func (a *Api) redactTunnels(tokenData TokenData, tunnels map[string]Tunnel) {
+
+	accounts := a.accounts(tokenData)
+
+	// Keyed by owner, since that's all authorize depends on
+	canWrite := make(map[string]bool)
+
+	for domain, tun := range tunnels {
+		var allowed bool
+
+		if tokenData.Client != "" {
+			allowed = tokenData.Client == tun.ClientName && accounts[tun.Owner]
+		} else {
+			var checked bool
+			allowed, checked = canWrite[tun.Owner]
+			if !checked {
+				allowed = a.authorize(tokenData, resourceTunnels, tun.Owner) == nil
+				canWrite[tun.Owner] = allowed
+			}
+		}
+
+		if !allowed {
+			tun.TunnelPrivateKey = ""
+			tun.AuthPassword = ""
+			tunnels[domain] = tun
+		}
+	}
+}
+
+// GetDomainRequests returns the unexpired namedrop domain requests made for
+// the users and orgs the token acts for, or all of them for users who can see
+// everything.
+func (a *Api) GetDomainRequests(tokenData TokenData) map[string]DomainRequest {
+
+	viewAll := a.canViewAll(tokenData)
+	accounts := a.accounts(tokenData)
+
+	now := time.Now()
+	reqs := make(map[string]DomainRequest)
+
+	for requestId, req := range a.db.GetDomainRequests() {
+		if req.Expired(now) {
+			continue
+		}
+
+		if viewAll || accounts[req.Owner] {
+			reqs[requestId] = req
+		}
+	}
+
+	return reqs
+}
+
+func (a *Api) CreateTunnel(tokenData TokenData, sourceIp string, params url.Values) (*Tunnel, error) {
+	tun, err := a.createTunnel(tokenData, params)
+	a.audit(tokenData, sourceIp, AuditTunnelCreate, params.Get("domain"), err)
+	return tun, err
+}
+
+func (a *Api) createTunnel(tokenData TokenData, params url.Values) (*Tunnel, error) {
 
 	domain := params.Get("domain")
 	if domain == "" {
-		return nil, errors.New("Invalid domain parameter")
+		return nil, badRequest("Invalid domain parameter")
 	}
 
 	owner := params.Get("owner")
 	if owner == "" {
-		return nil, errors.New("Invalid owner parameter")
+		owner = tokenData.Account()
 	}
 
-	// Only admins can create tunnels for other users
-	if tokenData.Owner != owner {
-		user, _ := a.db.GetUser(tokenData.Owner)
-		if !user.IsAdmin {
-			return nil, errors.New("Unauthorized")
-		}
+	err := a.authorize(tokenData, resourceTunnels, owner)
+	if err != nil {
+		return nil, err
 	}
 
 	clientName := params.Get("client-name")
@@ -342,7 +613,7 @@ func (a *Api) CreateTunnel(tokenData TokenData, params url.Values) (*Tunnel, err
 		var err error
 		clientPort, err = strconv.Atoi(clientPortParam)
 		if err != nil {
-			return nil, errors.New("Invalid client-port parameter")
+			return nil, badRequest("Invalid client-port parameter")
 		}
 	}
 
@@ -357,12 +628,19 @@ func (a *Api) CreateTunnel(tokenData TokenData, params url.Values) (*Tunnel, err
 		var err error
 		tunnelPort, err = strconv.Atoi(tunnelPortParam)
 		if err != nil {
-			return nil, errors.New("Invalid tunnel-port parameter")
+			return nil, badRequest("Invalid tunnel-port parameter")
+		}
+
+		err = a.checkTunnelPort(tokenData, tunnelPort)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	allowExternalTcp := params.Get("allow-external-tcp") == "on"
 
+	disableBuffering := params.Get("disable-buffering") == "on"
+
 	passwordProtect := params.Get("password-protect") == "on"
 
 	var username string
@@ -370,18 +648,18 @@ func (a *Api) CreateTunnel(tokenData TokenData, params url.Values) (*Tunnel, err
 	if passwordProtect {
 		username = params.Get("username")
 		if username == "" {
-			return nil, errors.New("Username required")
+			return nil, badRequest("Username required")
 		}
 
 		password = params.Get("password")
 		if password == "" {
-			return nil, errors.New("Password required")
+			return nil, badRequest("Password required")
 		}
 	}
 
 	tlsTerm := params.Get("tls-termination")
-	if tlsTerm != "server" && tlsTerm != "client" && tlsTerm != "passthrough" && tlsTerm != "client-tls" && tlsTerm != "server-tls" {
-		return nil, errors.New("Invalid tls-termination parameter")
+	if !validTlsTermination(tlsTerm) {
+		return nil, badRequest("Invalid tls-termination parameter")
 	}
 
 	sshServerAddr := a.db.GetAdminDomain()
@@ -396,7 +674,7 @@ func (a *Api) CreateTunnel(tokenData TokenData, params url.Values) (*Tunnel, err
 		var err error
 		sshServerPort, err = strconv.Atoi(sshServerPortParam)
 		if err != nil {
-			return nil, errors.New("Invalid ssh-server-port parameter")
+			return nil, badRequest("Invalid ssh-server-port parameter")
 		}
 	}
 
@@ -411,6 +689,7 @@ func (a *Api) CreateTunnel(tokenData TokenData, params url.Values) (*Tunnel, err
 		AuthUsername:     username,
 		AuthPassword:     password,
 		TlsTermination:   tlsTerm,
+		DisableBuffering: disableBuffering,
 		ServerAddress:    sshServerAddr,
 		ServerPort:       sshServerPort,
 	}
@@ -423,62 +702,272 @@ func (a *Api) CreateTunnel(tokenData TokenData, params url.Values) (*Tunnel, err
 	return &tunnel, nil
 }
 
-func (a *Api) DeleteTunnel(tokenData TokenData, params url.Values) error {
+func (a *Api) DeleteTunnel(tokenData TokenData, sourceIp string, params url.Values) error {
+	err := a.deleteTunnel(tokenData, params)
+	a.audit(tokenData, sourceIp, AuditTunnelDelete, params.Get("domain"), err)
+	return err
+}
+
+func (a *Api) UpdateTunnel(tokenData TokenData, sourceIp, domain string, params url.Values) (*Tunnel, error) {
+	tun, err := a.updateTunnel(tokenData, domain, params)
+	a.audit(tokenData, sourceIp, AuditTunnelUpdate, domain, err)
+	return tun, err
+}
+
+// updateTunnel changes only the settings present in params, which are the
+// same as for createTunnel. Setting tunnel-port to Random picks a new port, and
+// rotate-key=on generates a new SSH key. Leaving out the password while
+// password-protect is on keeps the current one.
+func (a *Api) updateTunnel(tokenData TokenData, domain string, params url.Values) (*Tunnel, error) {
+
+	tun, exists := a.db.GetTunnel(domain)
+	if !exists {
+		return nil, notFound("Tunnel doesn't exist")
+	}
+
+	err := a.authorize(tokenData, resourceTunnels, tun.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := params.Get("owner")
+	if owner != "" && owner != tun.Owner {
+		return nil, badRequest("Tunnel owner can't be changed")
+	}
+
+	if params.Has("client-name") {
+		tun.ClientName = params.Get("client-name")
+	}
+
+	if params.Has("client-addr") {
+		tun.ClientAddress = params.Get("client-addr")
+		if tun.ClientAddress == "" {
+			tun.ClientAddress = "127.0.0.1"
+		}
+	}
+
+	if params.Has("client-port") {
+		tun.ClientPort, err = strconv.Atoi(params.Get("client-port"))
+		if err != nil {
+			return nil, badRequest("Invalid client-port parameter")
+		}
+	}
+
+	if params.Has("tunnel-port") {
+		tunnelPortParam := params.Get("tunnel-port")
+		if tunnelPortParam == "Random" {
+			tun.TunnelPort = 0
+		} else {
+			tunnelPort, err := strconv.Atoi(tunnelPortParam)
+			if err != nil {
+				return nil, badRequest("Invalid tunnel-port parameter")
+			}
+
+			// Ports an admin set are kept when others update the
+			// tunnel
+			if tunnelPort != tun.TunnelPort {
+				err = a.checkTunnelPort(tokenData, tunnelPort)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			tun.TunnelPort = tunnelPort
+		}
+	}
+
+	if params.Has("tls-termination") {
+		tun.TlsTermination = params.Get("tls-termination")
+		if !validTlsTermination(tun.TlsTermination) {
+			return nil, badRequest("Invalid tls-termination parameter")
+		}
+	}
+
+	if params.Has("allow-external-tcp") {
+		tun.AllowExternalTcp, err = parseSwitch(params.Get("allow-external-tcp"))
+		if err != nil {
+			return nil, badRequest("Invalid allow-external-tcp parameter")
+		}
+	}
+
+	if params.Has("disable-buffering") {
+		tun.DisableBuffering, err = parseSwitch(params.Get("disable-buffering"))
+		if err != nil {
+			return nil, badRequest("Invalid disable-buffering parameter")
+		}
+	}
+
+	if params.Has("password-protect") {
+		passwordProtect, err := parseSwitch(params.Get("password-protect"))
+		if err != nil {
+			return nil, badRequest("Invalid password-protect parameter")
+		}
+
+		if passwordProtect {
+			if params.Get("username") != "" {
+				tun.AuthUsername = params.Get("username")
+			}
+			if params.Get("password") != "" {
+				tun.AuthPassword = params.Get("password")
+			}
+
+			if tun.AuthUsername == "" {
+				return nil, badRequest("Username required")
+			}
+			if tun.AuthPassword == "" {
+				return nil, badRequest("Password required")
+			}
+		} else {
+			tun.AuthUsername = ""
+			tun.AuthPassword = ""
+		}
+	}
+
+	rotateKey := false
+	if params.Has("rotate-key") {
+		rotateKey, err = parseSwitch(params.Get("rotate-key"))
+		if err != nil {
+			return nil, badRequest("Invalid rotate-key parameter")
+		}
+	}
+
+	tunnel, err := a.tunMan.UpdateTunnel(tun, rotateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tunnel, nil
+}
+
+func validTlsTermination(tlsTerm string) bool {
+	switch tlsTerm {
+	case "server", "client", "passthrough", "client-tls", "server-tls":
+		return true
+	default:
+		return false
+	}
+}
+
+// parseSwitch parses a checkbox style parameter, which is "on" when set.
+func parseSwitch(value string) (bool, error) {
+	switch value {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	default:
+		return false, fmt.Errorf("Invalid value %s. Must be on or off", value)
+	}
+}
+
+func (a *Api) deleteTunnel(tokenData TokenData, params url.Values) error {
 
 	domain := params.Get("domain")
 	if domain == "" {
-		return errors.New("Invalid domain parameter")
+		return badRequest("Invalid domain parameter")
 	}
 
 	tun, exists := a.db.GetTunnel(domain)
 	if !exists {
-		return errors.New("Tunnel doesn't exist")
+		return notFound("Tunnel doesn't exist")
 	}
 
-	if tokenData.Owner != tun.Owner {
-		user, _ := a.db.GetUser(tokenData.Owner)
-		if !user.IsAdmin {
-			return errors.New("Unauthorized")
-		}
+	err := a.authorize(tokenData, resourceTunnels, tun.Owner)
+	if err != nil {
+		return err
 	}
 
-	a.tunMan.DeleteTunnel(domain)
+	return a.tunMan.DeleteTunnel(domain)
+}
+
+// CreateToken is audited with the new token's id as the target, or the owner
+// if it fails.
+func (a *Api) CreateToken(tokenData TokenData, sourceIp string, params url.Values) (string, error) {
+	token, err := a.createToken(tokenData, params)
 
-	return nil
+	target := params.Get("owner")
+	if err == nil {
+		target = tokenId(token)
+	}
+
+	a.audit(tokenData, sourceIp, AuditTokenCreate, target, err)
+	return token, err
 }
 
-func (a *Api) CreateToken(tokenData TokenData, params url.Values) (string, error) {
+func (a *Api) createToken(tokenData TokenData, params url.Values) (string, error) {
 
 	ownerId := params.Get("owner")
 	if ownerId == "" {
-		return "", errors.New("Invalid owner paramater")
+		return "", badRequest("Invalid owner paramater")
 	}
 
-	user, _ := a.db.GetUser(tokenData.Owner)
+	err := a.authorize(tokenData, resourceTokens, ownerId)
+	if err != nil {
+		return "", err
+	}
 
-	if tokenData.Owner != ownerId && !user.IsAdmin {
-		return "", errors.New("Unauthorized")
+	owner, exists := a.db.GetUser(ownerId)
+	if !exists {
+		return "", badRequest("Owner doesn't exist")
 	}
 
-	var owner User
+	clients := owner.Clients
+	clientsOf := "user " + ownerId
 
-	if tokenData.Owner == ownerId {
-		owner = user
-	} else {
-		owner, _ = a.db.GetUser(ownerId)
+	orgName := params.Get("org")
+	if orgName != "" {
+		err := a.authorize(tokenData, resourceTokens, orgName)
+		if err != nil {
+			return "", err
+		}
+
+		org, exists := a.db.GetOrg(orgName)
+		if !exists {
+			return "", badRequest("Org doesn't exist")
+		}
+
+		if _, member := org.Members[ownerId]; !member {
+			return "", badRequest("User %s isn't a member of org %s", ownerId, orgName)
+		}
+
+		clients = org.Clients
+		clientsOf = "org " + orgName
 	}
 
 	client := params.Get("client")
 
 	if client != "any" {
-		if _, exists := owner.Clients[client]; !exists {
-			return "", fmt.Errorf("Client %s does not exist for user %s", client, ownerId)
+		if _, exists := clients[client]; !exists {
+			return "", badRequest("Client %s does not exist for %s", client, clientsOf)
 		}
 	} else {
 		client = ""
 	}
 
-	token, err := a.db.AddToken(ownerId, client)
+	scopes, err := parseScopes(tokenData, params["scope"])
+	if err != nil {
+		return "", err
+	}
+
+	var expiresAt time.Time
+	expiresParam := params.Get("expires-in-days")
+	if expiresParam != "" {
+		days, err := strconv.Atoi(expiresParam)
+		if err != nil || days < 1 {
+			return "", badRequest("Invalid expires-in-days parameter")
+		}
+
+		expiresAt = time.Now().UTC().AddDate(0, 0, days)
+	}
+
+	token, err := a.db.AddToken(TokenData{
+		Owner:       ownerId,
+		Client:      client,
+		Description: params.Get("description"),
+		ExpiresAt:   expiresAt,
+		Scopes:      scopes,
+		Org:         orgName,
+	})
 	if err != nil {
 		return "", errors.New("Failed to create token")
 	}
@@ -486,39 +975,54 @@ func (a *Api) CreateToken(tokenData TokenData, params url.Values) (string, error
 	return token, nil
 }
 
-func (a *Api) DeleteToken(tokenData TokenData, params url.Values) error {
-	token := params.Get("token")
-	if token == "" {
-		return errors.New("Invalid token parameter")
+func (a *Api) DeleteToken(tokenData TokenData, sourceIp string, params url.Values) error {
+	err := a.deleteToken(tokenData, params)
+	a.audit(tokenData, sourceIp, AuditTokenDelete, params.Get("id"), err)
+	return err
+}
+
+func (a *Api) deleteToken(tokenData TokenData, params url.Values) error {
+
+	id := params.Get("id")
+	if id == "" {
+		return badRequest("Invalid id parameter")
 	}
 
-	delTokenData, exists := a.db.GetTokenData(token)
+	delTokenData, exists := a.db.GetTokenData(id)
 	if !exists {
-		return errors.New("Token doesn't exist")
+		return notFound("Token doesn't exist")
 	}
 
-	if tokenData.Owner != delTokenData.Owner {
-		user, _ := a.db.GetUser(tokenData.Owner)
-		if !user.IsAdmin {
-			return errors.New("Unauthorized")
-		}
+	// Tokens limited to an org can be deleted by any member
+	err := a.authorize(tokenData, resourceTokens, delTokenData.Account())
+	if err != nil {
+		return err
 	}
 
-	a.db.DeleteTokenData(token)
+	err = a.db.DeleteTokenData(id)
+	if err != nil {
+		return err
+	}
 
 	return nil
 
 }
 
+// GetTokens returns the tokens visible to a token, keyed by id. The hashes are
+// left out.
 func (a *Api) GetTokens(tokenData TokenData, params url.Values) map[string]TokenData {
 
 	tokens := a.db.GetTokens()
 
-	user, _ := a.db.GetUser(tokenData.Owner)
+	viewAll := a.canViewAll(tokenData)
+	accounts := a.accounts(tokenData)
 
-	for key, tok := range tokens {
-		if !user.IsAdmin && tok.Owner != tokenData.Owner {
-			delete(tokens, key)
+	for id, tok := range tokens {
+		if !viewAll && !accounts[tok.Account()] {
+			delete(tokens, id)
+		} else {
+			tok.Hash = ""
+			tokens[id] = tok
 		}
 	}
 
@@ -527,35 +1031,47 @@ func (a *Api) GetTokens(tokenData TokenData, params url.Values) map[string]Token
 
 func (a *Api) GetUsers(tokenData TokenData, params url.Values) map[string]User {
 
-	user, _ := a.db.GetUser(tokenData.Owner)
-	users := a.db.GetUsers()
-
-	if user.IsAdmin {
-		return users
+	if a.canViewAll(tokenData) {
+		return a.db.GetUsers()
 	} else {
+		user, _ := a.db.GetUser(tokenData.Owner)
+
 		return map[string]User{
 			tokenData.Owner: user,
 		}
 	}
 }
 
-func (a *Api) CreateUser(tokenData TokenData, params url.Values) error {
+func (a *Api) CreateUser(tokenData TokenData, sourceIp string, params url.Values) error {
+	err := a.createUser(tokenData, params)
+	a.audit(tokenData, sourceIp, AuditUserCreate, params.Get("username"), err)
+	return err
+}
+
+func (a *Api) createUser(tokenData TokenData, params url.Values) error {
 
-	user, _ := a.db.GetUser(tokenData.Owner)
-	if !user.IsAdmin {
-		return errors.New("Unauthorized")
+	err := a.authorize(tokenData, resourceUsers, "")
+	if err != nil {
+		return err
 	}
 
 	username := params.Get("username")
 	minUsernameLen := 6
 	if len(username) < minUsernameLen {
-		errStr := fmt.Sprintf("Username must be at least %d characters", minUsernameLen)
-		return errors.New(errStr)
+		return badRequest("Username must be at least %d characters", minUsernameLen)
 	}
 
-	isAdmin := params.Get("is-admin") == "on"
+	role := params.Get("role")
+	if role == "" {
+		// From before roles
+		if params.Get("is-admin") == "on" {
+			role = RoleAdmin
+		} else {
+			role = RoleMember
+		}
+	}
 
-	err := a.db.AddUser(username, isAdmin)
+	err = a.db.AddUser(username, role)
 	if err != nil {
 		return err
 	}
@@ -563,63 +1079,151 @@ func (a *Api) CreateUser(tokenData TokenData, params url.Values) error {
 	return nil
 }
 
-func (a *Api) DeleteUser(tokenData TokenData, params url.Values) error {
+// SetUserRole is audited as a user update.
+func (a *Api) SetUserRole(tokenData TokenData, sourceIp string, params url.Values) error {
+	err := a.setUserRole(tokenData, params)
+	a.audit(tokenData, sourceIp, AuditUserUpdate, params.Get("username"), err)
+	return err
+}
 
-	user, _ := a.db.GetUser(tokenData.Owner)
-	if !user.IsAdmin {
-		return errors.New("Unauthorized")
+func (a *Api) setUserRole(tokenData TokenData, params url.Values) error {
+
+	err := a.authorize(tokenData, resourceUsers, "")
+	if err != nil {
+		return err
 	}
 
 	username := params.Get("username")
 	if username == "" {
-		return errors.New("Invalid username parameter")
+		return badRequest("Invalid username parameter")
 	}
 
-	_, exists := a.db.GetUser(username)
-	if !exists {
-		return errors.New("User doesn't exist")
+	return a.db.SetUserRole(username, params.Get("role"))
+}
+
+func (a *Api) DeleteUser(tokenData TokenData, sourceIp string, params url.Values) error {
+	err := a.deleteUser(tokenData, params)
+	a.audit(tokenData, sourceIp, AuditUserDelete, params.Get("username"), err)
+	return err
+}
+
+func (a *Api) deleteUser(tokenData TokenData, params url.Values) error {
+
+	err := a.authorize(tokenData, resourceUsers, "")
+	if err != nil {
+		return err
 	}
 
-	a.db.DeleteUser(username)
+	username := params.Get("username")
+	if username == "" {
+		return badRequest("Invalid username parameter")
+	}
 
-	for token, tokenData := range a.db.GetTokens() {
-		if tokenData.Owner == username {
-			a.db.DeleteTokenData(token)
-		}
+	return a.db.DeleteUser(username)
+}
+
+func (a *Api) SetClient(tokenData TokenData, sourceIp string, params url.Values, ownerId, clientId string) error {
+	err := a.setClient(tokenData, params, ownerId, clientId)
+	a.audit(tokenData, sourceIp, AuditClientSet, ownerId+"/"+clientId, err)
+	return err
+}
+
+func (a *Api) setClient(tokenData TokenData, params url.Values, ownerId, clientId string) error {
+
+	err := a.authorize(tokenData, resourceClients, ownerId)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return a.db.Update(func(tx StoreTx) error {
+		return updateClients(tx, ownerId, func(clients map[string]DbClient) error {
+			clients[clientId] = DbClient{}
+			return nil
+		})
+	})
 }
 
-func (a *Api) SetClient(tokenData TokenData, params url.Values, ownerId, clientId string) error {
+func (a *Api) DeleteClient(tokenData TokenData, sourceIp string, ownerId, clientId string) error {
+	err := a.deleteClient(tokenData, ownerId, clientId)
+	a.audit(tokenData, sourceIp, AuditClientDelete, ownerId+"/"+clientId, err)
+	return err
+}
 
-	if tokenData.Owner != ownerId {
-		user, _ := a.db.GetUser(tokenData.Owner)
-		if !user.IsAdmin {
-			return errors.New("Unauthorized")
-		}
+func (a *Api) deleteClient(tokenData TokenData, ownerId, clientId string) error {
+
+	err := a.authorize(tokenData, resourceClients, ownerId)
+	if err != nil {
+		return err
 	}
 
-	// TODO: what if two users try to get then set at the same time?
-	owner, _ := a.db.GetUser(ownerId)
-	owner.Clients[clientId] = DbClient{}
-	a.db.SetUser(ownerId, owner)
+	return a.db.Update(func(tx StoreTx) error {
+		return updateClients(tx, ownerId, func(clients map[string]DbClient) error {
+			if _, exists := clients[clientId]; !exists {
+				return notFound("Client doesn't exist")
+			}
 
-	return nil
+			delete(clients, clientId)
+			return nil
+		})
+	})
 }
 
-func (a *Api) DeleteClient(tokenData TokenData, ownerId, clientId string) error {
+// Whoami describes the token making a request, so clients can find out which
+// user they're acting for without being told.
+func (a *Api) Whoami(tokenData TokenData, token string) apiclient.Me {
 
-	if tokenData.Owner != ownerId {
-		user, _ := a.db.GetUser(tokenData.Owner)
-		if !user.IsAdmin {
-			return errors.New("Unauthorized")
-		}
+	user, _ := a.db.GetUser(tokenData.Owner)
+
+	return apiclient.Me{
+		TokenId:     tokenId(token),
+		Owner:       tokenData.Owner,
+		Role:        user.Role,
+		IsAdmin:     user.Role == RoleAdmin,
+		Org:         tokenData.Org,
+		Orgs:        orgNames(a.db.GetOrgs(), tokenData.Owner),
+		Client:      tokenData.Client,
+		Description: tokenData.Description,
+		Scopes:      tokenData.Scopes,
+		ExpiresAt:   tokenData.ExpiresAt,
 	}
+}
 
-	owner, _ := a.db.GetUser(ownerId)
-	delete(owner.Clients, clientId)
-	a.db.SetUser(ownerId, owner)
+// GetAuditEntries returns the audit log entries matching the filter in
+// params, newest first. Only admins and auditors can read the audit log.
+func (a *Api) GetAuditEntries(tokenData TokenData, params url.Values) ([]AuditEntry, error) {
 
-	return nil
+	user, _ := a.db.GetUser(tokenData.Owner)
+	if !user.Can(PermAuditRead) || tokenData.Client != "" {
+		return nil, errUnauthorized
+	}
+
+	filter, err := parseAuditFilter(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.auditLog.Query(filter)
+}
+
+// audit records a change, or an attempt at one if err isn't nil, in the audit
+// log.
+func (a *Api) audit(tokenData TokenData, sourceIp, action, target string, err error) {
+
+	entry := AuditEntry{
+		Time:     time.Now().UTC(),
+		Actor:    tokenData.Owner,
+		Client:   tokenData.Client,
+		Action:   action,
+		Target:   target,
+		SourceIp: sourceIp,
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	recordErr := a.auditLog.Record(entry)
+	if recordErr != nil {
+		log.Printf("Failed to write audit log: %v", recordErr)
+	}
 }
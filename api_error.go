@@ -0,0 +1,84 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Error codes returned by the v1 API. Unlike the messages, these won't change.
+const (
+	ErrCodeInvalidRequest   = "invalid_request"
+	ErrCodeUnauthenticated  = "unauthenticated"
+	ErrCodeTokenExpired     = "token_expired"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeConflict         = "conflict"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeInternal         = "internal_error"
+)
+
+// ApiError is an error which knows which HTTP status and error code it should
+// be reported with. Errors which aren't ApiErrors are reported as internal
+// errors.
+type ApiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ApiError) Error() string {
+	return e.Message
+}
+
+func badRequest(format string, a ...interface{}) *ApiError {
+	return &ApiError{http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf(format, a...)}
+}
+
+func forbidden(format string, a ...interface{}) *ApiError {
+	return &ApiError{http.StatusForbidden, ErrCodeForbidden, fmt.Sprintf(format, a...)}
+}
+
+func notFound(format string, a ...interface{}) *ApiError {
+	return &ApiError{http.StatusNotFound, ErrCodeNotFound, fmt.Sprintf(format, a...)}
+}
+
+func conflict(format string, a ...interface{}) *ApiError {
+	return &ApiError{http.StatusConflict, ErrCodeConflict, fmt.Sprintf(format, a...)}
+}
+
+var errUnauthorized = forbidden("Unauthorized")
+
+// toApiError returns err as an ApiError, treating anything else as an
+// internal error.
+func toApiError(err error) *ApiError {
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return &ApiError{http.StatusInternalServerError, ErrCodeInternal, err.Error()}
+}
+
+// writeApiError responds with err in the v1 API error format:
+//
+//	{"error": {"code": "not_found", "message": "Tunnel doesn't exist"}}
+func writeApiError(w http.ResponseWriter, err error) {
+	apiErr := toApiError(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(struct {
+		Error *ApiError `json:"error"`
+	}{apiErr})
+}
+
+// writeLegacyError responds with err as plain text, for the endpoints which
+// predate the v1 API. The status is the same as in v1.
+func writeLegacyError(w http.ResponseWriter, err error) {
+	apiErr := toApiError(err)
+
+	w.WriteHeader(apiErr.Status)
+	io.WriteString(w, apiErr.Message)
+}
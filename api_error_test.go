@@ -0,0 +1,93 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// decodeApiError checks a v1 error response has the JSON content type, and
+// returns its error.
+func decodeApiError(t *testing.T, rec *httptest.ResponseRecorder) ApiError {
+	t.Helper()
+
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Got content type %q", rec.Header().Get("Content-Type"))
+	}
+
+	var body struct {
+		Error *ApiError `json:"error"`
+	}
+
+	err := json.Unmarshal(rec.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatalf("Invalid error body %q: %v", rec.Body.String(), err)
+	}
+
+	if body.Error == nil {
+		t.Fatalf("Error body %q has no error", rec.Body.String())
+	}
+
+	return *body.Error
+}
+
+func TestWriteApiError(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		code    string
+		message string
+	}{
+		{"badRequest", badRequest("Invalid port %s", "x"), http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid port x"},
+		{"forbidden", forbidden("Not yours"), http.StatusForbidden, ErrCodeForbidden, "Not yours"},
+		{"notFound", notFound("Tunnel doesn't exist"), http.StatusNotFound, ErrCodeNotFound, "Tunnel doesn't exist"},
+		{"conflict", conflict("Tunnel %s exists", "a.example.com"), http.StatusConflict, ErrCodeConflict, "Tunnel a.example.com exists"},
+		{"errUnauthorized", errUnauthorized, http.StatusForbidden, ErrCodeForbidden, "Unauthorized"},
+		{"methodNotAllowed", methodNotAllowed(httptest.NewRequest("PUT", "/me", nil)), http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method PUT not allowed for /api/v1/me"},
+		{"wrapped", fmt.Errorf("Saving: %w", notFound("Gone")), http.StatusNotFound, ErrCodeNotFound, "Gone"},
+		{"other error", errors.New("Disk full"), http.StatusInternalServerError, ErrCodeInternal, "Disk full"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeApiError(rec, test.err)
+
+			if rec.Code != test.status {
+				t.Errorf("Got status %d, want %d", rec.Code, test.status)
+			}
+
+			apiErr := decodeApiError(t, rec)
+			if apiErr.Code != test.code || apiErr.Message != test.message {
+				t.Errorf("Got error %+v, want code %s and message %q", apiErr, test.code, test.message)
+			}
+		})
+	}
+}
+
+func TestWriteLegacyError(t *testing.T) {
+
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{badRequest("Invalid port"), http.StatusBadRequest},
+		{forbidden("Not yours"), http.StatusForbidden},
+		{notFound("Tunnel doesn't exist"), http.StatusNotFound},
+		{errors.New("Disk full"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		writeLegacyError(rec, test.err)
+
+		if rec.Code != test.status || rec.Body.String() != test.err.Error() {
+			t.Errorf("%v: got %d %q, want %d", test.err, rec.Code, rec.Body.String(), test.status)
+		}
+	}
+}
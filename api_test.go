@@ -0,0 +1,135 @@
+package boringproxy
+
+import (
+	"net/url"
+	"testing"
+)
+
+func newTestApi(t *testing.T) *Api {
+	t.Helper()
+
+	return &Api{config: &Config{}, db: newTestDatabase(t)}
+}
+
+func TestTunnelSecretsRedacted(t *testing.T) {
+
+	api := newTestApi(t)
+
+	for username, role := range map[string]string{
+		"alice-member":  RoleMember,
+		"bob-member":    RoleMember,
+		"audrey-audits": RoleAuditor,
+		"oscar-operate": RoleOperator,
+	} {
+		err := api.db.AddUser(username, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := api.db.SetTunnel("app.example.com", Tunnel{
+		Domain:           "app.example.com",
+		Owner:            "alice-member",
+		ClientName:       "laptop",
+		TunnelPrivateKey: "private key",
+		AuthUsername:     "user",
+		AuthPassword:     "password",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   TokenData
+		secrets bool
+	}{
+		{"owner", TokenData{Owner: "alice-member"}, true},
+		{"owner read-only", TokenData{Owner: "alice-member", Scopes: []string{ScopeReadOnly}}, false},
+		{"owner other scope", TokenData{Owner: "alice-member", Scopes: []string{ScopeTokensWrite}}, false},
+		{"tunnel's client read-only", TokenData{Owner: "alice-member", Client: "laptop", Scopes: []string{ScopeReadOnly}}, true},
+		{"other client", TokenData{Owner: "alice-member", Client: "desktop"}, false},
+		{"auditor", TokenData{Owner: "audrey-audits"}, false},
+		{"operator", TokenData{Owner: "oscar-operate"}, true},
+		{"operator read-only", TokenData{Owner: "oscar-operate", Scopes: []string{ScopeReadOnly}}, false},
+	}
+
+	params := url.Values{}
+	params.Set("domain", "app.example.com")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			tunnels := []Tunnel{}
+
+			if tun, exists := api.GetTunnels(test.token)["app.example.com"]; exists {
+				tunnels = append(tunnels, tun)
+			}
+
+			tun, err := api.GetTunnel(test.token, params)
+			if err == nil {
+				tunnels = append(tunnels, tun)
+			}
+
+			if len(tunnels) == 0 {
+				t.Fatal("Tunnel not visible")
+			}
+
+			for _, tun := range tunnels {
+				hasSecrets := tun.TunnelPrivateKey != "" || tun.AuthPassword != ""
+				if hasSecrets != test.secrets {
+					t.Errorf("Got secrets %v, want %v", hasSecrets, test.secrets)
+				}
+
+				if tun.AuthUsername != "user" {
+					t.Errorf("Got username %q, want it left in", tun.AuthUsername)
+				}
+			}
+		})
+	}
+
+	_, err = api.GetTunnel(TokenData{Owner: "bob-member"}, params)
+	if err == nil {
+		t.Error("Other members can see the tunnel")
+	}
+}
+
+func TestCheckTunnelPort(t *testing.T) {
+
+	api := newTestApi(t)
+
+	for username, role := range map[string]string{
+		"alice-member": RoleMember,
+		"adam-admin":   RoleAdmin,
+	} {
+		err := api.db.AddUser(username, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		token TokenData
+		port  int
+		ok    bool
+	}{
+		{"member", TokenData{Owner: "alice-member"}, 8080, true},
+		{"member privileged", TokenData{Owner: "alice-member"}, 443, false},
+		{"admin privileged", TokenData{Owner: "adam-admin"}, 443, true},
+		{"admin org token privileged", TokenData{Owner: "adam-admin", Org: "acme"}, 443, false},
+		{"zero", TokenData{Owner: "adam-admin"}, 0, false},
+		{"negative", TokenData{Owner: "adam-admin"}, -1, false},
+		{"highest", TokenData{Owner: "alice-member"}, 65535, true},
+		{"too high", TokenData{Owner: "adam-admin"}, 65536, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := api.checkTunnelPort(test.token, test.port)
+			if (err == nil) != test.ok {
+				t.Errorf("Got error %v, want success %v", err, test.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,700 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/boringproxy/boringproxy/apiclient"
+)
+
+// The v1 API lives under /api/v1. Unlike the original API, it takes JSON
+// request bodies, and reports errors as
+//
+//	{"error": {"code": "not_found", "message": "Tunnel doesn't exist"}}
+//
+// with a matching 4xx or 5xx status. See openapi.json for the full reference.
+// The handlers translate requests into the parameters the original API uses,
+// so both go through the same checks and are audited the same way. The
+// request and response types are shared with the apiclient package.
+
+func (a *Api) handleV1(w http.ResponseWriter, r *http.Request) {
+
+	path := strings.Trim(r.URL.Path, "/")
+
+	if path == "openapi.json" {
+		a.handleV1OpenApi(w, r)
+		return
+	}
+
+	tokenData, ok := a.authenticateV1(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(path, "/")
+
+	var err error
+
+	switch parts[0] {
+	case "me":
+		err = a.handleV1Me(w, r, tokenData, parts[1:])
+	case "tunnels":
+		err = a.handleV1Tunnels(w, r, tokenData, parts[1:])
+	case "users":
+		err = a.handleV1Users(w, r, tokenData, parts[1:])
+	case "orgs":
+		err = a.handleV1Orgs(w, r, tokenData, parts[1:])
+	case "tokens":
+		err = a.handleV1Tokens(w, r, tokenData, parts[1:])
+	case "audit":
+		err = a.handleV1Audit(w, r, tokenData, parts[1:])
+	default:
+		err = notFound("Unknown endpoint /api/v1/%s", path)
+	}
+
+	if err != nil {
+		writeApiError(w, err)
+	}
+}
+
+// authenticateV1 is authenticate for the v1 API.
+func (a *Api) authenticateV1(w http.ResponseWriter, r *http.Request) (TokenData, bool) {
+
+	token, err := extractToken("access_token", r)
+	if err != nil {
+		writeApiError(w, &ApiError{http.StatusUnauthorized, ErrCodeUnauthenticated, "No token provided"})
+		return TokenData{}, false
+	}
+
+	tokenData, err := a.db.ValidateToken(token)
+	if err == errExpiredToken {
+		writeApiError(w, &ApiError{http.StatusUnauthorized, ErrCodeTokenExpired, "Token expired"})
+		return TokenData{}, false
+	} else if err != nil {
+		writeApiError(w, &ApiError{http.StatusUnauthorized, ErrCodeUnauthenticated, "Invalid token"})
+		return TokenData{}, false
+	}
+
+	return tokenData, true
+}
+
+func (a *Api) handleV1OpenApi(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		writeApiError(w, methodNotAllowed(r))
+		return
+	}
+
+	spec, err := fs.ReadFile("openapi.json")
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(spec)
+}
+
+func (a *Api) handleV1Me(w http.ResponseWriter, r *http.Request, tokenData TokenData, parts []string) error {
+
+	if len(parts) != 0 {
+		return notFound("Unknown endpoint /api/v1%s", r.URL.Path)
+	}
+
+	if r.Method != "GET" {
+		return methodNotAllowed(r)
+	}
+
+	token, _ := extractToken("access_token", r)
+
+	writeJson(w, http.StatusOK, a.Whoami(tokenData, token))
+	return nil
+}
+
+// handleV1Tunnels serves /tunnels and /tunnels/{domain}
+func (a *Api) handleV1Tunnels(w http.ResponseWriter, r *http.Request, tokenData TokenData, parts []string) error {
+
+	if len(parts) > 1 {
+		return notFound("Unknown endpoint /api/v1%s", r.URL.Path)
+	}
+
+	if len(parts) == 0 {
+		switch r.Method {
+		case "GET":
+			clientName := r.URL.Query().Get("client-name")
+			if clientName != "" && tokenData.Client != "" && clientName != tokenData.Client {
+				return forbidden("Token is not valid for this client")
+			}
+
+			wait, err := parseWait(r.URL.Query())
+			if err != nil {
+				return err
+			}
+
+			body, etag, notModified, err := a.watchTunnels(r.Context(), tokenData, r.URL.Query().Get("owner"), clientName, wait, r.Header.Get("If-None-Match"))
+			if err != nil {
+				if r.Context().Err() != nil {
+					// Client went away
+					return nil
+				}
+				return err
+			}
+
+			w.Header().Set("ETag", etag)
+
+			if notModified {
+				w.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+			return nil
+		case "POST":
+			if tokenData.Client != "" {
+				return forbidden("Token cannot be used to create tunnels")
+			}
+
+			var req apiclient.TunnelRequest
+			err := readJson(r, &req)
+			if err != nil {
+				return err
+			}
+
+			if req.RotateKey != nil {
+				return badRequest("rotate_key can only be used when updating a tunnel")
+			}
+
+			tun, err := a.CreateTunnel(tokenData, sourceIp(r), tunnelRequestParams(req))
+			if err != nil {
+				return err
+			}
+
+			writeJson(w, http.StatusCreated, tun)
+			return nil
+		default:
+			return methodNotAllowed(r)
+		}
+	}
+
+	domain := parts[0]
+
+	params := url.Values{}
+	params.Set("domain", domain)
+
+	switch r.Method {
+	case "GET":
+		tun, err := a.GetTunnel(tokenData, params)
+		if err != nil {
+			return err
+		}
+
+		if tokenData.Client != "" && tokenData.Client != tun.ClientName {
+			return errUnauthorized
+		}
+
+		tun.ServerPublicKey = a.tunMan.ServerPublicKey()
+
+		writeJson(w, http.StatusOK, tun)
+		return nil
+	case "PATCH":
+		if tokenData.Client != "" {
+			return forbidden("Token cannot be used to update tunnels")
+		}
+
+		var req apiclient.TunnelRequest
+		err := readJson(r, &req)
+		if err != nil {
+			return err
+		}
+
+		if req.Domain != nil && *req.Domain != domain {
+			return badRequest("Tunnel domain can't be changed")
+		}
+
+		if req.ServerAddress != nil || req.ServerPort != nil {
+			return badRequest("Tunnel server address and port can't be changed")
+		}
+
+		tun, err := a.UpdateTunnel(tokenData, sourceIp(r), domain, tunnelRequestParams(req))
+		if err != nil {
+			return err
+		}
+
+		writeJson(w, http.StatusOK, tun)
+		return nil
+	case "DELETE":
+		if tokenData.Client != "" {
+			return forbidden("Token cannot be used to delete tunnels")
+		}
+
+		err := a.DeleteTunnel(tokenData, sourceIp(r), params)
+		if err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return methodNotAllowed(r)
+	}
+}
+
+// tunnelRequestParams converts a request to the parameters createTunnel and
+// updateTunnel take.
+func tunnelRequestParams(t apiclient.TunnelRequest) url.Values {
+
+	params := url.Values{}
+
+	setString := func(name string, value *string) {
+		if value != nil {
+			params.Set(name, *value)
+		}
+	}
+
+	setInt := func(name string, value *int) {
+		if value != nil {
+			params.Set(name, strconv.Itoa(*value))
+		}
+	}
+
+	setBool := func(name string, value *bool) {
+		if value != nil {
+			if *value {
+				params.Set(name, "on")
+			} else {
+				params.Set(name, "off")
+			}
+		}
+	}
+
+	setString("domain", t.Domain)
+	setString("owner", t.Owner)
+	setString("client-name", t.ClientName)
+	setString("client-addr", t.ClientAddress)
+	setInt("client-port", t.ClientPort)
+	setString("tls-termination", t.TlsTermination)
+	setBool("allow-external-tcp", t.AllowExternalTcp)
+	setBool("disable-buffering", t.DisableBuffering)
+	setString("ssh-server-addr", t.ServerAddress)
+	setInt("ssh-server-port", t.ServerPort)
+	setBool("rotate-key", t.RotateKey)
+
+	if t.TunnelPort != nil {
+		if *t.TunnelPort == 0 {
+			params.Set("tunnel-port", "Random")
+		} else {
+			setInt("tunnel-port", t.TunnelPort)
+		}
+	}
+
+	if t.AuthUsername != nil && *t.AuthUsername == "" {
+		params.Set("password-protect", "off")
+	} else if t.AuthUsername != nil || t.AuthPassword != nil {
+		params.Set("password-protect", "on")
+		setString("username", t.AuthUsername)
+		setString("password", t.AuthPassword)
+	}
+
+	return params
+}
+
+// handleV1Users serves /users, /users/{username},
+// /users/{username}/clients and /users/{username}/clients/{name}
+func (a *Api) handleV1Users(w http.ResponseWriter, r *http.Request, tokenData TokenData, parts []string) error {
+
+	if len(parts) > 1 && parts[1] == "clients" {
+		return a.handleV1Clients(w, r, tokenData, parts[0], parts[2:])
+	}
+
+	if tokenData.Client != "" {
+		return forbidden("Token cannot be used to manage users")
+	}
+
+	if len(parts) > 1 {
+		return notFound("Unknown endpoint /api/v1%s", r.URL.Path)
+	}
+
+	if len(parts) == 0 {
+		switch r.Method {
+		case "GET":
+			writeJson(w, http.StatusOK, a.GetUsers(tokenData, nil))
+			return nil
+		case "POST":
+			var req apiclient.UserRequest
+			err := readJson(r, &req)
+			if err != nil {
+				return err
+			}
+
+			params := url.Values{}
+			params.Set("username", req.Username)
+			params.Set("role", req.Role)
+			if req.IsAdmin {
+				params.Set("is-admin", "on")
+			}
+
+			err = a.CreateUser(tokenData, sourceIp(r), params)
+			if err != nil {
+				return err
+			}
+
+			user, _ := a.db.GetUser(req.Username)
+
+			writeJson(w, http.StatusCreated, user)
+			return nil
+		default:
+			return methodNotAllowed(r)
+		}
+	}
+
+	username := parts[0]
+
+	switch r.Method {
+	case "GET":
+		user, exists := a.GetUsers(tokenData, nil)[username]
+		if !exists {
+			return notFound("User doesn't exist")
+		}
+
+		writeJson(w, http.StatusOK, user)
+		return nil
+	case "PATCH":
+		var req apiclient.UserRequest
+		err := readJson(r, &req)
+		if err != nil {
+			return err
+		}
+
+		if req.Username != "" && req.Username != username {
+			return badRequest("Username can't be changed")
+		}
+
+		role := req.Role
+		if role == "" && req.IsAdmin {
+			role = RoleAdmin
+		}
+
+		if role == "" {
+			return badRequest("Nothing to update")
+		}
+
+		params := url.Values{}
+		params.Set("username", username)
+		params.Set("role", role)
+
+		err = a.SetUserRole(tokenData, sourceIp(r), params)
+		if err != nil {
+			return err
+		}
+
+		user, _ := a.db.GetUser(username)
+
+		writeJson(w, http.StatusOK, user)
+		return nil
+	case "DELETE":
+		params := url.Values{}
+		params.Set("username", username)
+
+		err := a.DeleteUser(tokenData, sourceIp(r), params)
+		if err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return methodNotAllowed(r)
+	}
+}
+
+// handleV1Clients serves the clients of a user or org. Since they share a
+// namespace, either works under /users or /orgs.
+func (a *Api) handleV1Clients(w http.ResponseWriter, r *http.Request, tokenData TokenData, owner string, parts []string) error {
+
+	if len(parts) > 1 {
+		return notFound("Unknown endpoint /api/v1%s", r.URL.Path)
+	}
+
+	if len(parts) == 0 {
+		if r.Method != "GET" {
+			return methodNotAllowed(r)
+		}
+
+		ownerClients, exists := a.GetClients(tokenData, owner)
+		if !exists {
+			return notFound("User or org doesn't exist")
+		}
+
+		clients := ownerClients
+		if tokenData.Client != "" {
+			clients = make(map[string]DbClient)
+			if client, exists := ownerClients[tokenData.Client]; exists {
+				clients[tokenData.Client] = client
+			}
+		}
+
+		writeJson(w, http.StatusOK, clients)
+		return nil
+	}
+
+	clientName := parts[0]
+
+	if tokenData.Client != "" && tokenData.Client != clientName {
+		return forbidden("Token is not valid for this client")
+	}
+
+	switch r.Method {
+	case "GET":
+		clients, exists := a.GetClients(tokenData, owner)
+		if !exists {
+			return notFound("User or org doesn't exist")
+		}
+
+		client, exists := clients[clientName]
+		if !exists {
+			return notFound("Client doesn't exist")
+		}
+
+		writeJson(w, http.StatusOK, client)
+		return nil
+	case "PUT":
+		err := a.SetClient(tokenData, sourceIp(r), nil, owner, clientName)
+		if err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case "DELETE":
+		err := a.DeleteClient(tokenData, sourceIp(r), owner, clientName)
+		if err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return methodNotAllowed(r)
+	}
+}
+
+// handleV1Orgs serves /orgs, /orgs/{name}, /orgs/{name}/members/{username},
+// /orgs/{name}/clients and /orgs/{name}/clients/{client}
+func (a *Api) handleV1Orgs(w http.ResponseWriter, r *http.Request, tokenData TokenData, parts []string) error {
+
+	if len(parts) > 1 && parts[1] == "clients" {
+		return a.handleV1Clients(w, r, tokenData, parts[0], parts[2:])
+	}
+
+	if tokenData.Client != "" {
+		return forbidden("Token cannot be used to manage orgs")
+	}
+
+	if len(parts) == 0 {
+		switch r.Method {
+		case "GET":
+			writeJson(w, http.StatusOK, a.GetOrgs(tokenData))
+			return nil
+		case "POST":
+			var req apiclient.OrgRequest
+			err := readJson(r, &req)
+			if err != nil {
+				return err
+			}
+
+			params := url.Values{}
+			params.Set("name", req.Name)
+
+			err = a.CreateOrg(tokenData, sourceIp(r), params)
+			if err != nil {
+				return err
+			}
+
+			org, _ := a.db.GetOrg(req.Name)
+
+			writeJson(w, http.StatusCreated, org)
+			return nil
+		default:
+			return methodNotAllowed(r)
+		}
+	}
+
+	name := parts[0]
+
+	params := url.Values{}
+	params.Set("name", name)
+
+	if len(parts) == 3 && parts[1] == "members" {
+		params.Set("username", parts[2])
+
+		var err error
+		switch r.Method {
+		case "PUT":
+			err = a.SetOrgMember(tokenData, sourceIp(r), params)
+		case "DELETE":
+			err = a.DeleteOrgMember(tokenData, sourceIp(r), params)
+		default:
+			return methodNotAllowed(r)
+		}
+		if err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if len(parts) > 1 {
+		return notFound("Unknown endpoint /api/v1%s", r.URL.Path)
+	}
+
+	switch r.Method {
+	case "GET":
+		org, exists := a.GetOrgs(tokenData)[name]
+		if !exists {
+			return notFound("Org doesn't exist")
+		}
+
+		writeJson(w, http.StatusOK, org)
+		return nil
+	case "DELETE":
+		err := a.DeleteOrg(tokenData, sourceIp(r), params)
+		if err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return methodNotAllowed(r)
+	}
+}
+
+// handleV1Tokens serves /tokens and /tokens/{id}
+func (a *Api) handleV1Tokens(w http.ResponseWriter, r *http.Request, tokenData TokenData, parts []string) error {
+
+	if tokenData.Client != "" {
+		return forbidden("Token cannot be used to manage tokens")
+	}
+
+	if len(parts) > 1 {
+		return notFound("Unknown endpoint /api/v1%s", r.URL.Path)
+	}
+
+	if len(parts) == 0 {
+		switch r.Method {
+		case "GET":
+			writeJson(w, http.StatusOK, a.GetTokens(tokenData, nil))
+			return nil
+		case "POST":
+			var req apiclient.TokenRequest
+			err := readJson(r, &req)
+			if err != nil {
+				return err
+			}
+
+			params := url.Values{}
+			params.Set("owner", req.Owner)
+			if req.Owner == "" {
+				params.Set("owner", tokenData.Owner)
+			}
+			params.Set("client", req.Client)
+			if req.Client == "" {
+				params.Set("client", "any")
+			}
+			params.Set("description", req.Description)
+			params.Set("org", req.Org)
+			if req.ExpiresInDays != 0 {
+				params.Set("expires-in-days", strconv.Itoa(req.ExpiresInDays))
+			}
+			params["scope"] = req.Scopes
+
+			token, err := a.CreateToken(tokenData, sourceIp(r), params)
+			if err != nil {
+				return err
+			}
+
+			writeJson(w, http.StatusCreated, apiclient.TokenResponse{
+				Id:    tokenId(token),
+				Token: token,
+			})
+			return nil
+		default:
+			return methodNotAllowed(r)
+		}
+	}
+
+	id := parts[0]
+
+	switch r.Method {
+	case "GET":
+		tok, exists := a.GetTokens(tokenData, nil)[id]
+		if !exists {
+			return notFound("Token doesn't exist")
+		}
+
+		writeJson(w, http.StatusOK, tok)
+		return nil
+	case "DELETE":
+		params := url.Values{}
+		params.Set("id", id)
+
+		err := a.DeleteToken(tokenData, sourceIp(r), params)
+		if err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return methodNotAllowed(r)
+	}
+}
+
+func (a *Api) handleV1Audit(w http.ResponseWriter, r *http.Request, tokenData TokenData, parts []string) error {
+
+	if len(parts) != 0 {
+		return notFound("Unknown endpoint /api/v1%s", r.URL.Path)
+	}
+
+	if r.Method != "GET" {
+		return methodNotAllowed(r)
+	}
+
+	entries, err := a.GetAuditEntries(tokenData, r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	writeJson(w, http.StatusOK, entries)
+	return nil
+}
+
+func methodNotAllowed(r *http.Request) *ApiError {
+	return &ApiError{http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, fmt.Sprintf("Method %s not allowed for /api/v1%s", r.Method, r.URL.Path)}
+}
+
+// readJson decodes the request body into v, refusing unknown fields so typos
+// don't go unnoticed.
+func readJson(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err != nil {
+		return badRequest("Invalid JSON body: %v", err)
+	}
+
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
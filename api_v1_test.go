@@ -0,0 +1,70 @@
+package boringproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestV1Errors(t *testing.T) {
+
+	api := newTestApi(t)
+
+	err := api.db.AddUser("alice", RoleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := api.db.AddToken(TokenData{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := api.db.AddToken(TokenData{
+		Owner:     "alice",
+		ExpiresAt: time.Now().UTC().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+		status int
+		code   string
+	}{
+		{"no token", "GET", "/me", "", http.StatusUnauthorized, ErrCodeUnauthenticated},
+		{"malformed header", "GET", "/me", "Basic abc", http.StatusUnauthorized, ErrCodeUnauthenticated},
+		{"invalid token", "GET", "/me", "Bearer abcd1234.wrong", http.StatusUnauthorized, ErrCodeUnauthenticated},
+		{"expired token", "GET", "/me", "Bearer " + expired, http.StatusUnauthorized, ErrCodeTokenExpired},
+		{"unknown endpoint", "GET", "/nothing", "Bearer " + token, http.StatusNotFound, ErrCodeNotFound},
+		{"wrong method", "DELETE", "/me", "Bearer " + token, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+		{"missing tunnel", "GET", "/tunnels/missing.example.com", "Bearer " + token, http.StatusNotFound, ErrCodeNotFound},
+		{"audit log as member", "GET", "/audit", "Bearer " + token, http.StatusForbidden, ErrCodeForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, nil)
+			if test.auth != "" {
+				req.Header.Set("Authorization", test.auth)
+			}
+
+			rec := httptest.NewRecorder()
+			api.handleV1(rec, req)
+
+			if rec.Code != test.status {
+				t.Errorf("Got status %d, want %d: %s", rec.Code, test.status, rec.Body.String())
+			}
+
+			apiErr := decodeApiError(t, rec)
+			if apiErr.Code != test.code {
+				t.Errorf("Got code %s, want %s", apiErr.Code, test.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Package apiclient is a client for the boringproxy server's v1 API
+// (/api/v1).
+//
+//	api := apiclient.New("bp.example.com", token, nil)
+//	tunnels, err := api.ListTunnels(ctx, apiclient.ListTunnelsOptions{})
+//
+// Errors reported by the server are returned as *Error.
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 2
+	defaultRetryDelay = 500 * time.Millisecond
+)
+
+type Client struct {
+	baseUrl    string
+	token      string
+	httpClient *http.Client
+	maxRetries int
+	retryDelay time.Duration
+}
+
+type Options struct {
+	// Defaults to http.DefaultClient
+	HttpClient *http.Client
+	// How many times to retry a request which failed because the server
+	// couldn't be reached or was temporarily unavailable. Only requests
+	// which are safe to repeat (GET, PUT and DELETE) are retried. Defaults
+	// to 2. Set it to -1 to disable retries.
+	MaxRetries int
+	// Delay before the first retry. It doubles for every retry after that.
+	// Defaults to 500ms.
+	RetryDelay time.Duration
+}
+
+// New returns a client for the server at server, which is either a host name
+// like bp.example.com (which is reached over HTTPS), or a URL like
+// http://localhost:8080. opts can be nil.
+func New(server, token string, opts *Options) *Client {
+
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	baseUrl := strings.TrimSuffix(server, "/")
+	if !strings.Contains(baseUrl, "://") {
+		baseUrl = "https://" + baseUrl
+	}
+
+	httpClient := opts.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	maxRetries := opts.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	} else if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	retryDelay := opts.RetryDelay
+	if retryDelay == 0 {
+		retryDelay = defaultRetryDelay
+	}
+
+	return &Client{
+		baseUrl:    baseUrl + "/api/v1",
+		token:      token,
+		httpClient: httpClient,
+		maxRetries: maxRetries,
+		retryDelay: retryDelay,
+	}
+}
+
+// do sends a request to the API and decodes the JSON response into out, if
+// it's not nil. in is encoded as the JSON request body if it's not nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	_, err := c.doRequest(ctx, method, path, nil, in, out)
+	return err
+}
+
+func (c *Client) doRequest(ctx context.Context, method, path string, header http.Header, in, out interface{}) (*http.Response, error) {
+
+	var reqBody []byte
+	if in != nil {
+		var err error
+		reqBody, err = json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	retries := 0
+	if method == "GET" || method == "PUT" || method == "DELETE" {
+		retries = c.maxRetries
+	}
+
+	delay := c.retryDelay
+
+	for attempt := 0; ; attempt++ {
+
+		resp, body, err := c.send(ctx, method, path, header, reqBody)
+
+		if attempt < retries && retryable(resp, err) && ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+
+			delay *= 2
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= 400 {
+			return resp, parseError(resp, body)
+		}
+
+		if out != nil && resp.StatusCode != http.StatusNotModified && resp.StatusCode != http.StatusNoContent {
+			err = json.Unmarshal(body, out)
+			if err != nil {
+				return resp, err
+			}
+		}
+
+		return resp, nil
+	}
+}
+
+// send makes a single attempt at a request, returning the response with its
+// body already read.
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, reqBody []byte) (*http.Response, []byte, error) {
+
+	var bodyReader io.Reader
+	if reqBody != nil {
+		bodyReader = bytes.NewReader(reqBody)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseUrl+path, bodyReader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, body, nil
+}
+
+// retryable reports whether a request might succeed if it's tried again.
+func retryable(resp *http.Response, err error) bool {
+
+	if err != nil {
+		var netErr net.Error
+		return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
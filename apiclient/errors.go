@@ -0,0 +1,90 @@
+package apiclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error codes reported by the server
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeUnauthenticated  = "unauthenticated"
+	CodeTokenExpired     = "token_expired"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeInternal         = "internal_error"
+)
+
+// Error is an error response from the server.
+type Error struct {
+	StatusCode int
+	// One of the Code constants. Empty if the response didn't come from
+	// the v1 API, ie from a proxy in front of the server.
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("HTTP Status code: %d. Message: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// IsNotFound reports whether err is an *Error for something which doesn't
+// exist.
+func IsNotFound(err error) bool {
+	return hasCode(err, CodeNotFound)
+}
+
+// IsConflict reports whether err is an *Error for something which is already
+// in use, ie a tunnel domain or port.
+func IsConflict(err error) bool {
+	return hasCode(err, CodeConflict)
+}
+
+// IsForbidden reports whether err is an *Error for a token which isn't
+// allowed to do what was asked.
+func IsForbidden(err error) bool {
+	return hasCode(err, CodeForbidden)
+}
+
+// IsUnauthenticated reports whether err is an *Error for a missing, invalid
+// or expired token.
+func IsUnauthenticated(err error) bool {
+	return hasCode(err, CodeUnauthenticated) || hasCode(err, CodeTokenExpired)
+}
+
+func hasCode(err error, code string) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+func parseError(resp *http.Response, body []byte) *Error {
+
+	var envelope struct {
+		Error *struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+
+	err := json.Unmarshal(body, &envelope)
+	if err == nil && envelope.Error != nil {
+		return &Error{
+			StatusCode: resp.StatusCode,
+			Code:       envelope.Error.Code,
+			Message:    envelope.Error.Message,
+		}
+	}
+
+	return &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+	}
+}
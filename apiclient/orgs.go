@@ -0,0 +1,48 @@
+package apiclient
+
+import (
+	"context"
+	"net/url"
+)
+
+// ListOrgs returns the orgs the user is a member of, or every org for users
+// who can see everything.
+func (c *Client) ListOrgs(ctx context.Context) (map[string]Org, error) {
+	orgs := make(map[string]Org)
+	err := c.do(ctx, "GET", "/orgs", nil, &orgs)
+	return orgs, err
+}
+
+func (c *Client) GetOrg(ctx context.Context, name string) (Org, error) {
+	var org Org
+	err := c.do(ctx, "GET", "/orgs/"+url.PathEscape(name), nil, &org)
+	return org, err
+}
+
+func (c *Client) CreateOrg(ctx context.Context, req OrgRequest) (Org, error) {
+	var org Org
+	err := c.do(ctx, "POST", "/orgs", req, &org)
+	return org, err
+}
+
+// DeleteOrg deletes an org along with the tokens limited to it. Orgs which
+// still own tunnels can't be deleted.
+func (c *Client) DeleteOrg(ctx context.Context, name string) error {
+	return c.do(ctx, "DELETE", "/orgs/"+url.PathEscape(name), nil, nil)
+}
+
+// AddOrgMember adds a user to an org. It's not an error if they're already
+// a member.
+func (c *Client) AddOrgMember(ctx context.Context, name, username string) error {
+	return c.do(ctx, "PUT", orgMemberPath(name, username), nil, nil)
+}
+
+// RemoveOrgMember removes a user from an org, and deletes their tokens which
+// are limited to it.
+func (c *Client) RemoveOrgMember(ctx context.Context, name, username string) error {
+	return c.do(ctx, "DELETE", orgMemberPath(name, username), nil, nil)
+}
+
+func orgMemberPath(name, username string) string {
+	return "/orgs/" + url.PathEscape(name) + "/members/" + url.PathEscape(username)
+}
@@ -0,0 +1,75 @@
+package apiclient
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Whoami describes the token the client is using, including the user it
+// belongs to and the client it's limited to, if any.
+func (c *Client) Whoami(ctx context.Context) (Me, error) {
+	var me Me
+	err := c.do(ctx, "GET", "/me", nil, &me)
+	return me, err
+}
+
+// ListTokens returns every token for users who can see everything (admins,
+// operators and auditors), or the user's own tokens and their orgs' tokens
+// for members, keyed by id.
+func (c *Client) ListTokens(ctx context.Context) (map[string]Token, error) {
+	tokens := make(map[string]Token)
+	err := c.do(ctx, "GET", "/tokens", nil, &tokens)
+	return tokens, err
+}
+
+func (c *Client) GetToken(ctx context.Context, id string) (Token, error) {
+	var tok Token
+	err := c.do(ctx, "GET", "/tokens/"+url.PathEscape(id), nil, &tok)
+	return tok, err
+}
+
+func (c *Client) CreateToken(ctx context.Context, req TokenRequest) (TokenResponse, error) {
+	var resp TokenResponse
+	err := c.do(ctx, "POST", "/tokens", req, &resp)
+	return resp, err
+}
+
+func (c *Client) DeleteToken(ctx context.Context, id string) error {
+	return c.do(ctx, "DELETE", "/tokens/"+url.PathEscape(id), nil, nil)
+}
+
+// ListAuditEntries returns the audit log entries matching filter, newest
+// first. Only admins and auditors can read the audit log.
+func (c *Client) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+
+	query := url.Values{}
+	if filter.Actor != "" {
+		query.Set("actor", filter.Actor)
+	}
+	if filter.Action != "" {
+		query.Set("action", filter.Action)
+	}
+	if filter.Target != "" {
+		query.Set("target", filter.Target)
+	}
+	if !filter.Since.IsZero() {
+		query.Set("since", filter.Since.Format(time.RFC3339))
+	}
+	if !filter.Until.IsZero() {
+		query.Set("until", filter.Until.Format(time.RFC3339))
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+
+	path := "/audit"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var entries []AuditEntry
+	err := c.do(ctx, "GET", path, nil, &entries)
+	return entries, err
+}
@@ -0,0 +1,94 @@
+package apiclient
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type ListTunnelsOptions struct {
+	// Only return the tunnels belonging to this user or org
+	Owner string
+	// Only return the tunnels for this client. The server port is filled
+	// in for these, so they're ready to connect to.
+	ClientName string
+	// If ETag is set and the tunnels haven't changed since it was
+	// returned, wait up to this long for them to change. The server caps
+	// it at a minute.
+	Wait time.Duration
+	ETag string
+}
+
+type TunnelList struct {
+	// Keyed by domain. Nil if NotModified is set.
+	Tunnels map[string]Tunnel
+	ETag    string
+	// Set if the tunnels didn't change from ListTunnelsOptions.ETag within
+	// ListTunnelsOptions.Wait
+	NotModified bool
+}
+
+// ListTunnels returns the tunnels visible to the token. That's the tunnels
+// of the user and their orgs, or every tunnel for users who can see
+// everything.
+func (c *Client) ListTunnels(ctx context.Context, opts ListTunnelsOptions) (*TunnelList, error) {
+
+	query := url.Values{}
+	if opts.Owner != "" {
+		query.Set("owner", opts.Owner)
+	}
+	if opts.ClientName != "" {
+		query.Set("client-name", opts.ClientName)
+	}
+	if opts.Wait > 0 {
+		query.Set("wait", strconv.Itoa(int(opts.Wait.Seconds())))
+	}
+
+	path := "/tunnels"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	header := http.Header{}
+	if opts.Wait > 0 && opts.ETag != "" {
+		header.Set("If-None-Match", opts.ETag)
+	}
+
+	list := &TunnelList{}
+
+	resp, err := c.doRequest(ctx, "GET", path, header, nil, &list.Tunnels)
+	if err != nil {
+		return nil, err
+	}
+
+	list.ETag = resp.Header.Get("ETag")
+	list.NotModified = resp.StatusCode == http.StatusNotModified
+
+	return list, nil
+}
+
+func (c *Client) GetTunnel(ctx context.Context, domain string) (Tunnel, error) {
+	var tun Tunnel
+	err := c.do(ctx, "GET", "/tunnels/"+url.PathEscape(domain), nil, &tun)
+	return tun, err
+}
+
+func (c *Client) CreateTunnel(ctx context.Context, req TunnelRequest) (Tunnel, error) {
+	var tun Tunnel
+	err := c.do(ctx, "POST", "/tunnels", req, &tun)
+	return tun, err
+}
+
+// UpdateTunnel changes the fields which are set in req, leaving the rest
+// alone.
+func (c *Client) UpdateTunnel(ctx context.Context, domain string, req TunnelRequest) (Tunnel, error) {
+	var tun Tunnel
+	err := c.do(ctx, "PATCH", "/tunnels/"+url.PathEscape(domain), req, &tun)
+	return tun, err
+}
+
+func (c *Client) DeleteTunnel(ctx context.Context, domain string) error {
+	return c.do(ctx, "DELETE", "/tunnels/"+url.PathEscape(domain), nil, nil)
+}
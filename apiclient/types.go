@@ -0,0 +1,184 @@
+package apiclient
+
+import (
+	"time"
+)
+
+// Tunnel is a tunnel as the server reports it. TunnelPrivateKey and
+// AuthPassword are empty unless the token is limited to the tunnel's client,
+// or is allowed to change the tunnel.
+type Tunnel struct {
+	Domain           string `json:"domain"`
+	ServerAddress    string `json:"server_address"`
+	ServerPort       int    `json:"server_port"`
+	ServerPublicKey  string `json:"server_public_key"`
+	Username         string `json:"username"`
+	TunnelPort       int    `json:"tunnel_port"`
+	TunnelPrivateKey string `json:"tunnel_private_key"`
+	ClientAddress    string `json:"client_address"`
+	ClientPort       int    `json:"client_port"`
+	AllowExternalTcp bool   `json:"allow_external_tcp"`
+	TlsTermination   string `json:"tls_termination"`
+	DisableBuffering bool   `json:"disable_buffering"`
+	Owner            string `json:"owner"`
+	ClientName       string `json:"client_name"`
+	AuthUsername     string `json:"auth_username"`
+	AuthPassword     string `json:"auth_password"`
+}
+
+// TunnelRequest is the body for creating or updating a tunnel. Fields which
+// are left nil keep their current value when updating. String, Int and Bool
+// help with filling it in.
+type TunnelRequest struct {
+	Domain        *string `json:"domain,omitempty"`
+	Owner         *string `json:"owner,omitempty"`
+	ClientName    *string `json:"client_name,omitempty"`
+	ClientAddress *string `json:"client_address,omitempty"`
+	ClientPort    *int    `json:"client_port,omitempty"`
+	// 0 picks a random port
+	TunnelPort       *int    `json:"tunnel_port,omitempty"`
+	TlsTermination   *string `json:"tls_termination,omitempty"`
+	AllowExternalTcp *bool   `json:"allow_external_tcp,omitempty"`
+	DisableBuffering *bool   `json:"disable_buffering,omitempty"`
+	// Setting AuthUsername to "" turns password protection off
+	AuthUsername *string `json:"auth_username,omitempty"`
+	AuthPassword *string `json:"auth_password,omitempty"`
+	// Only used when creating a tunnel
+	ServerAddress *string `json:"server_address,omitempty"`
+	ServerPort    *int    `json:"server_port,omitempty"`
+	// Only used when updating a tunnel
+	RotateKey *bool `json:"rotate_key,omitempty"`
+}
+
+// User roles
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleMember   = "member"
+	RoleAuditor  = "auditor"
+)
+
+type User struct {
+	// One of the Role constants
+	Role string `json:"role"`
+	// Same as Role == RoleAdmin
+	IsAdmin bool                  `json:"is_admin"`
+	Clients map[string]UserClient `json:"clients"`
+}
+
+// UserClient is a client registered to a user. There's nothing stored about
+// clients besides their names yet.
+type UserClient struct {
+}
+
+type UserRequest struct {
+	Username string `json:"username,omitempty"`
+	// Defaults to RoleMember when creating a user
+	Role string `json:"role,omitempty"`
+	// Deprecated: use Role
+	IsAdmin bool `json:"is_admin,omitempty"`
+}
+
+// Org is a group of users who share tunnels and clients. Orgs and users share
+// a namespace, so a tunnel's owner can be either.
+type Org struct {
+	Members map[string]OrgMember  `json:"members"`
+	Clients map[string]UserClient `json:"clients"`
+}
+
+type OrgMember struct {
+}
+
+type OrgRequest struct {
+	Name string `json:"name"`
+}
+
+type Token struct {
+	Owner string `json:"owner"`
+	// Set if the token acts for this org instead of its owner
+	Org         string    `json:"org,omitempty"`
+	Client      string    `json:"client,omitempty"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	// Zero if the token doesn't expire
+	ExpiresAt time.Time `json:"expires_at"`
+	Scopes    []string  `json:"scopes,omitempty"`
+}
+
+type TokenRequest struct {
+	// Defaults to the user making the request
+	Owner string `json:"owner,omitempty"`
+	// Limit the token to an org the owner is a member of. The token can
+	// then only manage what belongs to the org.
+	Org string `json:"org,omitempty"`
+	// Limit the token to a client. Empty means any client. For tokens
+	// limited to an org, the client must belong to the org.
+	Client      string `json:"client,omitempty"`
+	Description string `json:"description,omitempty"`
+	// 0 means the token never expires
+	ExpiresInDays int      `json:"expires_in_days,omitempty"`
+	Scopes        []string `json:"scopes,omitempty"`
+}
+
+// TokenResponse is returned when a token is created. This is the only time
+// the token itself is available.
+type TokenResponse struct {
+	Id    string `json:"id"`
+	Token string `json:"token"`
+}
+
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Client   string    `json:"client,omitempty"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target"`
+	SourceIp string    `json:"source_ip"`
+	// Empty if the change succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// AuditFilter selects audit log entries. Empty fields match everything.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	// 0 uses the server's default
+	Limit int
+}
+
+// Me describes the token the client is using.
+type Me struct {
+	TokenId string `json:"token_id"`
+	Owner   string `json:"owner"`
+	// The owner's role
+	Role    string `json:"role"`
+	IsAdmin bool   `json:"is_admin"`
+	// Empty unless the token is limited to an org. If it is, the token
+	// acts for the org instead of Owner.
+	Org string `json:"org,omitempty"`
+	// Orgs Owner is a member of
+	Orgs []string `json:"orgs"`
+	// Empty unless the token is limited to a client
+	Client      string `json:"client,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Empty if the token can do anything its owner can
+	Scopes []string `json:"scopes,omitempty"`
+	// Zero if the token doesn't expire
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func String(value string) *string {
+	return &value
+}
+
+func Int(value int) *int {
+	return &value
+}
+
+func Bool(value bool) *bool {
+	return &value
+}
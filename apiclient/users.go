@@ -0,0 +1,66 @@
+package apiclient
+
+import (
+	"context"
+	"net/url"
+)
+
+// ListUsers returns every user for admins, operators and auditors, or only
+// the user making the request for members.
+func (c *Client) ListUsers(ctx context.Context) (map[string]User, error) {
+	users := make(map[string]User)
+	err := c.do(ctx, "GET", "/users", nil, &users)
+	return users, err
+}
+
+func (c *Client) GetUser(ctx context.Context, username string) (User, error) {
+	var user User
+	err := c.do(ctx, "GET", "/users/"+url.PathEscape(username), nil, &user)
+	return user, err
+}
+
+func (c *Client) CreateUser(ctx context.Context, req UserRequest) (User, error) {
+	var user User
+	err := c.do(ctx, "POST", "/users", req, &user)
+	return user, err
+}
+
+// UpdateUser changes a user's role.
+func (c *Client) UpdateUser(ctx context.Context, username string, req UserRequest) (User, error) {
+	var user User
+	err := c.do(ctx, "PATCH", "/users/"+url.PathEscape(username), req, &user)
+	return user, err
+}
+
+// DeleteUser deletes a user along with their tokens.
+func (c *Client) DeleteUser(ctx context.Context, username string) error {
+	return c.do(ctx, "DELETE", "/users/"+url.PathEscape(username), nil, nil)
+}
+
+// ListClients returns a user's clients, keyed by name. Since users and orgs
+// share a namespace, the client methods also work with org names.
+func (c *Client) ListClients(ctx context.Context, username string) (map[string]UserClient, error) {
+	clients := make(map[string]UserClient)
+	err := c.do(ctx, "GET", "/users/"+url.PathEscape(username)+"/clients", nil, &clients)
+	return clients, err
+}
+
+func (c *Client) GetClient(ctx context.Context, username, clientName string) (UserClient, error) {
+	var client UserClient
+	err := c.do(ctx, "GET", clientPath(username, clientName), nil, &client)
+	return client, err
+}
+
+// AddClient registers a client for a user. It's not an error if the client
+// already exists.
+func (c *Client) AddClient(ctx context.Context, username, clientName string) error {
+	return c.do(ctx, "PUT", clientPath(username, clientName), nil, nil)
+}
+
+func (c *Client) DeleteClient(ctx context.Context, username, clientName string) error {
+	return c.do(ctx, "DELETE", clientPath(username, clientName), nil, nil)
+}
+
+func clientPath(username, clientName string) string {
+	return "/users/" + url.PathEscape(username) + "/clients/" + url.PathEscape(clientName)
+}
@@ -0,0 +1,230 @@
+package boringproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const auditLogFileName = "boringproxy_audit.jsonl"
+
+// Most entries returned by a single audit log query
+const maxAuditEntries = 1000
+const defaultAuditEntries = 100
+
+// Audit log actions
+const (
+	AuditTunnelCreate = "tunnel.create"
+	AuditTunnelUpdate = "tunnel.update"
+	AuditTunnelDelete = "tunnel.delete"
+	AuditTokenCreate  = "token.create"
+	AuditTokenDelete  = "token.delete"
+	AuditUserCreate   = "user.create"
+	AuditUserUpdate   = "user.update"
+	AuditUserDelete   = "user.delete"
+	AuditClientSet    = "client.set"
+	AuditClientDelete = "client.delete"
+
+	AuditOrgCreate       = "org.create"
+	AuditOrgDelete       = "org.delete"
+	AuditOrgMemberSet    = "org.member.set"
+	AuditOrgMemberDelete = "org.member.delete"
+)
+
+// AuditEntry records a change made through the Api, or an attempt at one.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Client   string    `json:"client,omitempty"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target"`
+	SourceIp string    `json:"source_ip"`
+	// Empty if the change succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// AuditFilter selects audit log entries. Empty fields match everything.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// AuditLog is an append-only log of changes, stored as one JSON object per
+// line. Nothing in boringproxy ever rewrites or truncates it.
+type AuditLog struct {
+	path  string
+	file  *os.File
+	mutex *sync.Mutex
+}
+
+func NewAuditLog(path string) (*AuditLog, error) {
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open audit log: %v", err)
+	}
+
+	return &AuditLog{
+		path:  path,
+		file:  file,
+		mutex: &sync.Mutex{},
+	}, nil
+}
+
+func (l *AuditLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.file.Close()
+}
+
+func (l *AuditLog) Record(entry AuditEntry) error {
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, err = l.file.Write(line)
+	return err
+}
+
+// Query returns the entries matching filter, newest first.
+func (l *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+
+	limit := filter.Limit
+	if limit <= 0 || limit > maxAuditEntries {
+		limit = maxAuditEntries
+	}
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Keep the newest matches in a ring, since the file is oldest first
+	matches := make([]AuditEntry, 0, limit)
+	next := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			// Probably a partial line from a crash
+			continue
+		}
+
+		if !filter.matches(entry) {
+			continue
+		}
+
+		if len(matches) < limit {
+			matches = append(matches, entry)
+		} else {
+			matches[next] = entry
+			next = (next + 1) % limit
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, 0, len(matches))
+	for i := len(matches) - 1; i >= 0; i-- {
+		entries = append(entries, matches[(next+i)%len(matches)])
+	}
+
+	return entries, nil
+}
+
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	if f.Actor != "" && entry.Actor != f.Actor {
+		return false
+	}
+	if f.Action != "" && entry.Action != f.Action {
+		return false
+	}
+	if f.Target != "" && entry.Target != f.Target {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// parseAuditFilter reads a filter from the actor, action, target, since,
+// until and limit parameters. Times are RFC 3339.
+func parseAuditFilter(params url.Values) (AuditFilter, error) {
+
+	filter := AuditFilter{
+		Actor:  params.Get("actor"),
+		Action: params.Get("action"),
+		Target: params.Get("target"),
+		Limit:  defaultAuditEntries,
+	}
+
+	var err error
+
+	since := params.Get("since")
+	if since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return filter, badRequest("Invalid since parameter: %v", err)
+		}
+	}
+
+	until := params.Get("until")
+	if until != "" {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return filter, badRequest("Invalid until parameter: %v", err)
+		}
+	}
+
+	limit := params.Get("limit")
+	if limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxAuditEntries {
+			return filter, badRequest("Invalid limit parameter. Must be between 1 and %d", maxAuditEntries)
+		}
+	}
+
+	return filter, nil
+}
+
+type sourceIpKey struct{}
+
+// withSourceIp stores the IP a request came from, so the audit log can
+// record it.
+func withSourceIp(r *http.Request, ip string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sourceIpKey{}, ip))
+}
+
+func sourceIp(r *http.Request) string {
+	ip, _ := r.Context().Value(sourceIpKey{}).(string)
+	return ip
+}
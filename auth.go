@@ -23,9 +23,9 @@ func NewAuth(db *Database) *Auth {
 }
 
 func (a *Auth) Authorized(token string) bool {
-	_, exists := a.db.GetTokenData(token)
+	_, err := a.db.ValidateToken(token)
 
-	if exists {
+	if err == nil {
 		return true
 	}
 
@@ -0,0 +1,265 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltStore keeps the database in an embedded bbolt file. Each record is
+// stored separately as JSON, so updates only write what changed.
+type boltStore struct {
+	db *bolt.DB
+}
+
+type boltStoreTx struct {
+	tx *bolt.Tx
+}
+
+var (
+	boltMetaBucket    = []byte("meta")
+	boltTokensBucket  = []byte("tokens")
+	boltTunnelsBucket = []byte("tunnels")
+	boltUsersBucket   = []byte("users")
+	boltOrgsBucket    = []byte("orgs")
+
+	boltDomainRequestsBucket = []byte("domain_requests")
+
+	boltAdminDomainKey   = []byte("admin_domain")
+	boltSchemaVersionKey = []byte("schema_version")
+)
+
+func openBoltStore(path string) (*boltStore, error) {
+
+	// Fail instead of waiting forever if another process has the file open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		buckets := [][]byte{boltMetaBucket, boltTokensBucket, boltTunnelsBucket, boltUsersBucket, boltOrgsBucket, boltDomainRequestsBucket}
+		for _, name := range buckets {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db}, nil
+}
+
+func (s *boltStore) View(fn func(tx StoreTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltStoreTx{tx})
+	})
+}
+
+func (s *boltStore) Update(fn func(tx StoreTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltStoreTx{tx})
+	})
+}
+
+func (s *boltStore) Backup(w io.Writer) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (tx *boltStoreTx) GetSchemaVersion() int {
+	version, _ := strconv.Atoi(string(tx.tx.Bucket(boltMetaBucket).Get(boltSchemaVersionKey)))
+	return version
+}
+
+func (tx *boltStoreTx) SetSchemaVersion(version int) error {
+	return tx.tx.Bucket(boltMetaBucket).Put(boltSchemaVersionKey, []byte(strconv.Itoa(version)))
+}
+
+func (tx *boltStoreTx) GetAdminDomain() string {
+	return string(tx.tx.Bucket(boltMetaBucket).Get(boltAdminDomainKey))
+}
+
+func (tx *boltStoreTx) SetAdminDomain(adminDomain string) error {
+	return tx.tx.Bucket(boltMetaBucket).Put(boltAdminDomainKey, []byte(adminDomain))
+}
+
+func (tx *boltStoreTx) GetTokens() map[string]TokenData {
+	tokens := make(map[string]TokenData)
+	tx.forEach(boltTokensBucket, func(k string, v []byte) {
+		var tokenData TokenData
+		if tx.decode(boltTokensBucket, k, v, &tokenData) {
+			tokens[k] = tokenData
+		}
+	})
+	return tokens
+}
+
+func (tx *boltStoreTx) GetToken(token string) (TokenData, bool) {
+	var tokenData TokenData
+	exists := tx.get(boltTokensBucket, token, &tokenData)
+	return tokenData, exists
+}
+
+func (tx *boltStoreTx) SetToken(token string, tokenData TokenData) error {
+	return tx.put(boltTokensBucket, token, tokenData)
+}
+
+func (tx *boltStoreTx) DeleteToken(token string) error {
+	return tx.tx.Bucket(boltTokensBucket).Delete([]byte(token))
+}
+
+func (tx *boltStoreTx) GetTunnels() map[string]Tunnel {
+	tunnels := make(map[string]Tunnel)
+	tx.forEach(boltTunnelsBucket, func(k string, v []byte) {
+		var tun Tunnel
+		if tx.decode(boltTunnelsBucket, k, v, &tun) {
+			tunnels[k] = tun
+		}
+	})
+	return tunnels
+}
+
+func (tx *boltStoreTx) GetTunnel(domain string) (Tunnel, bool) {
+	var tun Tunnel
+	exists := tx.get(boltTunnelsBucket, domain, &tun)
+	return tun, exists
+}
+
+func (tx *boltStoreTx) SetTunnel(domain string, tun Tunnel) error {
+	return tx.put(boltTunnelsBucket, domain, tun)
+}
+
+func (tx *boltStoreTx) DeleteTunnel(domain string) error {
+	return tx.tx.Bucket(boltTunnelsBucket).Delete([]byte(domain))
+}
+
+func (tx *boltStoreTx) GetUsers() map[string]User {
+	users := make(map[string]User)
+	tx.forEach(boltUsersBucket, func(k string, v []byte) {
+		var user User
+		if tx.decode(boltUsersBucket, k, v, &user) {
+			users[k] = copyUser(user)
+		}
+	})
+	return users
+}
+
+func (tx *boltStoreTx) GetUser(username string) (User, bool) {
+	var user User
+	if !tx.get(boltUsersBucket, username, &user) {
+		return User{}, false
+	}
+	// Make sure Clients isn't nil
+	return copyUser(user), true
+}
+
+func (tx *boltStoreTx) SetUser(username string, user User) error {
+	return tx.put(boltUsersBucket, username, user)
+}
+
+func (tx *boltStoreTx) DeleteUser(username string) error {
+	return tx.tx.Bucket(boltUsersBucket).Delete([]byte(username))
+}
+
+func (tx *boltStoreTx) GetOrgs() map[string]Org {
+	orgs := make(map[string]Org)
+	tx.forEach(boltOrgsBucket, func(k string, v []byte) {
+		var org Org
+		if tx.decode(boltOrgsBucket, k, v, &org) {
+			orgs[k] = copyOrg(org)
+		}
+	})
+	return orgs
+}
+
+func (tx *boltStoreTx) GetOrg(name string) (Org, bool) {
+	var org Org
+	if !tx.get(boltOrgsBucket, name, &org) {
+		return Org{}, false
+	}
+	// Make sure the maps aren't nil
+	return copyOrg(org), true
+}
+
+func (tx *boltStoreTx) SetOrg(name string, org Org) error {
+	return tx.put(boltOrgsBucket, name, org)
+}
+
+func (tx *boltStoreTx) DeleteOrg(name string) error {
+	return tx.tx.Bucket(boltOrgsBucket).Delete([]byte(name))
+}
+
+func (tx *boltStoreTx) GetDomainRequests() map[string]DomainRequest {
+	reqs := make(map[string]DomainRequest)
+	tx.forEach(boltDomainRequestsBucket, func(k string, v []byte) {
+		var req DomainRequest
+		if tx.decode(boltDomainRequestsBucket, k, v, &req) {
+			reqs[k] = req
+		}
+	})
+	return reqs
+}
+
+func (tx *boltStoreTx) GetDomainRequest(requestId string) (DomainRequest, bool) {
+	var req DomainRequest
+	exists := tx.get(boltDomainRequestsBucket, requestId, &req)
+	return req, exists
+}
+
+func (tx *boltStoreTx) SetDomainRequest(requestId string, req DomainRequest) error {
+	return tx.put(boltDomainRequestsBucket, requestId, req)
+}
+
+func (tx *boltStoreTx) DeleteDomainRequest(requestId string) error {
+	return tx.tx.Bucket(boltDomainRequestsBucket).Delete([]byte(requestId))
+}
+
+func (tx *boltStoreTx) forEach(bucket []byte, fn func(k string, v []byte)) {
+	tx.tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+		fn(string(k), v)
+		return nil
+	})
+}
+
+func (tx *boltStoreTx) get(bucket []byte, key string, v interface{}) bool {
+	data := tx.tx.Bucket(bucket).Get([]byte(key))
+	if data == nil {
+		return false
+	}
+	return tx.decode(bucket, key, data, v)
+}
+
+// decode unmarshals a record. Records which fail to decode are logged and
+// treated as missing, rather than making the whole bucket unreadable.
+func (tx *boltStoreTx) decode(bucket []byte, key string, data []byte, v interface{}) bool {
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		log.Printf("Failed to decode %s/%s: %v", bucket, key, err)
+		return false
+	}
+	return true
+}
+
+func (tx *boltStoreTx) put(bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.tx.Bucket(bucket).Put([]byte(key), data)
+}
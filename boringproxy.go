@@ -4,15 +4,17 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
-	"flag"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/caddyserver/certmagic"
@@ -35,37 +37,42 @@ type SmtpConfig struct {
 	Password string
 }
 
+const printLoginTokenDescription = "Created by -print-login"
+
 type Server struct {
 	db           *Database
 	tunMan       *TunnelManager
-	httpClient   *http.Client
+	httpProxy    *HttpProxy
 	httpListener *PassthroughListener
+	conns        *connTracker
+	config       *ServerConfig
+	configMutex  *sync.Mutex
+	logFile      *os.File
 }
 
 func Listen() {
-	flagSet := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-	newAdminDomain := flagSet.String("admin-domain", "", "Admin Domain")
-	sshServerPort := flagSet.Int("ssh-server-port", 22, "SSH Server Port")
-	dbDir := flagSet.String("db-dir", "", "Database file directory")
-	certDir := flagSet.String("cert-dir", "", "TLS cert directory")
-	printLogin := flagSet.Bool("print-login", false, "Prints admin login information")
-	httpPort := flagSet.Int("http-port", 80, "HTTP (insecure) port")
-	httpsPort := flagSet.Int("https-port", 443, "HTTPS (secure) port")
-	allowHttp := flagSet.Bool("allow-http", false, "Allow unencrypted (HTTP) requests")
-	publicIp := flagSet.String("public-ip", "", "Public IP")
-	behindProxy := flagSet.Bool("behind-proxy", false, "Whether we're running behind another reverse proxy")
-	acmeEmail := flagSet.String("acme-email", "", "Email for ACME (ie Let's Encrypt)")
-	acmeUseStaging := flagSet.Bool("acme-use-staging", false, "Use ACME (ie Let's Encrypt) staging servers")
-	acceptCATerms := flagSet.Bool("accept-ca-terms", false, "Automatically accept CA terms")
-	acmeCa := flagSet.String("acme-certificate-authority", "", "URI for ACME Certificate Authority")
-	err := flagSet.Parse(os.Args[2:])
+	args := os.Args[2:]
+
+	serverConfig, err := LoadServerConfig(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(1)
+	}
+
+	logFile, err := openLogFile(serverConfig.LogFile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: parsing flags: %s\n", os.Args[0], err)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(1)
 	}
 
 	log.Println("Starting up")
 
-	db, err := NewDatabase(*dbDir)
+	masterKey, err := LoadMasterKey(serverConfig.MasterKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := NewDatabase(serverConfig.DbDir, serverConfig.DbBackend, masterKey)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -74,8 +81,8 @@ func Listen() {
 
 	var ip string
 
-	if *publicIp != "" {
-		ip = *publicIp
+	if serverConfig.PublicIp != "" {
+		ip = serverConfig.PublicIp
 	} else {
 		ip, err = namedropClient.GetPublicIp()
 		if err != nil {
@@ -83,49 +90,50 @@ func Listen() {
 		}
 	}
 
-	err = namedrop.CheckPublicAddress(ip, *httpPort)
+	httpPort := serverConfig.HttpPort
+	httpsPort := serverConfig.HttpsPort
+	sshServerPort := serverConfig.SshServerPort
+
+	err = namedrop.CheckPublicAddress(ip, httpPort)
 	if err != nil {
-		fmt.Printf("WARNING: Failed to access %s:%d from the internet\n", ip, *httpPort)
+		fmt.Printf("WARNING: Failed to access %s:%d from the internet\n", ip, httpPort)
 	}
 
-	err = namedrop.CheckPublicAddress(ip, *httpsPort)
+	err = namedrop.CheckPublicAddress(ip, httpsPort)
 	if err != nil {
-		fmt.Printf("WARNING: Failed to access %s:%d from the internet\n", ip, *httpsPort)
+		fmt.Printf("WARNING: Failed to access %s:%d from the internet\n", ip, httpsPort)
 	}
 
 	autoCerts := true
-	if *httpPort != 80 || *httpsPort != 443 {
-		fmt.Printf("WARNING: LetsEncrypt only supports HTTP/HTTPS ports 80/443. You are using %d/%d. Disabling automatic certificate management\n", *httpPort, *httpsPort)
+	if httpPort != 80 || httpsPort != 443 {
+		fmt.Printf("WARNING: LetsEncrypt only supports HTTP/HTTPS ports 80/443. You are using %d/%d. Disabling automatic certificate management\n", httpPort, httpsPort)
 		autoCerts = false
 	}
 
-	if *certDir != "" {
-		certmagic.Default.Storage = &certmagic.FileStorage{*certDir}
+	if serverConfig.CertDir != "" {
+		certmagic.Default.Storage = &certmagic.FileStorage{Path: serverConfig.CertDir}
 	}
 	//certmagic.DefaultACME.DisableHTTPChallenge = true
 	//certmagic.DefaultACME.DisableTLSALPNChallenge = true
 
-	if *acmeEmail != "" {
-		certmagic.DefaultACME.Email = *acmeEmail
-	}
-
-	if *acceptCATerms {
-		certmagic.DefaultACME.Agreed = true
-		log.Print(fmt.Sprintf("Automatic agreement to CA terms with email (%s)", *acmeEmail))
-	}
-
-	if *acmeUseStaging {
-		certmagic.DefaultACME.CA = certmagic.LetsEncryptStagingCA
-	}
-
-	if *acmeCa != "" {
-		certmagic.DefaultACME.CA = *acmeCa
-	}
+	// The server keeps its own cache rather than certmagic's default one, so
+	// renewals use certConfig and its issuer, and pick up reloaded settings.
+	var certConfig *certmagic.Config
+	certCache := certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) {
+			return certConfig, nil
+		},
+	})
+	certConfig = certmagic.New(certCache, certmagic.Default)
 
-	certConfig := certmagic.NewDefault()
+	acmeIssuer := newReloadableIssuer(newAcmeManager(certConfig, serverConfig))
+	certConfig.Issuers = []certmagic.Issuer{acmeIssuer}
 
-	if *newAdminDomain != "" {
-		db.SetAdminDomain(*newAdminDomain)
+	if serverConfig.AdminDomain != "" {
+		err = db.SetAdminDomain(serverConfig.AdminDomain)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	adminDomain := db.GetAdminDomain()
@@ -149,48 +157,85 @@ func Listen() {
 	// Add admin user if it doesn't already exist
 	users := db.GetUsers()
 	if len(users) == 0 {
-		db.AddUser("admin", true)
-		_, err := db.AddToken("admin", "")
+		err := db.AddUser("admin", RoleAdmin)
 		if err != nil {
 			log.Fatal("Failed to initialize admin user")
 		}
+	}
+
+	if serverConfig.PrintLogin {
+		token, err := rotatePrintLoginToken(db)
+		if err != nil {
+			log.Fatalf("Failed to create admin token: %v", err)
+		}
 
+		printLoginInfo(token, db.GetAdminDomain(), httpsPort)
 	}
 
-	if *printLogin {
-		for token, tokenData := range db.GetTokens() {
-			if tokenData.Owner == "admin" && tokenData.Client == "" {
-				printLoginInfo(token, db.GetAdminDomain(), *httpsPort)
-				break
+	go func() {
+		for {
+			deleted, err := db.DeleteExpiredDomainRequests()
+			if err != nil {
+				log.Printf("Failed to delete expired domain requests: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Deleted %d expired domain requests", deleted)
 			}
+
+			time.Sleep(domainRequestCleanupInterval)
 		}
-	}
+	}()
 
 	config := &Config{
-		SshServerPort:  *sshServerPort,
+		SshServerPort:  sshServerPort,
 		PublicIp:       ip,
 		namedropClient: namedropClient,
 		autoCerts:      autoCerts,
 	}
 
-	tunMan := NewTunnelManager(config, db, certConfig)
+	sshServer, err := NewSshServer(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sshListener, err := net.Listen("tcp", fmt.Sprintf(":%d", sshServerPort))
+	if err != nil {
+		log.Fatalf("Failed to start SSH server: %v. If another program is already using port %d, select a different port with -ssh-server-port", err, sshServerPort)
+	}
+
+	go func() {
+		err := sshServer.Serve(sshListener)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Fatalf("SSH server error: %v", err)
+		}
+	}()
+
+	tunMan := NewTunnelManager(config, db, certConfig, sshServer)
 
 	auth := NewAuth(db)
 
-	api := NewApi(config, db, auth, tunMan)
+	auditLog, err := NewAuditLog(DBFolderPath + auditLogFileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	api := NewApi(config, db, auth, tunMan, auditLog)
 
 	webUiHandler := NewWebUiHandler(config, db, api, auth)
 
-	httpClient := &http.Client{
-		// Don't follow redirects
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
+	httpProxy := NewHttpProxy()
 
 	httpListener := NewPassthroughListener()
 
-	p := &Server{db, tunMan, httpClient, httpListener}
+	p := &Server{
+		db:           db,
+		tunMan:       tunMan,
+		httpProxy:    httpProxy,
+		httpListener: httpListener,
+		conns:        newConnTracker(),
+		config:       serverConfig,
+		configMutex:  &sync.Mutex{},
+		logFile:      logFile,
+	}
 
 	tlsConfig := &tls.Config{
 		GetCertificate: certConfig.GetCertificate,
@@ -207,7 +252,12 @@ func Listen() {
 			io.WriteString(w, err.Error())
 			return
 		}
-		fmt.Println(fmt.Sprintf("%s %s %s %s %s", timestamp, remoteIp, r.Method, r.Host, r.URL.Path))
+
+		serverConfig := p.getConfig()
+
+		if !serverConfig.DisableRequestLog {
+			p.logRequest(fmt.Sprintf("%s %s %s %s %s", timestamp, remoteIp, r.Method, r.Host, r.URL.Path))
+		}
 
 		hostParts := strings.Split(r.Host, ":")
 		hostDomain := hostParts[0]
@@ -226,6 +276,12 @@ func Listen() {
 				return
 			}
 
+			_, err := db.GetDNSRequest(requestId)
+			if err != nil {
+				http.Redirect(w, r, "/alert?message=Domain request expired or not found. Please try again", 303)
+				return
+			}
+
 			namedropTokenData, err := namedropClient.GetToken(requestId, code)
 			if err != nil {
 				w.WriteHeader(500)
@@ -259,7 +315,13 @@ func Listen() {
 			fqdn := host + "." + domain
 
 			if db.GetAdminDomain() == "" {
-				db.SetAdminDomain(fqdn)
+				err := db.SetAdminDomain(fqdn)
+				if err != nil {
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+
 				namedropClient.SetDomain(fqdn)
 
 				if autoCerts {
@@ -272,14 +334,16 @@ func Listen() {
 
 				url := fmt.Sprintf("https://%s", fqdn)
 
-				// Automatically log using the first found admin token. This is safe to do here
+				// Automatically log in with a new admin token. This is safe to do here
 				// because we know that retrieving the admin domain was initiated from the CLI.
-				tokens := db.GetTokens()
-				for token, tokenData := range tokens {
-					if tokenData.Owner == "admin" {
-						url = url + "/login?access_token=" + token
-						break
-					}
+				token, err := db.AddToken(TokenData{
+					Owner:       "admin",
+					Description: "Created when setting the admin domain",
+				})
+				if err == nil {
+					url = url + "/login?access_token=" + token
+				} else {
+					log.Printf("Failed to create admin token: %v", err)
 				}
 
 				http.Redirect(w, r, url, 303)
@@ -289,6 +353,17 @@ func Listen() {
 			}
 
 		} else if hostDomain == db.GetAdminDomain() {
+			ip := remoteIp
+			if serverConfig.BehindProxy {
+				// The last address is the one our proxy added
+				forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+				lastForwarded := strings.TrimSpace(forwarded[len(forwarded)-1])
+				if lastForwarded != "" {
+					ip = lastForwarded
+				}
+			}
+			r = withSourceIp(r, ip)
+
 			if strings.HasPrefix(r.URL.Path, "/api/") {
 				http.StripPrefix("/api", api).ServeHTTP(w, r)
 			} else {
@@ -304,47 +379,244 @@ func Listen() {
 				return
 			}
 
-			proxyRequest(w, r, tunnel, httpClient, "localhost", tunnel.TunnelPort, *behindProxy)
+			httpProxy.ProxyRequest(w, r, tunnel, "localhost", tunnel.TunnelPort, serverConfig.BehindProxy)
 		}
 	})
 
-	go func() {
+	// Checked on every request, since allow-http can be changed by reloading
+	// the config.
+	insecureHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.getConfig().AllowHttp {
+			http.DefaultServeMux.ServeHTTP(w, r)
+			return
+		}
 
-		if *allowHttp {
-			if err := http.ListenAndServe(fmt.Sprintf(":%d", *httpPort), nil); err != nil {
-				log.Fatalf("ListenAndServe error: %v", err)
-			}
-		} else {
-			redirectTLS := func(w http.ResponseWriter, r *http.Request) {
-				url := fmt.Sprintf("https://%s:%d%s", r.Host, *httpsPort, r.RequestURI)
-				http.Redirect(w, r, url, http.StatusMovedPermanently)
-			}
+		url := fmt.Sprintf("https://%s:%d%s", r.Host, httpsPort, r.RequestURI)
+		http.Redirect(w, r, url, http.StatusMovedPermanently)
+	})
 
-			if err := http.ListenAndServe(fmt.Sprintf(":%d", *httpPort), http.HandlerFunc(redirectTLS)); err != nil {
-				log.Fatalf("ListenAndServe error: %v", err)
-			}
-		}
+	insecureServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", httpPort),
+		Handler: insecureHandler,
+	}
 
+	go func() {
+		err := insecureServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("ListenAndServe error: %v", err)
+		}
 	}()
 
-	go http.Serve(tlsListener, nil)
+	secureServer := &http.Server{}
+
+	go secureServer.Serve(tlsListener)
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *httpsPort))
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", httpsPort))
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Print(err)
+				continue
+			}
+
+			go p.handleConnection(p.conns.Track(conn), certConfig)
+		}
+	}()
+
 	log.Println("Ready")
 
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	var sig os.Signal
 	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Print(err)
+		sig = <-sigChan
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		log.Println("Received SIGHUP, reloading config")
+		p.reloadConfig(args, certConfig, acmeIssuer)
+	}
+
+	log.Printf("Received %s, shutting down", sig)
+
+	shutdownTimeout := time.Duration(p.getConfig().ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting new connections
+	listener.Close()
+	sshListener.Close()
+
+	// Wait for in-flight requests and connections to finish. Everything
+	// still has to go through the SSH forwards, so those are closed last.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		insecureServer.Shutdown(ctx)
+		wg.Done()
+	}()
+	go func() {
+		secureServer.Shutdown(ctx)
+		wg.Done()
+	}()
+	wg.Wait()
+
+	err = p.conns.Wait(ctx)
+	if err != nil {
+		log.Println("Timed out waiting for connections to finish")
+	}
+
+	sshServer.Close()
+
+	err = db.Close()
+	if err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+
+	err = auditLog.Close()
+	if err != nil {
+		log.Printf("Failed to close audit log: %v", err)
+	}
+
+	log.Println("Shutdown complete")
+}
+
+func (p *Server) getConfig() ServerConfig {
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+	return *p.config
+}
+
+// reloadConfig re-reads the config file and flags, and applies the settings
+// which can be changed while running. If anything goes wrong the current
+// config is kept.
+func (p *Server) reloadConfig(args []string, certConfig *certmagic.Config, acmeIssuer *reloadableIssuer) {
+
+	newConfig, err := LoadServerConfig(args)
+	if err != nil {
+		log.Printf("Failed to reload config: %v", err)
+		return
+	}
+
+	logFile, err := openLogFile(newConfig.LogFile)
+	if err != nil {
+		log.Printf("Failed to reload config: %v", err)
+		return
+	}
+
+	p.configMutex.Lock()
+	oldConfig := p.config
+	oldLogFile := p.logFile
+	p.config = newConfig
+	p.logFile = logFile
+	p.configMutex.Unlock()
+
+	if oldLogFile != nil {
+		oldLogFile.Close()
+	}
+
+	for _, name := range oldConfig.restartRequired(newConfig) {
+		log.Printf("WARNING: Changing %s requires a restart", name)
+	}
+
+	// ACMEManagers copy their settings when they're created, so a new one
+	// is needed for the new settings to apply.
+	acmeIssuer.set(newAcmeManager(certConfig, newConfig))
+
+	log.Println("Config reloaded")
+}
+
+func (p *Server) logRequest(line string) {
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+
+	if p.logFile != nil {
+		fmt.Fprintln(p.logFile, line)
+	} else {
+		fmt.Println(line)
+	}
+}
+
+// rotatePrintLoginToken creates an admin token for -print-login, and deletes
+// the ones created by earlier starts. Tokens are stored hashed, so there's no
+// existing one to print, but they shouldn't pile up with every restart.
+func rotatePrintLoginToken(db *Database) (string, error) {
+
+	token, err := db.AddToken(TokenData{
+		Owner:       "admin",
+		Description: printLoginTokenDescription,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	newId := tokenId(token)
+
+	for id, tokenData := range db.GetTokens() {
+		if id == newId || tokenData.Owner != "admin" || tokenData.Description != printLoginTokenDescription {
 			continue
 		}
 
-		go p.handleConnection(conn, certConfig)
+		err := db.DeleteTokenData(id)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return token, nil
+}
+
+// openLogFile points the standard logger at path, or stderr if path is empty.
+func openLogFile(path string) (*os.File, error) {
+
+	if path == "" {
+		log.SetOutput(os.Stderr)
+		return nil, nil
+	}
+
+	logFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
 	}
+
+	log.SetOutput(logFile)
+
+	return logFile, nil
+}
+
+// newAcmeManager creates an ACMEManager for certConfig with the ACME settings
+// from config. certmagic.DefaultACME is left alone, since certmagic reads it
+// from its own goroutines.
+func newAcmeManager(certConfig *certmagic.Config, config *ServerConfig) *certmagic.ACMEManager {
+
+	template := certmagic.ACMEManager{
+		Email:  config.AcmeEmail,
+		Agreed: config.AcceptCATerms,
+	}
+
+	if config.AcceptCATerms {
+		log.Print(fmt.Sprintf("Automatic agreement to CA terms with email (%s)", config.AcmeEmail))
+	}
+
+	if config.AcmeCa != "" {
+		template.CA = config.AcmeCa
+	} else if config.AcmeUseStaging {
+		template.CA = certmagic.LetsEncryptStagingCA
+	} else {
+		template.CA = certmagic.LetsEncryptProductionCA
+	}
+
+	return certmagic.NewACMEManager(certConfig, template)
 }
 
 func (p *Server) handleConnection(clientConn net.Conn, certConfig *certmagic.Config) {
@@ -352,6 +624,7 @@ func (p *Server) handleConnection(clientConn net.Conn, certConfig *certmagic.Con
 	clientHello, clientReader, err := peekClientHello(clientConn)
 	if err != nil {
 		log.Println("peekClientHello error", err)
+		clientConn.Close()
 		return
 	}
 
@@ -375,6 +648,8 @@ func (p *Server) handleConnection(clientConn net.Conn, certConfig *certmagic.Con
 
 func (p *Server) passthroughRequest(conn net.Conn, tunnel Tunnel) {
 
+	defer conn.Close()
+
 	upstreamAddr := fmt.Sprintf("localhost:%d", tunnel.TunnelPort)
 	upstreamConn, err := net.Dial("tcp", upstreamAddr)
 
@@ -414,7 +689,10 @@ func setAdminDomain(certConfig *certmagic.Config, db *Database, namedropClient *
 			}
 		}
 
-		db.SetAdminDomain(adminDomain)
+		err := db.SetAdminDomain(adminDomain)
+		if err != nil {
+			log.Fatal(err)
+		}
 	case "2":
 
 		log.Println("Get bootstrap domain")
@@ -425,7 +703,7 @@ func setAdminDomain(certConfig *certmagic.Config, db *Database, namedropClient *
 		}
 
 		qrterminal.GenerateHalfBlock(namedropLink, qrterminal.L, os.Stdout)
-		fmt.Println("Use the link below or scan the QR code above to select an admin domain:\n")
+		fmt.Print("Use the link below or scan the QR code above to select an admin domain:\n\n")
 		fmt.Printf("%s\n\n", namedropLink)
 
 	default:
@@ -6,23 +6,29 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/boringproxy/boringproxy/apiclient"
 	"github.com/caddyserver/certmagic"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 type Client struct {
+	api              *apiclient.Client
 	httpClient       *http.Client
-	tunnels          map[string]Tunnel
-	previousEtag     string
 	server           string
 	token            string
+	legacy           bool
+	httpProxy        *HttpProxy
+	tunnels          map[string]Tunnel
+	previousEtag     string
 	clientName       string
 	user             string
 	cancelFuncs      map[string]context.CancelFunc
@@ -30,20 +36,72 @@ type Client struct {
 	certConfig       *certmagic.Config
 	behindProxy      bool
 	pollInterval     int
+	knownHostsFile   string
+	knownHostsMutex  *sync.Mutex
+	watch            bool
+	shutdownTimeout  time.Duration
+	tunnelsWg        *sync.WaitGroup
+	declaredTunnels  []TunnelConfig
 }
 
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 2 * time.Minute
+	keepAliveInterval = 30 * time.Second
+	keepAliveTimeout  = 15 * time.Second
+	sshDialTimeout    = 15 * time.Second
+	// How long the server holds a watch request open if nothing changes
+	watchWait       = 50 * time.Second
+	watchRetryDelay = 5 * time.Second
+	// For creating and updating declared tunnels
+	registerAttempts   = 3
+	registerRetryDelay = 2 * time.Second
+)
+
+var errWatchUnsupported = errors.New("Server doesn't support watching tunnels")
+
 type ClientConfig struct {
-	ServerAddr     string `json:"serverAddr,omitempty"`
-	Token          string `json:"token,omitempty"`
-	ClientName     string `json:"clientName,omitempty"`
-	User           string `json:"user,omitempty"`
-	CertDir        string `json:"certDir,omitempty"`
-	AcmeEmail      string `json:"acmeEmail,omitempty"`
-	AcmeUseStaging bool   `json:"acmeUseStaging,omitempty"`
-	AcmeCa         string `json:"acmeCa,omitempty"`
-	DnsServer      string `json:"dnsServer,omitempty"`
-	BehindProxy    bool   `json:"behindProxy,omitempty"`
-	PollInterval   int    `json:"pollInterval,omitempty"`
+	ServerAddr     string `json:"serverAddr,omitempty" yaml:"serverAddr,omitempty"`
+	Token          string `json:"token,omitempty" yaml:"token,omitempty"`
+	ClientName     string `json:"clientName,omitempty" yaml:"clientName,omitempty"`
+	User           string `json:"user,omitempty" yaml:"user,omitempty"`
+	CertDir        string `json:"certDir,omitempty" yaml:"certDir,omitempty"`
+	AcmeEmail      string `json:"acmeEmail,omitempty" yaml:"acmeEmail,omitempty"`
+	AcmeUseStaging bool   `json:"acmeUseStaging,omitempty" yaml:"acmeUseStaging,omitempty"`
+	AcmeCa         string `json:"acmeCa,omitempty" yaml:"acmeCa,omitempty"`
+	DnsServer      string `json:"dnsServer,omitempty" yaml:"dnsServer,omitempty"`
+	BehindProxy    bool   `json:"behindProxy,omitempty" yaml:"behindProxy,omitempty"`
+	PollInterval   int    `json:"pollInterval,omitempty" yaml:"pollInterval,omitempty"`
+	KnownHostsFile string `json:"knownHostsFile,omitempty" yaml:"knownHostsFile,omitempty"`
+	DisableWatch   bool   `json:"disableWatch,omitempty" yaml:"disableWatch,omitempty"`
+	// Seconds to wait for open connections to finish when a tunnel is
+	// stopped or the client shuts down
+	ShutdownTimeout int `json:"shutdownTimeout,omitempty" yaml:"shutdownTimeout,omitempty"`
+	// Tunnels to create on the server for this client at startup
+	Tunnels []TunnelConfig `json:"tunnels,omitempty" yaml:"tunnels,omitempty"`
+}
+
+// TunnelConfig declares a tunnel in the client config file. Declared tunnels
+// are created on the server when the client starts, and re-created if they
+// differ from the tunnel already on the server.
+type TunnelConfig struct {
+	Domain        string `json:"domain" yaml:"domain"`
+	ClientAddress string `json:"clientAddress,omitempty" yaml:"clientAddress,omitempty"`
+	ClientPort    int    `json:"clientPort" yaml:"clientPort"`
+	// Random if not set
+	TunnelPort int `json:"tunnelPort,omitempty" yaml:"tunnelPort,omitempty"`
+	// Defaults to "client"
+	TlsTermination   string `json:"tlsTermination,omitempty" yaml:"tlsTermination,omitempty"`
+	AllowExternalTcp bool   `json:"allowExternalTcp,omitempty" yaml:"allowExternalTcp,omitempty"`
+	DisableBuffering bool   `json:"disableBuffering,omitempty" yaml:"disableBuffering,omitempty"`
+	AuthUsername     string `json:"authUsername,omitempty" yaml:"authUsername,omitempty"`
+	AuthPassword     string `json:"authPassword,omitempty" yaml:"authPassword,omitempty"`
+}
+
+// LoadClientConfigFile reads a JSON or YAML client config file into config.
+// Values which aren't in the file are left alone.
+func LoadClientConfigFile(path string, config *ClientConfig) error {
+	return readConfigFile(path, config)
 }
 
 func NewClient(config *ClientConfig) (*Client, error) {
@@ -76,7 +134,7 @@ func NewClient(config *ClientConfig) (*Client, error) {
 	certmagic.DefaultACME.DisableHTTPChallenge = true
 
 	if config.CertDir != "" {
-		certmagic.Default.Storage = &certmagic.FileStorage{config.CertDir}
+		certmagic.Default.Storage = &certmagic.FileStorage{Path: config.CertDir}
 	}
 
 	if config.AcmeEmail != "" {
@@ -99,16 +157,33 @@ func NewClient(config *ClientConfig) (*Client, error) {
 			return http.ErrUseLastResponse
 		},
 	}
+
+	for _, tun := range config.Tunnels {
+		if tun.Domain == "" {
+			return nil, errors.New("Declared tunnels require a domain")
+		}
+
+		if tun.ClientPort == 0 {
+			return nil, fmt.Errorf("Tunnel %s requires a client port", tun.Domain)
+		}
+	}
+
 	tunnels := make(map[string]Tunnel)
 	cancelFuncs := make(map[string]context.CancelFunc)
 	cancelFuncsMutex := &sync.Mutex{}
 
+	api := apiclient.New(config.ServerAddr, config.Token, &apiclient.Options{
+		HttpClient: httpClient,
+	})
+
 	return &Client{
+		api:              api,
 		httpClient:       httpClient,
-		tunnels:          tunnels,
-		previousEtag:     "",
 		server:           config.ServerAddr,
 		token:            config.Token,
+		httpProxy:        NewHttpProxy(),
+		tunnels:          tunnels,
+		previousEtag:     "",
 		clientName:       config.ClientName,
 		user:             config.User,
 		cancelFuncs:      cancelFuncs,
@@ -116,56 +191,86 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		certConfig:       certConfig,
 		behindProxy:      config.BehindProxy,
 		pollInterval:     config.PollInterval,
+		knownHostsFile:   config.KnownHostsFile,
+		knownHostsMutex:  &sync.Mutex{},
+		watch:            !config.DisableWatch,
+		shutdownTimeout:  time.Duration(config.ShutdownTimeout) * time.Second,
+		tunnelsWg:        &sync.WaitGroup{},
+		declaredTunnels:  config.Tunnels,
 	}, nil
 }
 
+// Run syncs tunnels with the server until ctx is cancelled. Before returning,
+// it waits for all tunnels to finish draining their open connections.
 func (c *Client) Run(ctx context.Context) error {
 
-	url := fmt.Sprintf("https://%s/api/clients/?client-name=%s", c.server, c.clientName)
-	if c.user != "" {
-		url = url + "&user=" + c.user
+	err := c.identify(ctx)
+	if err != nil {
+		return err
 	}
 
-	clientReq, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return fmt.Errorf("Failed to create request for URL %s", url)
+	if c.legacy {
+		err = c.legacyAddClient(ctx)
+	} else {
+		err = c.api.AddClient(ctx, c.user, c.clientName)
 	}
-	if len(c.token) > 0 {
-		clientReq.Header.Add("Authorization", "bearer "+c.token)
+	if err != nil {
+		return fmt.Errorf("Failed to register client %s for %s: %v", c.clientName, c.user, err)
 	}
-	resp, err := c.httpClient.Do(clientReq)
+
+	err = c.RegisterTunnels(ctx)
 	if err != nil {
-		return fmt.Errorf("Failed to create client. Ensure the server is running. URL: %s", url)
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("Failed to create client. HTTP Status code: %d. Failed to read body", resp.StatusCode)
+	// Only started once the client is polling. A nil pollChan never
+	// triggers in the select below, so a polling interval of 0 disables
+	// polling.
+	var pollTicker *time.Ticker
+	var pollChan <-chan time.Time
+	defer func() {
+		if pollTicker != nil {
+			pollTicker.Stop()
 		}
+	}()
 
-		msg := string(body)
-		return fmt.Errorf("Failed to create client. Are the user ('%s') and token correct? HTTP Status code: %d. Message: %s", c.user, resp.StatusCode, msg)
-	}
+	defer func() {
+		log.Println("Waiting for tunnels to close")
+		c.tunnelsWg.Wait()
+	}()
 
-	pollChan := make(chan struct{})
+	for {
+		if c.watch {
+			err := c.WatchTunnels(ctx)
+			if err == nil {
+				continue
+			}
 
-	// A polling interval of 0 disables polling. Basically pollChan will
-	// remain blocked and never trigger in the select below.
-	if c.pollInterval > 0 {
-		go func() {
-			for {
-				<-time.After(time.Duration(c.pollInterval) * time.Millisecond)
-				pollChan <- struct{}{}
+			if errors.Is(err, errWatchUnsupported) {
+				log.Println("Server doesn't support watching for tunnel changes. Falling back to polling")
+				c.watch = false
+				continue
 			}
-		}()
-	}
 
-	for {
-		err := c.PollTunnels(ctx)
-		if err != nil {
 			log.Print(err)
+
+			// Avoid hammering the server if it's down
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(watchRetryDelay):
+				continue
+			}
+		} else {
+			err := c.PollTunnels(ctx)
+			if err != nil {
+				log.Print(err)
+			}
+
+			if pollTicker == nil && c.pollInterval > 0 {
+				pollTicker = time.NewTicker(time.Duration(c.pollInterval) * time.Millisecond)
+				pollChan = pollTicker.C
+			}
 		}
 
 		select {
@@ -177,50 +282,142 @@ func (c *Client) Run(ctx context.Context) error {
 	}
 }
 
-func (c *Client) PollTunnels(ctx context.Context) error {
+// identify looks up the token, and fills in the user and client name from it
+// if they weren't given. The user can also be an org the token's owner is a
+// member of, and is always the org for tokens limited to one.
+func (c *Client) identify(ctx context.Context) error {
+
+	me, err := c.api.Whoami(ctx)
+	if apiclient.IsUnauthenticated(err) {
+		return fmt.Errorf("Token rejected by server: %v", err)
+	} else if isMissingEndpoint(err) {
+		return c.identifyLegacy()
+	} else if err != nil {
+		return fmt.Errorf("Failed to look up token. Ensure the server is running. %v", err)
+	}
 
-	//log.Println("PollTunnels")
+	if me.Org != "" {
+		if c.user == "" {
+			c.user = me.Org
+		} else if c.user != me.Org {
+			return fmt.Errorf("Token is limited to org %s, not %s", me.Org, c.user)
+		}
+	} else if c.user == "" {
+		c.user = me.Owner
+	} else if c.user != me.Owner && !stringInArray(c.user, me.Orgs) && me.Role != apiclient.RoleAdmin && me.Role != apiclient.RoleOperator {
+		return fmt.Errorf("Token belongs to user %s, not %s", me.Owner, c.user)
+	}
 
-	url := fmt.Sprintf("https://%s/api/tunnels?client-name=%s", c.server, c.clientName)
+	if c.clientName == "" {
+		c.clientName = me.Client
+	} else if me.Client != "" && c.clientName != me.Client {
+		return fmt.Errorf("Token is limited to client %s, not %s", me.Client, c.clientName)
+	}
 
-	listenReq, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
+	if c.clientName == "" {
+		return errors.New("Client name required, since the token isn't limited to a client")
 	}
 
-	if len(c.token) > 0 {
-		listenReq.Header.Add("Authorization", "bearer "+c.token)
+	if !me.ExpiresAt.IsZero() {
+		log.Printf("Token expires at %s", me.ExpiresAt.Format(time.RFC3339))
 	}
 
-	resp, err := c.httpClient.Do(listenReq)
-	if err != nil {
+	log.Printf("Running as client %s for %s", c.clientName, c.user)
+
+	return nil
+}
+
+// identifyLegacy sets the client up for a server without /api/v1, which can't
+// look up the token. See client_legacy.go.
+func (c *Client) identifyLegacy() error {
+
+	if c.clientName == "" {
+		return errors.New("Client name required, since the server is too old to look it up from the token")
+	}
+
+	if len(c.declaredTunnels) > 0 {
+		return errors.New("Declared tunnels need a server with the v1 API. Upgrade the server, or remove them from the config")
+	}
+
+	log.Println("Server doesn't support the v1 API. Using the original API, and polling for tunnel changes")
+
+	c.legacy = true
+	c.watch = false
+
+	log.Printf("Running as client %s", c.clientName)
+
+	return nil
+}
+
+// isMissingEndpoint reports whether err is a 404 for an endpoint the server
+// doesn't have. Older servers don't report it as a v1 error, so the status
+// is all there is to go on.
+func isMissingEndpoint(err error) bool {
+	var apiErr *apiclient.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+func (c *Client) PollTunnels(ctx context.Context) error {
+	if c.legacy {
+		return c.legacyFetchTunnels(ctx)
+	}
+
+	_, _, err := c.fetchTunnels(ctx, 0)
+	return err
+}
+
+// WatchTunnels waits for the server to report a change to the tunnels, and
+// syncs them. It returns nil if nothing changed before the server timed out
+// the request, and errWatchUnsupported if the server can't be watched.
+func (c *Client) WatchTunnels(ctx context.Context) error {
+
+	prevEtag := c.previousEtag
+
+	etag, notModified, err := c.fetchTunnels(ctx, watchWait)
+	if isMissingEndpoint(err) {
+		return errWatchUnsupported
+	} else if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return errors.New("Failed to listen (not 200 status)")
+	// Servers which don't support watching return immediately with the
+	// same ETag.
+	if !notModified && prevEtag != "" && etag == prevEtag {
+		return errWatchUnsupported
 	}
 
-	etag := resp.Header["Etag"][0]
+	return nil
+}
+
+func (c *Client) fetchTunnels(ctx context.Context, wait time.Duration) (string, bool, error) {
+
+	list, err := c.api.ListTunnels(ctx, apiclient.ListTunnelsOptions{
+		Owner:      c.user,
+		ClientName: c.clientName,
+		Wait:       wait,
+		ETag:       c.previousEtag,
+	})
+	if err != nil {
+		return "", false, err
+	}
 
-	if etag != c.previousEtag {
+	if list.NotModified {
+		return c.previousEtag, true, nil
+	}
 
-		body, err := ioutil.ReadAll(resp.Body)
+	if list.ETag != c.previousEtag {
 
 		tunnels := make(map[string]Tunnel)
-
-		err = json.Unmarshal(body, &tunnels)
-		if err != nil {
-			return err
+		for domain, tun := range list.Tunnels {
+			tunnels[domain] = Tunnel(tun)
 		}
 
 		c.SyncTunnels(ctx, tunnels)
 
-		c.previousEtag = etag
+		c.previousEtag = list.ETag
 	}
 
-	return nil
+	return list.ETag, false, nil
 }
 
 func (c *Client) SyncTunnels(ctx context.Context, serverTunnels map[string]Tunnel) {
@@ -238,7 +435,12 @@ func (c *Client) SyncTunnels(ctx context.Context, serverTunnels map[string]Tunne
 			c.tunnels[k] = newTun
 			bore = true
 		} else if newTun != tun {
+			// The old connection drains while the new one
+			// connects. The server gives the tunnel port to the
+			// new connection, but keeps the old one open until the
+			// requests it's carrying have finished.
 			log.Println("Restart tunnel", k)
+			c.tunnels[k] = newTun
 			c.cancelFuncsMutex.Lock()
 			c.cancelFuncs[k]()
 			c.cancelFuncsMutex.Unlock()
@@ -252,12 +454,11 @@ func (c *Client) SyncTunnels(ctx context.Context, serverTunnels map[string]Tunne
 			c.cancelFuncs[k] = cancel
 			c.cancelFuncsMutex.Unlock()
 
-			go func(closureCtx context.Context, tun Tunnel) {
-				err := c.BoreTunnel(closureCtx, tun)
-				if err != nil {
-					log.Println("BoreTunnel error: ", err)
-				}
-			}(cancelCtx, newTun)
+			c.tunnelsWg.Add(1)
+			go func(tunnel Tunnel) {
+				c.superviseTunnel(cancelCtx, tunnel)
+				c.tunnelsWg.Done()
+			}(newTun)
 		}
 	}
 
@@ -276,6 +477,185 @@ func (c *Client) SyncTunnels(ctx context.Context, serverTunnels map[string]Tunne
 	}
 }
 
+// RegisterTunnels makes sure every tunnel declared in the config exists on the
+// server with the declared settings. Missing tunnels are created, and ones
+// which differ are updated. Declared domains which belong to someone else are
+// an error, and are never taken over.
+func (c *Client) RegisterTunnels(ctx context.Context) error {
+
+	if len(c.declaredTunnels) == 0 {
+		return nil
+	}
+
+	list, err := c.api.ListTunnels(ctx, apiclient.ListTunnelsOptions{})
+	if err != nil {
+		return fmt.Errorf("Failed to get tunnels: %v", err)
+	}
+
+	for _, tunConfig := range c.declaredTunnels {
+
+		if tunConfig.ClientAddress == "" {
+			tunConfig.ClientAddress = "127.0.0.1"
+		}
+
+		if tunConfig.TlsTermination == "" {
+			tunConfig.TlsTermination = "client"
+		}
+
+		// Set everything either way, since leaving fields out of an
+		// update means no change
+		tunReq := apiclient.TunnelRequest{
+			Domain:           apiclient.String(tunConfig.Domain),
+			Owner:            apiclient.String(c.user),
+			ClientName:       apiclient.String(c.clientName),
+			ClientAddress:    apiclient.String(tunConfig.ClientAddress),
+			ClientPort:       apiclient.Int(tunConfig.ClientPort),
+			TlsTermination:   apiclient.String(tunConfig.TlsTermination),
+			AllowExternalTcp: apiclient.Bool(tunConfig.AllowExternalTcp),
+			DisableBuffering: apiclient.Bool(tunConfig.DisableBuffering),
+			AuthUsername:     apiclient.String(tunConfig.AuthUsername),
+			AuthPassword:     apiclient.String(tunConfig.AuthPassword),
+		}
+
+		if tunConfig.TunnelPort != 0 {
+			tunReq.TunnelPort = apiclient.Int(tunConfig.TunnelPort)
+		}
+
+		if tunConfig.AuthUsername == "" && tunConfig.AuthPassword == "" {
+			tunReq.AuthPassword = nil
+		}
+
+		tun, exists := list.Tunnels[tunConfig.Domain]
+		if exists {
+			if tun.Owner != c.user {
+				return fmt.Errorf("Declared tunnel %s belongs to %s, not %s", tunConfig.Domain, tun.Owner, c.user)
+			}
+
+			if c.tunnelMatches(Tunnel(tun), tunConfig) {
+				continue
+			}
+
+			log.Println("Updating declared tunnel", tunConfig.Domain)
+
+			err := retryTransient(ctx, func() error {
+				_, err := c.api.UpdateTunnel(ctx, tunConfig.Domain, tunReq)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("Failed to update tunnel %s: %v", tunConfig.Domain, err)
+			}
+
+			continue
+		}
+
+		log.Println("Creating declared tunnel", tunConfig.Domain)
+
+		err := retryTransient(ctx, func() error {
+			_, err := c.api.CreateTunnel(ctx, tunReq)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to create tunnel %s: %v", tunConfig.Domain, err)
+		}
+	}
+
+	return nil
+}
+
+// retryTransient calls fn until it succeeds, up to registerAttempts times.
+// Only network errors and server errors are retried, since anything else,
+// ie a conflict, would fail the same way again.
+func retryTransient(ctx context.Context, fn func() error) error {
+
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt == registerAttempts {
+			return err
+		}
+
+		var apiErr *apiclient.Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode < 500 {
+			return err
+		}
+
+		log.Printf("%v. Retrying", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(registerRetryDelay):
+		}
+	}
+}
+
+func (c *Client) tunnelMatches(tun Tunnel, tunConfig TunnelConfig) bool {
+
+	if tunConfig.TunnelPort != 0 && tunConfig.TunnelPort != tun.TunnelPort {
+		return false
+	}
+
+	return tun.ClientName == c.clientName &&
+		tun.ClientAddress == tunConfig.ClientAddress &&
+		tun.ClientPort == tunConfig.ClientPort &&
+		tun.TlsTermination == tunConfig.TlsTermination &&
+		tun.AllowExternalTcp == tunConfig.AllowExternalTcp &&
+		tun.DisableBuffering == tunConfig.DisableBuffering &&
+		tun.AuthUsername == tunConfig.AuthUsername &&
+		tun.AuthPassword == tunConfig.AuthPassword
+}
+
+// superviseTunnel keeps a tunnel running until ctx is cancelled, reconnecting
+// with exponential backoff and jitter whenever the connection drops.
+func (c *Client) superviseTunnel(ctx context.Context, tunnel Tunnel) {
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	backoff := minReconnectDelay
+
+	for {
+		start := time.Now()
+
+		err := c.BoreTunnel(ctx, tunnel)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Printf("Tunnel %s down: %v", tunnel.Domain, err)
+		} else {
+			log.Printf("Tunnel %s disconnected", tunnel.Domain)
+		}
+
+		// A tunnel that stayed up for a while is considered healthy, so
+		// start over with a short delay.
+		if time.Since(start) > maxReconnectDelay {
+			backoff = minReconnectDelay
+		}
+
+		// Wait somewhere between half and all of the backoff, so clients
+		// don't all reconnect at once after a server restart.
+		delay := backoff/2 + time.Duration(rng.Int63n(int64(backoff/2)+1))
+
+		log.Printf("Reconnecting tunnel %s in %s", tunnel.Domain, delay.Round(time.Millisecond))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		backoff *= 2
+		if backoff > maxReconnectDelay {
+			backoff = maxReconnectDelay
+		}
+	}
+}
+
+// BoreTunnel connects a tunnel and blocks until either ctx is cancelled or the
+// SSH connection is lost.
 func (c *Client) BoreTunnel(ctx context.Context, tunnel Tunnel) error {
 
 	log.Println("BoreTunnel", tunnel.Domain)
@@ -285,15 +665,18 @@ func (c *Client) BoreTunnel(ctx context.Context, tunnel Tunnel) error {
 		return fmt.Errorf("Unable to parse private key: %v", err)
 	}
 
-	//var hostKey ssh.PublicKey
+	hostKeyCallback, err := c.hostKeyCallback(tunnel)
+	if err != nil {
+		return err
+	}
 
 	config := &ssh.ClientConfig{
 		User: tunnel.Username,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		//HostKeyCallback: ssh.FixedHostKey(hostKey),
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshDialTimeout,
 	}
 
 	sshHost := fmt.Sprintf("%s:%d", tunnel.ServerAddress, tunnel.ServerPort)
@@ -314,21 +697,26 @@ func (c *Client) BoreTunnel(ctx context.Context, tunnel Tunnel) error {
 	}
 	defer listener.Close()
 
+	conns := newConnTracker()
+	var httpServer *http.Server
+
 	if tunnel.TlsTermination == "client" {
 
 		tlsConfig := &tls.Config{
 			GetCertificate: c.certConfig.GetCertificate,
 			NextProtos:     []string{"h2", "acme-tls/1"},
 		}
-		tlsListener := tls.NewListener(listener, tlsConfig)
+		// Track the raw connections as well, since Shutdown doesn't
+		// wait for upgraded (ie WebSocket) connections.
+		tlsListener := tls.NewListener(conns.Listener(listener), tlsConfig)
 
 		httpMux := http.NewServeMux()
 
 		httpMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			proxyRequest(w, r, tunnel, c.httpClient, tunnel.ClientAddress, tunnel.ClientPort, c.behindProxy)
+			c.httpProxy.ProxyRequest(w, r, tunnel, tunnel.ClientAddress, tunnel.ClientPort, c.behindProxy)
 		})
 
-		httpServer := &http.Server{
+		httpServer = &http.Server{
 			Handler: httpMux,
 		}
 
@@ -344,13 +732,10 @@ func (c *Client) BoreTunnel(ctx context.Context, tunnel Tunnel) error {
 			for {
 				conn, err := listener.Accept()
 				if err != nil {
-					// TODO: Currently assuming an error means the
-					// tunnel was manually deleted, but there
-					// could be other errors that we should be
-					// attempting to recover from rather than
-					// breaking.
+					// The listener only fails once the SSH
+					// connection is gone, in which case
+					// superviseTunnel takes care of reconnecting.
 					break
-					//continue
 				}
 
 				var useTls bool
@@ -360,7 +745,7 @@ func (c *Client) BoreTunnel(ctx context.Context, tunnel Tunnel) error {
 					useTls = false
 				}
 
-				go ProxyTcp(conn, tunnel.ClientAddress, tunnel.ClientPort, useTls, c.certConfig)
+				go ProxyTcp(conns.Track(conn), tunnel.ClientAddress, tunnel.ClientPort, useTls, c.certConfig)
 			}
 		}()
 	}
@@ -375,9 +760,127 @@ func (c *Client) BoreTunnel(ctx context.Context, tunnel Tunnel) error {
 		}
 	}
 
-	<-ctx.Done()
+	log.Printf("Tunnel %s connected", tunnel.Domain)
 
-	return nil
+	connDone := make(chan error, 1)
+	go func() {
+		connDone <- client.Wait()
+	}()
+
+	go keepAlive(ctx, client)
+
+	select {
+	case <-ctx.Done():
+		c.drainTunnel(tunnel, listener, httpServer, conns)
+		return nil
+	case err := <-connDone:
+		return fmt.Errorf("SSH connection lost: %v", err)
+	}
+}
+
+// drainTunnel stops accepting new connections for a tunnel and waits up to
+// the shutdown timeout for the open ones to finish.
+func (c *Client) drainTunnel(tunnel Tunnel, listener net.Listener, httpServer *http.Server, conns *connTracker) {
+
+	listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+	defer cancel()
+
+	if httpServer != nil {
+		httpServer.Shutdown(ctx)
+	}
+
+	err := conns.Wait(ctx)
+	if err != nil {
+		log.Printf("Tunnel %s: timed out waiting for connections to finish", tunnel.Domain)
+	}
+}
+
+// hostKeyCallback verifies the SSH server against the host key published by
+// the server. Servers which don't publish a key fall back to trust on first
+// use if a known_hosts file is configured.
+func (c *Client) hostKeyCallback(tunnel Tunnel) (ssh.HostKeyCallback, error) {
+
+	if tunnel.ServerPublicKey != "" {
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(tunnel.ServerPublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid server public key: %v", err)
+		}
+
+		return ssh.FixedHostKey(hostKey), nil
+	}
+
+	if c.knownHostsFile == "" {
+		log.Printf("WARNING: Server didn't provide a host key for %s and no known hosts file is configured. Not verifying SSH server identity", tunnel.Domain)
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		c.knownHostsMutex.Lock()
+		defer c.knownHostsMutex.Unlock()
+
+		// Create the file if it doesn't exist yet
+		f, err := os.OpenFile(c.knownHostsFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		checkKnownHosts, err := knownhosts.New(c.knownHostsFile)
+		if err != nil {
+			return err
+		}
+
+		err = checkKnownHosts(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			log.Printf("Trusting new SSH host key for %s (%s)", hostname, ssh.FingerprintSHA256(key))
+			line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+			_, err = f.WriteString(line + "\n")
+			return err
+		}
+
+		return err
+	}, nil
+}
+
+// keepAlive periodically pings the server, and closes the connection if the
+// server stops responding. This catches half-dead connections (ie after a
+// network change) which would otherwise hang around indefinitely.
+func keepAlive(ctx context.Context, client *ssh.Client) {
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		select {
+		case err := <-replied:
+			if err != nil {
+				client.Close()
+				return
+			}
+		case <-time.After(keepAliveTimeout):
+			log.Println("SSH keepalive timed out")
+			client.Close()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 func printJson(data interface{}) {
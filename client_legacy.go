@@ -0,0 +1,92 @@
+package boringproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Servers from before /api/v1 only have the original form-based API. The
+// client falls back to it when /api/v1/me isn't found, and polls for tunnel
+// changes, since those servers can't be watched. Declared tunnels need the
+// v1 API.
+
+// legacyAddClient registers the client with POST /api/clients.
+func (c *Client) legacyAddClient(ctx context.Context) error {
+
+	params := url.Values{}
+	params.Set("client-name", c.clientName)
+	if c.user != "" {
+		params.Set("user", c.user)
+	}
+
+	_, _, err := c.legacyRequest(ctx, "POST", "/api/clients/?"+params.Encode())
+	return err
+}
+
+// legacyFetchTunnels gets the client's tunnels with GET /api/tunnels, and
+// syncs them if they changed.
+func (c *Client) legacyFetchTunnels(ctx context.Context) error {
+
+	params := url.Values{}
+	params.Set("client-name", c.clientName)
+
+	body, etag, err := c.legacyRequest(ctx, "GET", "/api/tunnels?"+params.Encode())
+	if err != nil {
+		return fmt.Errorf("Failed to get tunnels: %v", err)
+	}
+
+	if etag != "" && etag == c.previousEtag {
+		return nil
+	}
+
+	tunnels := make(map[string]Tunnel)
+	err = json.Unmarshal(body, &tunnels)
+	if err != nil {
+		return err
+	}
+
+	c.SyncTunnels(ctx, tunnels)
+
+	c.previousEtag = etag
+
+	return nil
+}
+
+// legacyRequest makes an authenticated request to the original API, and
+// returns the response body and ETag.
+func (c *Client) legacyRequest(ctx context.Context, method, path string) ([]byte, string, error) {
+
+	baseUrl := strings.TrimSuffix(c.server, "/")
+	if !strings.Contains(baseUrl, "://") {
+		baseUrl = "https://" + baseUrl
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, baseUrl+path, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.Header.Set("Authorization", "bearer "+c.token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, "", fmt.Errorf("HTTP Status code: %d. Message: %s", resp.StatusCode, string(body))
+	}
+
+	return body, resp.Header.Get("ETag"), nil
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boringproxy/boringproxy"
+)
+
+const adminUsage = `Usage: %s admin [command] [flags]
+
+Manage the server database directly. With the json backend, stop the server
+first, since it would overwrite any changes.
+
+Commands:
+    users list|create|delete|set-role
+    orgs list|create|delete|add-member|remove-member
+    tokens list|create|delete
+    tunnels list|create|delete
+    clients list|create|delete
+    rotate-admin-token    Replace an admin's login tokens with a new one.
+    export                Write the whole database as JSON.
+    import                Load a database written by export.
+
+Use "%[1]s admin command [subcommand] -h" for a list of flags for the command.
+`
+
+// adminFlags are the flags every admin command takes for finding the database.
+type adminFlags struct {
+	dbDir         *string
+	dbBackend     *string
+	masterKeyFile *string
+}
+
+func newAdminFlagSet(name string) (*flag.FlagSet, *adminFlags) {
+	flagSet := flag.NewFlagSet(os.Args[0]+" admin "+name, flag.ExitOnError)
+	flags := &adminFlags{
+		dbDir:         flagSet.String("db-dir", "", "Database file directory"),
+		dbBackend:     flagSet.String("db-backend", boringproxy.StoreBackendJson, "Database storage backend (json or bolt)"),
+		masterKeyFile: flagSet.String("master-key-file", "", "File containing the database master key. Defaults to the BORINGPROXY_MASTER_KEY environment variable"),
+	}
+	return flagSet, flags
+}
+
+func (f *adminFlags) open() *boringproxy.Admin {
+	masterKey, err := boringproxy.LoadMasterKey(*f.masterKeyFile)
+	if err != nil {
+		fail(err.Error())
+	}
+
+	admin, err := boringproxy.OpenAdmin(*f.dbDir, *f.dbBackend, masterKey)
+	if err != nil {
+		fail(err.Error())
+	}
+
+	return admin
+}
+
+func runAdminCommand(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, os.Args[0]+" admin: Need a command")
+		fmt.Printf(adminUsage, os.Args[0])
+		os.Exit(1)
+	}
+
+	command := args[0]
+
+	switch command {
+	case "help", "-h", "--help", "-help":
+		fmt.Printf(adminUsage, os.Args[0])
+	case "users":
+		runAdminUsersCommand(args[1:])
+	case "orgs":
+		runAdminOrgsCommand(args[1:])
+	case "tokens":
+		runAdminTokensCommand(args[1:])
+	case "tunnels":
+		runAdminTunnelsCommand(args[1:])
+	case "clients":
+		runAdminClientsCommand(args[1:])
+	case "rotate-admin-token":
+		flagSet, flags := newAdminFlagSet(command)
+		username := flagSet.String("user", "admin", "Admin user to rotate the token of")
+		flagSet.Parse(args[1:])
+
+		admin := flags.open()
+		defer admin.Close()
+
+		token, deleted, err := admin.RotateAdminToken(*username)
+		if err != nil {
+			fail(err.Error())
+		}
+
+		fmt.Printf("Deleted %d old tokens. New token:\n%s\n", deleted, token)
+	case "export":
+		flagSet, flags := newAdminFlagSet(command)
+		outPath := flagSet.String("o", "", "File to write the export to. Defaults to stdout")
+		flagSet.Parse(args[1:])
+
+		admin := flags.open()
+		defer admin.Close()
+
+		out := os.Stdout
+		if *outPath != "" {
+			// The export contains tunnel private keys
+			f, err := os.OpenFile(*outPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				fail(err.Error())
+			}
+			defer f.Close()
+			out = f
+		}
+
+		err := admin.Export(out)
+		if err != nil {
+			fail(err.Error())
+		}
+	case "import":
+		flagSet, flags := newAdminFlagSet(command)
+		inPath := flagSet.String("i", "", "Export file to import")
+		mode := flagSet.String("mode", boringproxy.ImportModeMerge, "merge adds what doesn't exist yet, replace discards everything first")
+		flagSet.Parse(args[1:])
+
+		if *inPath == "" {
+			fail("-i is required")
+		}
+
+		f, err := os.Open(*inPath)
+		if err != nil {
+			fail(err.Error())
+		}
+		defer f.Close()
+
+		admin := flags.open()
+		defer admin.Close()
+
+		stats, err := admin.Import(f, *mode)
+		if err != nil {
+			fail(err.Error())
+		}
+
+		fmt.Printf("Imported %d users, %d orgs, %d tokens and %d tunnels. Skipped %d which already existed\n", stats.Users, stats.Orgs, stats.Tokens, stats.Tunnels, stats.Skipped)
+	default:
+		fail(os.Args[0] + " admin: Invalid command " + command)
+	}
+}
+
+func adminSubcommand(resource string, args []string) string {
+	if len(args) < 1 {
+		fail(fmt.Sprintf("%s admin %s: Need a command (list, create or delete)", os.Args[0], resource))
+	}
+	return args[0]
+}
+
+func runAdminUsersCommand(args []string) {
+
+	command := adminSubcommand("users", args)
+	flagSet, flags := newAdminFlagSet("users " + command)
+
+	switch command {
+	case "list":
+		flagSet.Parse(args[1:])
+
+		admin := flags.open()
+		defer admin.Close()
+
+		users := admin.GetUsers()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tROLE\tCLIENTS")
+		for _, username := range sortedUsernames(users) {
+			user := users[username]
+
+			clientNames := []string{}
+			for clientName := range user.Clients {
+				clientNames = append(clientNames, clientName)
+			}
+			sort.Strings(clientNames)
+
+			fmt.Fprintf(w, "%s\t%s\t%s\n", username, user.Role, strings.Join(clientNames, ","))
+		}
+		w.Flush()
+	case "create":
+		username := flagSet.String("username", "", "Username")
+		role := flagSet.String("role", boringproxy.RoleMember, "Role (admin, operator, member or auditor)")
+		isAdmin := flagSet.Bool("admin", false, "Same as -role admin")
+		flagSet.Parse(args[1:])
+
+		if *username == "" {
+			fail("-username is required")
+		}
+
+		if *isAdmin {
+			*role = boringproxy.RoleAdmin
+		}
+
+		admin := flags.open()
+		defer admin.Close()
+
+		err := admin.CreateUser(*username, *role)
+		if err != nil {
+			fail(err.Error())
+		}
+	case "set-role":
+		username := flagSet.String("username", "", "Username")
+		role := flagSet.String("role", "", "Role (admin, operator, member or auditor)")
+		flagSet.Parse(args[1:])
+
+		if *username == "" {
+			fail("-username is required")
+		}
+
+		if *role == "" {
+			fail("-role is required")
+		}
+
+		admin := flags.open()
+		defer admin.Close()
+
+		err := admin.SetUserRole(*username, *role)
+		if err != nil {
+			fail(err.Error())
+		}
+	case "delete":
+		username := flagSet.String("username", "", "Username")
+		flagSet.Parse(args[1:])
+
+		if *username == "" {
+			fail("-username is required")
+		}
+
+		admin := flags.open()
+		defer admin.Close()
+
+		err := admin.DeleteUser(*username)
+		if err != nil {
+			fail(err.Error())
+		}
+	default:
+		fail(os.Args[0] + " admin users: Invalid command " + command)
+	}
+}
+
+func runAdminOrgsCommand(args []string) {
+
+	command := adminSubcommand("orgs", args)
+	flagSet, flags := newAdminFlagSet("orgs " + command)
+
+	switch command {
+	case "list":
+		flagSet.Parse(args[1:])
+
+		admin := flags.open()
+		defer admin.Close()
+
+		orgs := admin.GetOrgs()
+
+		names := []string{}
+		for name := range orgs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tMEMBERS\tCLIENTS")
+		for _, name := range names {
+			org := orgs[name]
+
+			members := []string{}
+			for username := range org.Members {
+				members = append(members, username)
+			}
+			sort.Strings(members)
+
+			clientNames := []string{}
+			for clientName := range org.Clients {
+				clientNames = append(clientNames, clientName)
+			}
+			sort.Strings(clientNames)
+
+			fmt.Fprintf(w, "%s\t%s\t%s\n", name, strings.Join(members, ","), strings.Join(clientNames, ","))
+		}
+		w.Flush()
+	case "create", "delete":
+		name := flagSet.String("name", "", "Org name")
+		flagSet.Parse(args[1:])
+
+		if *name == "" {
+			fail("-name is required")
+		}
+
+		admin := flags.open()
+		defer admin.Close()
+
+		var err error
+		if command == "create" {
+			err = admin.CreateOrg(*name)
+		} else {
+			err = admin.DeleteOrg(*name)
+		}
+		if err != nil {
+			fail(err.Error())
+		}
+	case "add-member", "remove-member":
+		name := flagSet.String("name", "", "Org name")
+		username := flagSet.String("username", "", "Username")
+		flagSet.Parse(args[1:])
+
+		if *name == "" || *username == "" {
+			fail("-name and -username are required")
+		}
+
+		admin := flags.open()
+		defer admin.Close()
+
+		var err error
+		if command == "add-member" {
+			err = admin.SetOrgMember(*name, *username)
+		} else {
+			err = admin.DeleteOrgMember(*name, *username)
+		}
+		if err != nil {
+			fail(err.Error())
+		}
+	default:
+		fail(os.Args[0] + " admin orgs: Invalid command " + command)
+	}
+}
+
+func runAdminTokensCommand(args []string) {
+
+	command := adminSubcommand("tokens", args)
+	flagSet, flags := newAdminFlagSet("tokens " + command)
+
+	switch command {
+	case "list":
+		owner := flagSet.String("owner", "", "Only list tokens owned by this user")
+		flagSet.Parse(args[1:])
+
+		admin := flags.open()
+		defer admin.Close()
+
+		tokens := admin.GetTokens()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tOWNER\tORG\tCLIENT\tSCOPES\tEXPIRES\tLAST USED\tDESCRIPTION")
+		ids := []string{}
+		for id := range tokens {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			tokenData := tokens[id]
+			if *owner != "" && tokenData.Owner != *owner {
+				continue
+			}
+
+			scopes := strings.Join(tokenData.Scopes, ",")
+			if scopes == "" {
+				scopes = "all"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", id, tokenData.Owner, tokenData.Org, tokenData.Client, scopes,
+				formatTime(tokenData.ExpiresAt, "never"), formatTime(tokenData.LastUsedAt, "never"), tokenData.Description)
+		}
+		w.Flush()
+	case "create":
+		owner := flagSet.String("owner", "", "User the token belongs to")
+		org := flagSet.String("org", "", "Limit the token to this org, which the owner must be a member of")
+		client := flagSet.String("client", "", "Limit the token to this client. With -org, it must be one of the org's clients")
+		description := flagSet.String("description", "", "Description")
+		expiresInDays := flagSet.Int("expires-in-days", 0, "Days until the token expires. 0 means never")
+		scopes := flagSet.String("scopes", "", "Comma separated scopes to limit the token to (read-only, tunnels:write, clients:write, tokens:write, users:admin). Empty means full access")
+		flagSet.Parse(args[1:])
+
+		if *owner == "" {
+			fail("-owner is required")
+		}
+
+		tokenData := boringproxy.TokenData{
+			Owner:       *owner,
+			Org:         *org,
+			Client:      *client,
+			Description: *description,
+		}
+
+		if *expiresInDays > 0 {
+			tokenData.ExpiresAt = time.Now().UTC().AddDate(0, 0, *expiresInDays)
+		}
+
+		if *scopes != "" {
+			tokenData.Scopes = strings.Split(*scopes, ",")
+		}
+
+		admin := flags.open()
+		defer admin.Close()
+
+		token, err := admin.CreateToken(tokenData)
+		if err != nil {
+			fail(err.Error())
+		}
+
+		fmt.Println(token)
+	case "delete":
+		id := flagSet.String("id", "", "Token id, as shown by list")
+		flagSet.Parse(args[1:])
+
+		if *id == "" {
+			fail("-id is required")
+		}
+
+		admin := flags.open()
+		defer admin.Close()
+
+		err := admin.DeleteToken(*id)
+		if err != nil {
+			fail(err.Error())
+		}
+	default:
+		fail(os.Args[0] + " admin tokens: Invalid command " + command)
+	}
+}
+
+func runAdminTunnelsCommand(args []string) {
+
+	command := adminSubcommand("tunnels", args)
+	flagSet, flags := newAdminFlagSet("tunnels " + command)
+
+	switch command {
+	case "list":
+		owner := flagSet.String("owner", "", "Only list tunnels owned by this user or org")
+		flagSet.Parse(args[1:])
+
+		admin := flags.open()
+		defer admin.Close()
+
+		tunnels := admin.GetTunnels()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "DOMAIN\tOWNER\tCLIENT\tTARGET\tTUNNEL PORT\tTLS TERMINATION")
+		domains := []string{}
+		for domain := range tunnels {
+			domains = append(domains, domain)
+		}
+		sort.Strings(domains)
+
+		for _, domain := range domains {
+			tun := tunnels[domain]
+			if *owner != "" && tun.Owner != *owner {
+				continue
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s:%d\t%d\t%s\n", domain, tun.Owner, tun.ClientName, tun.ClientAddress, tun.ClientPort, tun.TunnelPort, tun.TlsTermination)
+		}
+		w.Flush()
+	case "create":
+		tunReq := boringproxy.Tunnel{}
+		flagSet.StringVar(&tunReq.Domain, "domain", "", "Tunnel domain")
+		flagSet.StringVar(&tunReq.Owner, "owner", "", "User or org the tunnel belongs to")
+		flagSet.StringVar(&tunReq.ClientName, "client-name", "", "Client which connects the tunnel")
+		flagSet.StringVar(&tunReq.ClientAddress, "client-addr", "127.0.0.1", "Address the client forwards to")
+		flagSet.IntVar(&tunReq.ClientPort, "client-port", 0, "Port the client forwards to")
+		flagSet.IntVar(&tunReq.TunnelPort, "tunnel-port", 0, "Port on the server. Random if 0")
+		flagSet.StringVar(&tunReq.TlsTermination, "tls-termination", "client", "server, client, passthrough, client-tls or server-tls")
+		flagSet.BoolVar(&tunReq.AllowExternalTcp, "allow-external-tcp", false, "Allow connecting to the tunnel port from outside the server")
+		flagSet.BoolVar(&tunReq.DisableBuffering, "disable-buffering", false, "Disable response buffering")
+		flagSet.Parse(args[1:])
+
+		if tunReq.Domain == "" || tunReq.Owner == "" {
+			fail("-domain and -owner are required")
+		}
+
+		admin := flags.open()
+		defer admin.Close()
+
+		tun, err := admin.CreateTunnel(tunReq)
+		if err != nil {
+			fail(err.Error())
+		}
+
+		fmt.Printf("Created tunnel %s on port %d\n", tun.Domain, tun.TunnelPort)
+	case "delete":
+		domain := flagSet.String("domain", "", "Tunnel domain")
+		flagSet.Parse(args[1:])
+
+		if *domain == "" {
+			fail("-domain is required")
+		}
+
+		admin := flags.open()
+		defer admin.Close()
+
+		err := admin.DeleteTunnel(*domain)
+		if err != nil {
+			fail(err.Error())
+		}
+	default:
+		fail(os.Args[0] + " admin tunnels: Invalid command " + command)
+	}
+}
+
+func runAdminClientsCommand(args []string) {
+
+	command := adminSubcommand("clients", args)
+	flagSet, flags := newAdminFlagSet("clients " + command)
+
+	switch command {
+	case "list":
+		username := flagSet.String("user", "", "Only list clients of this user or org")
+		flagSet.Parse(args[1:])
+
+		admin := flags.open()
+		defer admin.Close()
+
+		clients := make(map[string]map[string]boringproxy.DbClient)
+		for name, user := range admin.GetUsers() {
+			clients[name] = user.Clients
+		}
+		for name, org := range admin.GetOrgs() {
+			clients[name] = org.Clients
+		}
+
+		owners := []string{}
+		for name := range clients {
+			owners = append(owners, name)
+		}
+		sort.Strings(owners)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "OWNER\tCLIENT")
+		for _, name := range owners {
+			if *username != "" && name != *username {
+				continue
+			}
+
+			clientNames := []string{}
+			for clientName := range clients[name] {
+				clientNames = append(clientNames, clientName)
+			}
+			sort.Strings(clientNames)
+
+			for _, clientName := range clientNames {
+				fmt.Fprintf(w, "%s\t%s\n", name, clientName)
+			}
+		}
+		w.Flush()
+	case "create", "delete":
+		username := flagSet.String("user", "", "User or org the client belongs to")
+		clientName := flagSet.String("name", "", "Client name")
+		flagSet.Parse(args[1:])
+
+		if *username == "" || *clientName == "" {
+			fail("-user and -name are required")
+		}
+
+		admin := flags.open()
+		defer admin.Close()
+
+		var err error
+		if command == "create" {
+			err = admin.SetClient(*username, *clientName)
+		} else {
+			err = admin.DeleteClient(*username, *clientName)
+		}
+		if err != nil {
+			fail(err.Error())
+		}
+	default:
+		fail(os.Args[0] + " admin clients: Invalid command " + command)
+	}
+}
+
+func sortedUsernames(users map[string]boringproxy.User) []string {
+	usernames := []string{}
+	for username := range users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+func formatTime(t time.Time, zero string) string {
+	if t.IsZero() {
+		return zero
+	}
+	return t.Format("2006-01-02 15:04")
+}
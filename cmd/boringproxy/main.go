@@ -8,7 +8,9 @@ import (
 	"io"
 	"net"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 
 	"github.com/boringproxy/boringproxy"
 )
@@ -19,6 +21,8 @@ Commands:
     version      Prints version information.
     server       Start a new server.
     client       Connect to a server.
+    db           Manage the server database.
+    admin        Manage users, tokens and tunnels without a running server.
     tuntls       Tunnel a raw TLS connection.
 
 Use "%[1]s command -h" for a list of flags for the command.
@@ -84,53 +88,60 @@ func main() {
 		}
 	case "server":
 		boringproxy.Listen()
+	case "db":
+		runDbCommand(os.Args[2:])
+	case "admin":
+		runAdminCommand(os.Args[2:])
 	case "client":
+		config := &boringproxy.ClientConfig{}
+
 		flagSet := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-		server := flagSet.String("server", "", "boringproxy server")
-		token := flagSet.String("token", "", "Access token")
-		name := flagSet.String("client-name", "", "Client name")
-		user := flagSet.String("user", "", "user")
-		certDir := flagSet.String("cert-dir", "", "TLS cert directory")
-		acmeEmail := flagSet.String("acme-email", "", "Email for ACME (ie Let's Encrypt)")
-		acmeUseStaging := flagSet.Bool("acme-use-staging", false, "Use ACME (ie Let's Encrypt) staging servers")
-		acmeCa := flagSet.String("acme-certificate-authority", "", "URI for ACME Certificate Authority")
-		dnsServer := flagSet.String("dns-server", "", "Custom DNS server")
-		behindProxy := flagSet.Bool("behind-proxy", false, "Whether we're running behind another reverse proxy")
-		pollInterval := flagSet.Int("poll-interval-ms", 2000, "Interval in milliseconds to poll for tunnel changes")
+		configFile := flagSet.String("config", "", "Config file (JSON or YAML). Flags override values from the file")
+		flagSet.StringVar(&config.ServerAddr, "server", "", "boringproxy server")
+		flagSet.StringVar(&config.Token, "token", "", "Access token")
+		flagSet.StringVar(&config.ClientName, "client-name", "", "Client name. Defaults to the client the token is limited to")
+		flagSet.StringVar(&config.User, "user", "", "User or org to run the client as. Defaults to the token's owner, or its org if it's limited to one")
+		flagSet.StringVar(&config.CertDir, "cert-dir", "", "TLS cert directory")
+		flagSet.StringVar(&config.AcmeEmail, "acme-email", "", "Email for ACME (ie Let's Encrypt)")
+		flagSet.BoolVar(&config.AcmeUseStaging, "acme-use-staging", false, "Use ACME (ie Let's Encrypt) staging servers")
+		flagSet.StringVar(&config.AcmeCa, "acme-certificate-authority", "", "URI for ACME Certificate Authority")
+		flagSet.StringVar(&config.DnsServer, "dns-server", "", "Custom DNS server")
+		flagSet.BoolVar(&config.BehindProxy, "behind-proxy", false, "Whether we're running behind another reverse proxy")
+		flagSet.IntVar(&config.PollInterval, "poll-interval-ms", 2000, "Interval in milliseconds to poll for tunnel changes, with -disable-watch or if the server doesn't support watching")
+		flagSet.BoolVar(&config.DisableWatch, "disable-watch", false, "Always poll for tunnel changes instead of waiting for the server to push them")
+		flagSet.StringVar(&config.KnownHostsFile, "known-hosts-file", "", "Trust on first use known_hosts file, for servers that don't publish their SSH host key")
+		flagSet.IntVar(&config.ShutdownTimeout, "shutdown-timeout", 30, "Seconds to wait for open connections to finish when shutting down")
 
 		err := flagSet.Parse(os.Args[2:])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s: parsing flags: %s\n", os.Args[0], err)
 		}
 
-		if *server == "" {
+		if *configFile != "" {
+			err = boringproxy.LoadClientConfigFile(*configFile, config)
+			if err != nil {
+				fail(err.Error())
+			}
+
+			// Parse again so flags take precedence over the file
+			flagSet.Parse(os.Args[2:])
+		}
+
+		if config.ServerAddr == "" {
 			fail("-server is required")
 		}
 
-		if *token == "" {
+		if config.Token == "" {
 			fail("-token is required")
 		}
 
 		minPollInterval := 100
-		if *pollInterval != 0 && *pollInterval < minPollInterval {
+		if config.PollInterval != 0 && config.PollInterval < minPollInterval {
 			fail(fmt.Sprintf("-poll-interval-ms must be at least %d, or 0 to disable polling", minPollInterval))
 		}
 
-		config := &boringproxy.ClientConfig{
-			ServerAddr:     *server,
-			Token:          *token,
-			ClientName:     *name,
-			User:           *user,
-			CertDir:        *certDir,
-			AcmeEmail:      *acmeEmail,
-			AcmeUseStaging: *acmeUseStaging,
-			AcmeCa:         *acmeCa,
-			DnsServer:      *dnsServer,
-			BehindProxy:    *behindProxy,
-			PollInterval:   *pollInterval,
-		}
-
-		ctx := context.Background()
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
 
 		client, err := boringproxy.NewClient(config)
 		if err != nil {
@@ -149,6 +160,111 @@ func main() {
 	}
 }
 
+const dbUsage = `Usage: %s db [command] [flags]
+
+Commands:
+    convert      Copy the database to a different storage backend.
+    migrate      Upgrade the database to the current schema version.
+    rekey        Change the key used to encrypt secrets in the database.
+
+Use "%[1]s db command -h" for a list of flags for the command.
+`
+
+func runDbCommand(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, os.Args[0]+" db: Need a command")
+		fmt.Printf(dbUsage, os.Args[0])
+		os.Exit(1)
+	}
+
+	command := args[0]
+
+	switch command {
+	case "help", "-h", "--help", "-help":
+		fmt.Printf(dbUsage, os.Args[0])
+	case "convert":
+		flagSet := flag.NewFlagSet(os.Args[0]+" db convert", flag.ExitOnError)
+		dbDir := flagSet.String("db-dir", "", "Database file directory")
+		from := flagSet.String("from", boringproxy.StoreBackendJson, "Backend to copy from (json or bolt)")
+		to := flagSet.String("to", boringproxy.StoreBackendBolt, "Backend to copy to (json or bolt)")
+		flagSet.Parse(args[1:])
+
+		err := boringproxy.ConvertDatabase(*dbDir, *from, *to)
+		if err != nil {
+			fail(err.Error())
+		}
+
+		fmt.Printf("Database converted. Start the server with -db-backend %s to use it\n", *to)
+	case "migrate":
+		flagSet := flag.NewFlagSet(os.Args[0]+" db migrate", flag.ExitOnError)
+		dbDir := flagSet.String("db-dir", "", "Database file directory")
+		dbBackend := flagSet.String("db-backend", boringproxy.StoreBackendJson, "Database storage backend (json or bolt)")
+		masterKeyFile := flagSet.String("master-key-file", "", "File containing the database master key. Defaults to the BORINGPROXY_MASTER_KEY environment variable")
+		dryRun := flagSet.Bool("dry-run", false, "Run the migrations without saving anything, to see what would change")
+		flagSet.Parse(args[1:])
+
+		masterKey, err := boringproxy.LoadMasterKey(*masterKeyFile)
+		if err != nil {
+			fail(err.Error())
+		}
+
+		applied, err := boringproxy.MigrateDatabase(*dbDir, *dbBackend, masterKey, *dryRun)
+		if err != nil {
+			fail(err.Error())
+		}
+
+		if len(applied) == 0 {
+			fmt.Println("Database is already up to date")
+			return
+		}
+
+		if *dryRun {
+			fmt.Println("Dry run. These migrations would be applied:")
+		} else {
+			fmt.Println("Applied migrations:")
+		}
+
+		for _, desc := range applied {
+			fmt.Println("    " + desc)
+		}
+	case "rekey":
+		flagSet := flag.NewFlagSet(os.Args[0]+" db rekey", flag.ExitOnError)
+		dbDir := flagSet.String("db-dir", "", "Database file directory")
+		dbBackend := flagSet.String("db-backend", boringproxy.StoreBackendJson, "Database storage backend (json or bolt)")
+		oldKeyFile := flagSet.String("old-key-file", "", "File containing the current master key. Defaults to the BORINGPROXY_MASTER_KEY environment variable. Leave both unset if the database isn't encrypted yet")
+		newKeyFile := flagSet.String("new-key-file", "", "File containing the new master key. Leave unset to decrypt the database")
+		flagSet.Parse(args[1:])
+
+		oldKey, err := boringproxy.LoadMasterKey(*oldKeyFile)
+		if err != nil {
+			fail(err.Error())
+		}
+
+		var newKey []byte
+		if *newKeyFile != "" {
+			newKey, err = boringproxy.LoadMasterKey(*newKeyFile)
+			if err != nil {
+				fail(err.Error())
+			}
+		}
+
+		changed, err := boringproxy.RekeyDatabase(*dbDir, *dbBackend, oldKey, newKey)
+		if err != nil {
+			fail(err.Error())
+		}
+
+		fmt.Printf("Updated secrets in %d tokens and tunnels\n", changed)
+
+		if newKey == nil {
+			fmt.Println("Database secrets are no longer encrypted. Start the server without a master key")
+		} else {
+			fmt.Println("Start the server with the new master key")
+		}
+	default:
+		fail(os.Args[0] + " db: Invalid command " + command)
+	}
+}
+
 func doTlsTunnel(server string, in io.Reader, out io.Writer) {
 	fmt.Fprintf(os.Stderr, "tuntls connecting to server: %s\n", server)
 
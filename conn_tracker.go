@@ -0,0 +1,82 @@
+package boringproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// connTracker keeps track of open connections, so shutdown can wait for them
+// to finish.
+type connTracker struct {
+	wg *sync.WaitGroup
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		wg: &sync.WaitGroup{},
+	}
+}
+
+// Track returns a connection which is counted as open until it's closed.
+func (t *connTracker) Track(conn net.Conn) net.Conn {
+	t.wg.Add(1)
+	return &trackedConn{
+		Conn: conn,
+		once: &sync.Once{},
+		done: t.wg.Done,
+	}
+}
+
+// Listener wraps l so every connection it accepts is tracked.
+func (t *connTracker) Listener(l net.Listener) net.Listener {
+	return &trackingListener{l, t}
+}
+
+// Wait blocks until every tracked connection is closed, or ctx is done.
+func (t *connTracker) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	once *sync.Once
+	done func()
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.done)
+	return err
+}
+
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+type trackingListener struct {
+	net.Listener
+	tracker *connTracker
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.tracker.Track(conn), nil
+}
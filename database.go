@@ -1,32 +1,62 @@
 package boringproxy
 
 import (
-	"encoding/json"
+	"bytes"
 	"errors"
-	"io/ioutil"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/takingnames/namedrop-go"
 )
 
 var DBFolderPath string
 
+const dbBackupPrefix = "boringproxy_db_backup_"
+
+// A backup of the database is made each time the server starts. This many are
+// kept.
+const maxDbBackups = 5
+
+// How long a user has to finish a namedrop domain request, and how often
+// expired ones are cleaned up.
+const domainRequestLifetime = 1 * time.Hour
+const domainRequestCleanupInterval = 10 * time.Minute
+
 type Database struct {
-	AdminDomain string                         `json:"admin_domain"`
-	Tokens      map[string]TokenData           `json:"tokens"`
-	Tunnels     map[string]Tunnel              `json:"tunnels"`
-	Users       map[string]User                `json:"users"`
-	dnsRequests map[string]namedrop.DNSRequest `json:"dns_requests"`
-	mutex       *sync.Mutex
+	store    Store
+	fileName string
+	mutex    *sync.Mutex
+	changes  chan struct{}
 }
 
+// TokenData is stored under the token's id. See tokens.go.
 type TokenData struct {
 	Owner  string `json:"owner"`
 	Client string `json:"client,omitempty"`
+	// SHA-256 of the token
+	Hash        string    `json:"hash"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Only updated every few minutes
+	LastUsedAt time.Time `json:"last_used_at"`
+	// Zero if the token doesn't expire
+	ExpiresAt time.Time `json:"expires_at"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	// Set if the token acts for an org its owner belongs to, instead of
+	// for its owner
+	Org string `json:"org,omitempty"`
 }
 
 type User struct {
+	// One of the Role constants
+	Role string `json:"role"`
+	// Same as Role == RoleAdmin. Kept in sync for API clients which
+	// predate roles.
 	IsAdmin bool                `json:"is_admin"`
 	Clients map[string]DbClient `json:"clients"`
 }
@@ -34,6 +64,29 @@ type User struct {
 type DbClient struct {
 }
 
+// Org is a group of users who share tunnels and clients. Orgs and users share
+// a namespace, so a tunnel's Owner can be either.
+type Org struct {
+	Members map[string]OrgMember `json:"members"`
+	Clients map[string]DbClient  `json:"clients"`
+}
+
+type OrgMember struct {
+}
+
+// DomainRequest is a namedrop request for a domain which hasn't come back
+// from the OAuth flow yet. They're stored so the flow survives a restart.
+type DomainRequest struct {
+	// Empty for the request made when setting up the admin domain
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (r DomainRequest) Expired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
+}
+
 type DNSRecord struct {
 	Type     string `json:"type"`
 	Value    string `json:"value"`
@@ -53,6 +106,7 @@ type Tunnel struct {
 	ClientPort       int    `json:"client_port"`
 	AllowExternalTcp bool   `json:"allow_external_tcp"`
 	TlsTermination   string `json:"tls_termination"`
+	DisableBuffering bool   `json:"disable_buffering"`
 
 	// TODO: These are not used by clients and possibly shouldn't be
 	// returned in API calls.
@@ -62,266 +116,700 @@ type Tunnel struct {
 	AuthPassword string `json:"auth_password"`
 }
 
-func NewDatabase(path string) (*Database, error) {
-
-	DBFolderPath = path
+// NewDatabase opens the database in the directory path, using the given
+// storage backend (StoreBackendJson or StoreBackendBolt). Existing databases
+// are backed up, then migrated to the current schema version.
+//
+// If masterKey isn't nil, tunnel private keys, tunnel passwords and tokens are
+// encrypted with it before they're stored. See LoadMasterKey.
+func NewDatabase(path, backend string, masterKey []byte) (*Database, error) {
 
-	dbJson, err := ioutil.ReadFile(DBFolderPath + "boringproxy_db.json")
+	db, existed, err := openDatabase(path, backend, masterKey)
 	if err != nil {
-		log.Printf("failed reading %sboringproxy_db.json\n", DBFolderPath)
-		dbJson = []byte("{}")
+		return nil, err
+	}
+
+	if existed {
+		// Encrypt first so the backup doesn't contain plaintext secrets
+		err = db.encryptSecrets()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		err = db.backup()
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Failed to back up database: %v", err)
+		}
+
+		_, err = db.migrate(false)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
 
-	var db *Database
+	return db, nil
+}
+
+// openDatabase opens the database without backing it up or migrating it, and
+// reports whether it already existed. New databases start at the current
+// schema version.
+func openDatabase(path, backend string, masterKey []byte) (*Database, bool, error) {
 
-	err = json.Unmarshal(dbJson, &db)
+	DBFolderPath = path
+
+	fileName, err := storeFileName(backend)
 	if err != nil {
-		log.Println(err)
-		db = &Database{}
+		return nil, false, err
 	}
 
-	if db.Tokens == nil {
-		db.Tokens = make(map[string]TokenData)
+	dbPath := DBFolderPath + fileName
+
+	_, err = os.Stat(dbPath)
+	existed := err == nil
+
+	// Don't quietly start with an empty database if there's one for a
+	// different backend, ie after forgetting -db-backend.
+	if !existed {
+		for _, other := range []string{StoreBackendJson, StoreBackendBolt} {
+			otherName, _ := storeFileName(other)
+			_, err := os.Stat(DBFolderPath + otherName)
+			if other != backend && err == nil {
+				return nil, false, fmt.Errorf("Found a %s database in %s, but the backend is set to %s. Convert it with 'boringproxy db convert' or select the backend with -db-backend", other, DBFolderPath, backend)
+			}
+		}
 	}
 
-	if db.Tunnels == nil {
-		db.Tunnels = make(map[string]Tunnel)
+	rawStore, err := openLockedStore(DBFolderPath, backend)
+	if err != nil {
+		return nil, false, err
 	}
 
-	if db.Users == nil {
-		db.Users = make(map[string]User)
+	store, err := setupEncryption(rawStore, masterKey)
+	if err != nil {
+		rawStore.Close()
+		return nil, false, err
 	}
 
-	if db.dnsRequests == nil {
-		db.dnsRequests = make(map[string]namedrop.DNSRequest)
+	db := &Database{
+		store:    store,
+		fileName: fileName,
+		mutex:    &sync.Mutex{},
+		changes:  make(chan struct{}),
 	}
 
-	db.mutex = &sync.Mutex{}
+	if !existed {
+		log.Printf("No database found at %s. Created a new one", dbPath)
 
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-	db.persist()
+		err = db.Update(func(tx StoreTx) error {
+			return tx.SetSchemaVersion(currentSchemaVersion)
+		})
+		if err != nil {
+			db.Close()
+			return nil, false, err
+		}
+	}
 
-	return db, nil
+	return db, existed, nil
 }
 
-func (d *Database) SetAdminDomain(adminDomain string) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+// setupEncryption wraps store so secrets are encrypted with masterKey. Without
+// a master key, store is returned as is, unless it contains encrypted secrets
+// which couldn't be used.
+func setupEncryption(store Store, masterKey []byte) (Store, error) {
+
+	if masterKey == nil {
+		encrypted := false
+		err := store.View(func(tx StoreTx) error {
+			encrypted = hasEncryptedSecrets(tx)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if encrypted {
+			return nil, errors.New("Database secrets are encrypted, but no master key was provided. Use -master-key-file or set " + masterKeyEnvVar)
+		}
+
+		return store, nil
+	}
 
-	d.AdminDomain = adminDomain
+	encStore, err := newEncryptedStore(store, masterKey)
+	if err != nil {
+		return nil, err
+	}
 
-	d.persist()
+	return encStore, nil
 }
-func (d *Database) GetAdminDomain() string {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
 
-	return d.AdminDomain
-}
+// encryptSecrets encrypts any secrets still stored in plaintext, ie the first
+// time the server runs with a master key.
+func (d *Database) encryptSecrets() error {
 
-func (d *Database) SetDNSRequest(requestId string, request namedrop.DNSRequest) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-
-	d.dnsRequests[requestId] = request
+	encStore, ok := d.store.(*encryptedStore)
+	if !ok {
+		return nil
+	}
 
-	// Not currently persisting because dnsRequests is only stored in
-	// memory. May change in the future.
-	//d.persist()
-}
-func (d *Database) GetDNSRequest(requestId string) (namedrop.DNSRequest, error) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+	changed := 0
+	err := encStore.Store.Update(func(tx StoreTx) error {
+		var err error
+		changed, err = rekeySecrets(tx, encStore.cipher, encStore.cipher)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt database secrets: %v", err)
+	}
 
-	if req, ok := d.dnsRequests[requestId]; ok {
-		return req, nil
+	if changed > 0 {
+		log.Printf("Encrypted secrets in %d tokens and tunnels. Backups made before now still contain them in plaintext", changed)
 	}
 
-	return namedrop.DNSRequest{}, errors.New("No such DNS Request")
+	return nil
 }
-func (d *Database) DeleteDNSRequest(requestId string) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
 
-	delete(d.dnsRequests, requestId)
+func (d *Database) Close() error {
+	return d.store.Close()
 }
 
-func (d *Database) AddToken(owner, client string) (string, error) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+// backup saves a timestamped copy of the database, and removes the oldest
+// backups so only maxDbBackups are kept.
+func (d *Database) backup() error {
+	return backupStore(d.store, d.fileName)
+}
 
-	_, exists := d.Users[owner]
-	if !exists {
-		return "", errors.New("Owner doesn't exist")
+func backupStore(store Store, fileName string) error {
+
+	var buf bytes.Buffer
+	err := store.Backup(&buf)
+	if err != nil {
+		return err
 	}
 
-	token, err := genRandomCode(32)
+	ext := filepath.Ext(fileName)
+	timestamp := time.Now().UTC().Format("20060102T150405Z")
+	backupPath := fmt.Sprintf("%s%s%s%s", DBFolderPath, dbBackupPrefix, timestamp, ext)
+
+	err = writeFileAtomic(backupPath, buf.Bytes(), 0600)
 	if err != nil {
-		return "", errors.New("Could not generat token")
+		return err
 	}
 
-	d.Tokens[token] = TokenData{
-		Owner:  owner,
-		Client: client,
+	backups, err := filepath.Glob(DBFolderPath + dbBackupPrefix + "*" + ext)
+	if err != nil {
+		return err
 	}
 
-	d.persist()
+	// The timestamps sort chronologically
+	sort.Strings(backups)
 
-	return token, nil
+	for len(backups) > maxDbBackups {
+		err := os.Remove(backups[0])
+		if err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
 }
 
-func (d *Database) GetTokens() map[string]TokenData {
+// Changes returns a channel which is closed the next time the tunnels a token
+// can see might change: when a tunnel is created, changed or deleted, a user's
+// role changes, an org's members change, or a user or org is deleted. Get a
+// new channel after each change. Other changes, ie to tokens or clients, don't
+// close it, since they would wake up every client watching its tunnels for
+// nothing.
+func (d *Database) Changes() <-chan struct{} {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	tokens := make(map[string]TokenData)
-
-	for k, v := range d.Tokens {
-		tokens[k] = v
-	}
+	return d.changes
+}
 
-	return tokens
+// View runs fn in a read-only transaction.
+func (d *Database) View(fn func(tx StoreTx) error) error {
+	return d.store.View(fn)
 }
 
-func (d *Database) GetTokenData(token string) (TokenData, bool) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+// Update runs fn in a read-write transaction. Everything fn changes is saved
+// at once if it returns nil, and nothing is saved if it returns an error, so
+// read-modify-write sequences can't race with other updates. If fn makes any
+// of the changes described at Changes, anyone waiting on it is notified once
+// they're saved.
+func (d *Database) Update(fn func(tx StoreTx) error) error {
 
-	tokenData, exists := d.Tokens[token]
+	tunnelsChanged := false
 
-	if !exists {
-		return TokenData{}, false
+	err := d.store.Update(func(tx StoreTx) error {
+		return fn(&tunnelChangesTx{tx, &tunnelsChanged})
+	})
+	if err != nil {
+		return err
 	}
 
-	return tokenData, true
-}
+	if !tunnelsChanged {
+		return nil
+	}
 
-func (d *Database) SetTokenData(token string, tokenData TokenData) {
 	d.mutex.Lock()
-	defer d.mutex.Unlock()
+	close(d.changes)
+	d.changes = make(chan struct{})
+	d.mutex.Unlock()
 
-	d.Tokens[token] = tokenData
-	d.persist()
+	return nil
 }
 
-func (d *Database) DeleteTokenData(token string) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+// tunnelChangesTx records whether a transaction makes any changes which affect
+// the tunnels tokens can see. See Changes.
+type tunnelChangesTx struct {
+	StoreTx
+	changed *bool
+}
 
-	delete(d.Tokens, token)
+func (tx *tunnelChangesTx) SetTunnel(domain string, tun Tunnel) error {
+	*tx.changed = true
+	return tx.StoreTx.SetTunnel(domain, tun)
+}
 
-	d.persist()
+func (tx *tunnelChangesTx) DeleteTunnel(domain string) error {
+	*tx.changed = true
+	return tx.StoreTx.DeleteTunnel(domain)
 }
 
-func (d *Database) GetTunnels() map[string]Tunnel {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+// Roles decide whether tokens can see other users' tunnels
+func (tx *tunnelChangesTx) SetUser(username string, user User) error {
+	if old, exists := tx.StoreTx.GetUser(username); exists && old.Role != user.Role {
+		*tx.changed = true
+	}
+	return tx.StoreTx.SetUser(username, user)
+}
 
-	tunnels := make(map[string]Tunnel)
+func (tx *tunnelChangesTx) DeleteUser(username string) error {
+	*tx.changed = true
+	return tx.StoreTx.DeleteUser(username)
+}
 
-	for k, v := range d.Tunnels {
-		tunnels[k] = v
+// Members can see the org's tunnels
+func (tx *tunnelChangesTx) SetOrg(name string, org Org) error {
+	old, _ := tx.StoreTx.GetOrg(name)
+	if !sameMembers(old.Members, org.Members) {
+		*tx.changed = true
 	}
+	return tx.StoreTx.SetOrg(name, org)
+}
 
-	return tunnels
+func (tx *tunnelChangesTx) DeleteOrg(name string) error {
+	*tx.changed = true
+	return tx.StoreTx.DeleteOrg(name)
 }
 
-func (d *Database) GetTunnel(domain string) (Tunnel, bool) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+func sameMembers(a, b map[string]OrgMember) bool {
+	if len(a) != len(b) {
+		return false
+	}
 
-	tun, exists := d.Tunnels[domain]
+	for username := range a {
+		if _, exists := b[username]; !exists {
+			return false
+		}
+	}
 
-	if !exists {
-		return Tunnel{}, false
+	return true
+}
+
+// view is View for getters which can't return an error.
+func (d *Database) view(fn func(tx StoreTx)) {
+	err := d.View(func(tx StoreTx) error {
+		fn(tx)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Database read failed: %v", err)
 	}
+}
 
-	return tun, true
+func (d *Database) SetAdminDomain(adminDomain string) error {
+	return d.Update(func(tx StoreTx) error {
+		return tx.SetAdminDomain(adminDomain)
+	})
+}
+func (d *Database) GetAdminDomain() string {
+	var adminDomain string
+	d.view(func(tx StoreTx) {
+		adminDomain = tx.GetAdminDomain()
+	})
+	return adminDomain
 }
 
-func (d *Database) SetTunnel(domain string, tun Tunnel) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+// SetDNSRequest, GetDNSRequest and DeleteDNSRequest implement
+// namedrop.ClientDatabase. namedrop.DNSRequest doesn't carry anything, so a
+// DomainRequest is stored in its place.
+func (d *Database) SetDNSRequest(requestId string, request namedrop.DNSRequest) {
+	now := time.Now().UTC()
+
+	err := d.Update(func(tx StoreTx) error {
+		return tx.SetDomainRequest(requestId, DomainRequest{
+			CreatedAt: now,
+			ExpiresAt: now.Add(domainRequestLifetime),
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to save domain request: %v", err)
+	}
+}
+func (d *Database) GetDNSRequest(requestId string) (namedrop.DNSRequest, error) {
+	req, exists := d.GetDomainRequest(requestId)
+	if !exists || req.Expired(time.Now()) {
+		return namedrop.DNSRequest{}, errors.New("No such DNS Request")
+	}
 
-	d.Tunnels[domain] = tun
-	d.persist()
+	return namedrop.DNSRequest{}, nil
+}
+func (d *Database) DeleteDNSRequest(requestId string) {
+	err := d.Update(func(tx StoreTx) error {
+		return tx.DeleteDomainRequest(requestId)
+	})
+	if err != nil {
+		log.Printf("Failed to delete domain request: %v", err)
+	}
 }
 
-func (d *Database) DeleteTunnel(domain string) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+func (d *Database) GetDomainRequests() map[string]DomainRequest {
+	var reqs map[string]DomainRequest
+	d.view(func(tx StoreTx) {
+		reqs = tx.GetDomainRequests()
+	})
+	return reqs
+}
+
+func (d *Database) GetDomainRequest(requestId string) (DomainRequest, bool) {
+	var req DomainRequest
+	var exists bool
+	d.view(func(tx StoreTx) {
+		req, exists = tx.GetDomainRequest(requestId)
+	})
+	return req, exists
+}
 
-	delete(d.Tunnels, domain)
+// SetDomainRequestOwner records which user made a domain request, once
+// namedrop has created it.
+func (d *Database) SetDomainRequestOwner(requestId, owner string) error {
+	return d.Update(func(tx StoreTx) error {
+		req, exists := tx.GetDomainRequest(requestId)
+		if !exists {
+			return errors.New("No such domain request")
+		}
 
-	d.persist()
+		req.Owner = owner
+
+		return tx.SetDomainRequest(requestId, req)
+	})
 }
 
-func (d *Database) GetUsers() map[string]User {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+// DeleteExpiredDomainRequests deletes the domain requests which have expired,
+// and returns how many there were. The database is only written if there's
+// something to delete.
+func (d *Database) DeleteExpiredDomainRequests() (int, error) {
+	now := time.Now()
+	deleted := 0
+
+	expired := []string{}
+	d.view(func(tx StoreTx) {
+		for requestId, req := range tx.GetDomainRequests() {
+			if req.Expired(now) {
+				expired = append(expired, requestId)
+			}
+		}
+	})
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	err := d.Update(func(tx StoreTx) error {
+		for _, requestId := range expired {
+			// Checked again, since it could have been deleted
+			// in the meantime
+			if _, exists := tx.GetDomainRequest(requestId); !exists {
+				continue
+			}
+
+			err := tx.DeleteDomainRequest(requestId)
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted, nil
+}
 
-	users := make(map[string]User)
+// AddToken creates a token for tokenData.Owner, and returns it. This is the
+// only time the token is available, since only its hash is stored.
+func (d *Database) AddToken(tokenData TokenData) (string, error) {
 
-	for k, v := range d.Users {
-		users[k] = v
+	token, id, err := generateToken()
+	if err != nil {
+		return "", errors.New("Could not generat token")
 	}
 
-	return users
+	tokenData.Hash = hashToken(token)
+	tokenData.CreatedAt = time.Now().UTC()
+
+	err = d.Update(func(tx StoreTx) error {
+		_, exists := tx.GetUser(tokenData.Owner)
+		if !exists {
+			return badRequest("Owner doesn't exist")
+		}
+
+		_, exists = tx.GetToken(id)
+		if exists {
+			return errors.New("Token id collision. Try again")
+		}
+
+		return tx.SetToken(id, tokenData)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
 }
 
-func (d *Database) GetUser(username string) (User, bool) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+// ValidateToken returns the data for token if it's valid and hasn't expired,
+// and records that it was used.
+func (d *Database) ValidateToken(token string) (TokenData, error) {
 
-	user, exists := d.Users[username]
+	id := tokenId(token)
 
+	tokenData, exists := d.GetTokenData(id)
 	if !exists {
-		return User{}, false
+		return TokenData{}, errInvalidToken
 	}
 
-	return user, true
+	now := time.Now().UTC()
+
+	err := checkToken(token, tokenData, now)
+	if err != nil {
+		return TokenData{}, err
+	}
+
+	if now.Sub(tokenData.LastUsedAt) > tokenLastUsedInterval {
+		err := d.Update(func(tx StoreTx) error {
+			tokenData, exists := tx.GetToken(id)
+			if !exists {
+				return nil
+			}
+
+			tokenData.LastUsedAt = now
+			return tx.SetToken(id, tokenData)
+		})
+		if err != nil {
+			log.Printf("Failed to update token last used time: %v", err)
+		}
+	}
+
+	return tokenData, nil
 }
 
-func (d *Database) SetUser(username string, user User) error {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+func (d *Database) GetTokens() map[string]TokenData {
+	var tokens map[string]TokenData
+	d.view(func(tx StoreTx) {
+		tokens = tx.GetTokens()
+	})
+	return tokens
+}
 
-	d.Users[username] = user
-	d.persist()
+func (d *Database) GetTokenData(id string) (TokenData, bool) {
+	var tokenData TokenData
+	var exists bool
+	d.view(func(tx StoreTx) {
+		tokenData, exists = tx.GetToken(id)
+	})
+	return tokenData, exists
+}
 
-	return nil
+func (d *Database) SetTokenData(id string, tokenData TokenData) error {
+	return d.Update(func(tx StoreTx) error {
+		return tx.SetToken(id, tokenData)
+	})
 }
 
-func (d *Database) AddUser(username string, isAdmin bool) error {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+func (d *Database) DeleteTokenData(id string) error {
+	return d.Update(func(tx StoreTx) error {
+		return tx.DeleteToken(id)
+	})
+}
+
+func (d *Database) GetTunnels() map[string]Tunnel {
+	var tunnels map[string]Tunnel
+	d.view(func(tx StoreTx) {
+		tunnels = tx.GetTunnels()
+	})
+	return tunnels
+}
+
+func (d *Database) GetTunnel(domain string) (Tunnel, bool) {
+	var tun Tunnel
+	var exists bool
+	d.view(func(tx StoreTx) {
+		tun, exists = tx.GetTunnel(domain)
+	})
+	return tun, exists
+}
+
+func (d *Database) SetTunnel(domain string, tun Tunnel) error {
+	return d.Update(func(tx StoreTx) error {
+		return tx.SetTunnel(domain, tun)
+	})
+}
 
-	_, exists := d.Users[username]
+func (d *Database) DeleteTunnel(domain string) error {
+	return d.Update(func(tx StoreTx) error {
+		return tx.DeleteTunnel(domain)
+	})
+}
+
+func (d *Database) GetUsers() map[string]User {
+	var users map[string]User
+	d.view(func(tx StoreTx) {
+		users = tx.GetUsers()
+	})
+	return users
+}
+
+func (d *Database) GetUser(username string) (User, bool) {
+	var user User
+	var exists bool
+	d.view(func(tx StoreTx) {
+		user, exists = tx.GetUser(username)
+	})
+	return user, exists
+}
+
+func (d *Database) SetUser(username string, user User) error {
+	return d.Update(func(tx StoreTx) error {
+		return tx.SetUser(username, user)
+	})
+}
+
+func (d *Database) AddUser(username, role string) error {
 
-	if exists {
-		return errors.New("User exists")
+	if !validRole(role) {
+		return badRequest("Invalid role %s", role)
 	}
 
-	d.Users[username] = User{
-		IsAdmin: isAdmin,
-		Clients: make(map[string]DbClient),
+	return d.Update(func(tx StoreTx) error {
+		_, exists := tx.GetUser(username)
+		if exists {
+			return conflict("User exists")
+		}
+
+		_, exists = tx.GetOrg(username)
+		if exists {
+			return conflict("Name is already used by an org")
+		}
+
+		return tx.SetUser(username, User{
+			Role:    role,
+			IsAdmin: role == RoleAdmin,
+			Clients: make(map[string]DbClient),
+		})
+	})
+}
+
+// SetUserRole changes a user's role. The last admin can't be given another
+// role, so there's always someone who can manage users.
+func (d *Database) SetUserRole(username, role string) error {
+
+	if !validRole(role) {
+		return badRequest("Invalid role %s", role)
 	}
 
-	d.persist()
+	return d.Update(func(tx StoreTx) error {
+		user, exists := tx.GetUser(username)
+		if !exists {
+			return notFound("User doesn't exist")
+		}
 
-	return nil
+		if role != RoleAdmin && isLastAdmin(tx, username) {
+			return conflict("Can't change the role of the last admin")
+		}
+
+		user.Role = role
+		user.IsAdmin = role == RoleAdmin
+
+		return tx.SetUser(username, user)
+	})
 }
 
-func (d *Database) DeleteUser(username string) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+// isLastAdmin reports whether username is the only admin. The last admin
+// can't be demoted or deleted, so there's always someone who can manage users.
+func isLastAdmin(tx StoreTx, username string) bool {
 
-	delete(d.Users, username)
+	user, _ := tx.GetUser(username)
+	if user.Role != RoleAdmin {
+		return false
+	}
+
+	for name, u := range tx.GetUsers() {
+		if name != username && u.Role == RoleAdmin {
+			return false
+		}
+	}
 
-	d.persist()
+	return true
 }
 
-func (d *Database) persist() {
-	saveJson(d, DBFolderPath+"boringproxy_db.json")
+// DeleteUser deletes a user along with their tokens, and removes them from
+// their orgs. Users who still own tunnels can't be deleted, since a user
+// created later with the same name would get them, and neither can the last
+// admin.
+func (d *Database) DeleteUser(username string) error {
+	return d.Update(func(tx StoreTx) error {
+		_, exists := tx.GetUser(username)
+		if !exists {
+			return notFound("User doesn't exist")
+		}
+
+		if isLastAdmin(tx, username) {
+			return conflict("Can't delete the last admin")
+		}
+
+		for domain, tun := range tx.GetTunnels() {
+			if tun.Owner == username {
+				return conflict("User still owns tunnel %s. Delete it first", domain)
+			}
+		}
+
+		err := leaveOrgs(tx, username)
+		if err != nil {
+			return err
+		}
+
+		err = tx.DeleteUser(username)
+		if err != nil {
+			return err
+		}
+
+		for token, tokenData := range tx.GetTokens() {
+			if tokenData.Owner == username {
+				err := tx.DeleteToken(token)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
 }
@@ -0,0 +1,221 @@
+package boringproxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var testBackends = []string{StoreBackendJson, StoreBackendBolt}
+
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	db, err := NewDatabase(t.TempDir()+"/", StoreBackendJson, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestDatabasePersists(t *testing.T) {
+
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+
+			dir := t.TempDir() + "/"
+
+			db, err := NewDatabase(dir, backend, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = db.AddUser("alice", RoleMember)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = db.SetTunnel("app.example.com", Tunnel{Domain: "app.example.com", Owner: "alice"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db.Close()
+
+			db, err = NewDatabase(dir, backend, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if _, exists := db.GetUser("alice"); !exists {
+				t.Error("User wasn't saved")
+			}
+
+			if tun, exists := db.GetTunnel("app.example.com"); !exists || tun.Owner != "alice" {
+				t.Errorf("Got tunnel %+v, %v", tun, exists)
+			}
+		})
+	}
+}
+
+func TestDatabaseUpdateRollsBack(t *testing.T) {
+
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+
+			db, err := NewDatabase(t.TempDir()+"/", backend, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			failed := errors.New("failed")
+
+			err = db.Update(func(tx StoreTx) error {
+				err := tx.SetUser("alice", User{Role: RoleMember})
+				if err != nil {
+					return err
+				}
+				return failed
+			})
+			if err != failed {
+				t.Fatalf("Got error %v, want %v", err, failed)
+			}
+
+			if _, exists := db.GetUser("alice"); exists {
+				t.Error("Failed update was saved")
+			}
+		})
+	}
+}
+
+func TestJsonStoreWritesAtomically(t *testing.T) {
+
+	dir := t.TempDir() + "/"
+
+	db, err := NewDatabase(dir, StoreBackendJson, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.AddUser("alice", RoleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(dir + "boringproxy_db.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Got permissions %v, want 0600", info.Mode().Perm())
+	}
+
+	tmpFiles, err := filepath.Glob(dir + "*.tmp*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tmpFiles) != 0 {
+		t.Errorf("Temporary files left behind: %v", tmpFiles)
+	}
+}
+
+func TestJsonStoreRefusesCorruptFile(t *testing.T) {
+
+	dir := t.TempDir() + "/"
+	path := dir + "boringproxy_db.json"
+
+	corrupt := []byte(`{"users": {"alice"`)
+
+	err := ioutil.WriteFile(path, corrupt, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDatabase(dir, StoreBackendJson, nil)
+	if err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("Got error %v, want one about the corrupt database", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != string(corrupt) {
+		t.Error("Corrupt database was overwritten")
+	}
+}
+
+func TestBackupsAreRotated(t *testing.T) {
+
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+
+			dir := t.TempDir() + "/"
+
+			fileName, err := storeFileName(backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ext := filepath.Ext(fileName)
+
+			// Older than any backup made now
+			old := []string{}
+			for _, timestamp := range []string{"20200101T000000Z", "20200102T000000Z", "20200103T000000Z", "20200104T000000Z", "20200105T000000Z"} {
+				path := dir + dbBackupPrefix + timestamp + ext
+				err := ioutil.WriteFile(path, nil, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+				old = append(old, path)
+			}
+
+			// Opening an existing database backs it up
+			db, err := NewDatabase(dir, backend, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+
+			db, err = NewDatabase(dir, backend, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+
+			backups, err := filepath.Glob(dir + dbBackupPrefix + "*" + ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(backups)
+
+			if len(backups) != maxDbBackups {
+				t.Fatalf("Got %d backups, want %d", len(backups), maxDbBackups)
+			}
+
+			if backups[0] != old[1] {
+				t.Errorf("Oldest backup is %s, want %s", backups[0], old[1])
+			}
+
+			newest, err := ioutil.ReadFile(backups[len(backups)-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(newest) == 0 {
+				t.Error("New backup is empty")
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package boringproxy
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Only one process can use a database directory at a time. The server keeps
+// the json backend in memory and overwrites the file on every change, so
+// changes made by 'boringproxy admin' while it's running would be lost.
+const dbLockFileName = "boringproxy_db.lock"
+
+// lockDatabaseDir takes the lock for the database in dbDir, and writes the
+// process id to the lock file so whoever is turned away knows what to stop.
+// The lock is released when the returned file is closed, or the process
+// exits.
+func lockDatabaseDir(dbDir string) (*os.File, error) {
+
+	path := dbDir + dbLockFileName
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open database lock file: %v", err)
+	}
+
+	err = lockFile(file)
+	if err != nil {
+		file.Close()
+
+		pid := "another process"
+		data, readErr := os.ReadFile(path)
+		if readErr == nil && len(strings.TrimSpace(string(data))) > 0 {
+			pid = "process " + strings.TrimSpace(string(data))
+		}
+
+		return nil, fmt.Errorf("Database in %s is in use by %s, ie a running server. Stop it first", dbDir, pid)
+	}
+
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Failed to write database lock file: %v", err)
+	}
+
+	return file, nil
+}
+
+// lockedStore releases the database directory lock when it's closed.
+type lockedStore struct {
+	Store
+	lock *os.File
+}
+
+func (s *lockedStore) Close() error {
+	err := s.Store.Close()
+	s.lock.Close()
+	return err
+}
+
+// openLockedStore locks dbDir, then opens the database stored there with
+// backend. The server and every db and admin command open the database through
+// here, so none of them can run while another is using it. The lock is held
+// until the store is closed.
+func openLockedStore(dbDir, backend string) (Store, error) {
+
+	fileName, err := storeFileName(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := lockDatabaseDir(dbDir)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := openStore(backend, dbDir+fileName)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return &lockedStore{store, lock}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package boringproxy
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
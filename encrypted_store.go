@@ -0,0 +1,484 @@
+package boringproxy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Environment variable the master key is read from if no key file is given
+const masterKeyEnvVar = "BORINGPROXY_MASTER_KEY"
+
+const masterKeySize = 32
+
+// Prefix of encrypted values. The version allows changing the scheme later.
+const encryptedPrefix = "enc:v1:"
+
+// Additional data for each kind of secret, so an encrypted value can't be
+// copied into a different field.
+const (
+	secretFieldToken      = "token"
+	secretFieldPrivateKey = "tunnel_private_key"
+	secretFieldPassword   = "auth_password"
+)
+
+// LoadMasterKey reads the base64 encoded master key from path, or from the
+// BORINGPROXY_MASTER_KEY environment variable if path is empty. It returns nil
+// if neither is set, in which case secrets are stored unencrypted.
+func LoadMasterKey(path string) ([]byte, error) {
+
+	var encoded string
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read master key: %v", err)
+		}
+		encoded = string(data)
+	} else {
+		encoded = os.Getenv(masterKeyEnvVar)
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Master key must be base64 encoded: %v", err)
+	}
+
+	if len(key) != masterKeySize {
+		return nil, fmt.Errorf("Master key must be %d bytes, got %d", masterKeySize, len(key))
+	}
+
+	return key, nil
+}
+
+// secretCipher encrypts secrets with AES-256-GCM, using keys derived from the
+// master key.
+type secretCipher struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+func newSecretCipher(masterKey []byte) (*secretCipher, error) {
+
+	kdf := hkdf.New(sha256.New, masterKey, nil, []byte("boringproxy secrets v1"))
+
+	encKey := make([]byte, 32)
+	macKey := make([]byte, 32)
+
+	_, err := io.ReadFull(kdf, encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.ReadFull(kdf, macKey)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &secretCipher{aead, macKey}, nil
+}
+
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// encrypt encrypts value with a random nonce. Empty values are left empty.
+func (c *secretCipher) encrypt(field, value string) (string, error) {
+
+	if value == "" {
+		return "", nil
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	return c.seal(nonce, field, value), nil
+}
+
+// encryptDeterministic always encrypts the same value to the same result, so
+// it can be used for map keys. The nonce is derived from the value, which
+// only reveals whether two values are equal.
+func (c *secretCipher) encryptDeterministic(field, value string) string {
+
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+
+	return c.seal(nonce, field, value)
+}
+
+func (c *secretCipher) seal(nonce []byte, field, value string) string {
+	sealed := c.aead.Seal(nonce, nonce, []byte(value), []byte(field))
+	return encryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed)
+}
+
+// decrypt returns value decrypted. Values which aren't encrypted are returned
+// as they are, so databases can be encrypted gradually.
+func (c *secretCipher) decrypt(field, value string) (string, error) {
+
+	if !isEncrypted(value) {
+		return value, nil
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errors.New("Encrypted value is too short")
+	}
+
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(field))
+	if err != nil {
+		return "", errors.New("Failed to decrypt value. Is the master key correct?")
+	}
+
+	return string(plaintext), nil
+}
+
+// encryptedStore wraps a Store, encrypting tunnel private keys, tunnel
+// passwords and tokens before they're stored and decrypting them on the way
+// out.
+type encryptedStore struct {
+	Store
+	cipher *secretCipher
+}
+
+type encryptedStoreTx struct {
+	StoreTx
+	cipher *secretCipher
+}
+
+func newEncryptedStore(store Store, masterKey []byte) (*encryptedStore, error) {
+	c, err := newSecretCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedStore{store, c}, nil
+}
+
+func (s *encryptedStore) View(fn func(tx StoreTx) error) error {
+	return s.Store.View(func(tx StoreTx) error {
+		return fn(&encryptedStoreTx{tx, s.cipher})
+	})
+}
+
+func (s *encryptedStore) Update(fn func(tx StoreTx) error) error {
+	return s.Store.Update(func(tx StoreTx) error {
+		return fn(&encryptedStoreTx{tx, s.cipher})
+	})
+}
+
+func (tx *encryptedStoreTx) GetTokens() map[string]TokenData {
+	tokens := make(map[string]TokenData)
+	for encToken, tokenData := range tx.StoreTx.GetTokens() {
+		token, err := tx.cipher.decrypt(secretFieldToken, encToken)
+		if err != nil {
+			log.Printf("Skipping token: %v", err)
+			continue
+		}
+		tokens[token] = tokenData
+	}
+	return tokens
+}
+
+func (tx *encryptedStoreTx) GetToken(token string) (TokenData, bool) {
+	return tx.StoreTx.GetToken(tx.cipher.encryptDeterministic(secretFieldToken, token))
+}
+
+func (tx *encryptedStoreTx) SetToken(token string, tokenData TokenData) error {
+	return tx.StoreTx.SetToken(tx.cipher.encryptDeterministic(secretFieldToken, token), tokenData)
+}
+
+func (tx *encryptedStoreTx) DeleteToken(token string) error {
+	return tx.StoreTx.DeleteToken(tx.cipher.encryptDeterministic(secretFieldToken, token))
+}
+
+func (tx *encryptedStoreTx) GetTunnels() map[string]Tunnel {
+	tunnels := tx.StoreTx.GetTunnels()
+	for domain, tun := range tunnels {
+		tunnels[domain] = tx.decryptTunnel(tun)
+	}
+	return tunnels
+}
+
+func (tx *encryptedStoreTx) GetTunnel(domain string) (Tunnel, bool) {
+	tun, exists := tx.StoreTx.GetTunnel(domain)
+	if !exists {
+		return Tunnel{}, false
+	}
+	return tx.decryptTunnel(tun), true
+}
+
+func (tx *encryptedStoreTx) SetTunnel(domain string, tun Tunnel) error {
+	tun, err := encryptTunnel(tx.cipher, tun)
+	if err != nil {
+		return err
+	}
+	return tx.StoreTx.SetTunnel(domain, tun)
+}
+
+func (tx *encryptedStoreTx) decryptTunnel(tun Tunnel) Tunnel {
+	tun, err := decryptTunnel(tx.cipher, tun)
+	if err != nil {
+		log.Printf("Tunnel %s: %v", tun.Domain, err)
+	}
+	return tun
+}
+
+func encryptTunnel(c *secretCipher, tun Tunnel) (Tunnel, error) {
+	var err error
+
+	tun.TunnelPrivateKey, err = c.encrypt(secretFieldPrivateKey, tun.TunnelPrivateKey)
+	if err != nil {
+		return tun, err
+	}
+
+	tun.AuthPassword, err = c.encrypt(secretFieldPassword, tun.AuthPassword)
+	if err != nil {
+		return tun, err
+	}
+
+	return tun, nil
+}
+
+// decryptTunnel decrypts the secrets in tun. Secrets which fail to decrypt are
+// cleared, so ciphertext is never used as a key or password.
+func decryptTunnel(c *secretCipher, tun Tunnel) (Tunnel, error) {
+	privateKey, keyErr := c.decrypt(secretFieldPrivateKey, tun.TunnelPrivateKey)
+	password, passwordErr := c.decrypt(secretFieldPassword, tun.AuthPassword)
+
+	tun.TunnelPrivateKey = privateKey
+	tun.AuthPassword = password
+
+	if keyErr != nil {
+		return tun, keyErr
+	}
+
+	return tun, passwordErr
+}
+
+// hasEncryptedSecrets reports whether anything in tx (which must be a raw,
+// unwrapped transaction) is encrypted.
+func hasEncryptedSecrets(tx StoreTx) bool {
+
+	for token := range tx.GetTokens() {
+		if isEncrypted(token) {
+			return true
+		}
+	}
+
+	for _, tun := range tx.GetTunnels() {
+		if tunnelHasEncryptedSecrets(tun) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func tunnelHasEncryptedSecrets(tun Tunnel) bool {
+	return isEncrypted(tun.TunnelPrivateKey) || isEncrypted(tun.AuthPassword)
+}
+
+// tunnelSecretsEncrypted reports whether none of the secrets in tun are
+// plaintext.
+func tunnelSecretsEncrypted(tun Tunnel) bool {
+	return (tun.TunnelPrivateKey == "" || isEncrypted(tun.TunnelPrivateKey)) &&
+		(tun.AuthPassword == "" || isEncrypted(tun.AuthPassword))
+}
+
+// rekeySecrets re-encrypts every secret in tx (which must be a raw, unwrapped
+// transaction) from oldCipher to newCipher. Either may be nil, meaning
+// unencrypted. Passing the same cipher for both encrypts any plaintext left in
+// the database. It returns the number of tokens and tunnels changed.
+func rekeySecrets(tx StoreTx, oldCipher, newCipher *secretCipher) (int, error) {
+
+	changed := 0
+
+	for storedToken, tokenData := range tx.GetTokens() {
+
+		token := storedToken
+		if isEncrypted(storedToken) {
+			if oldCipher == nil {
+				return 0, errors.New("Database is encrypted, but no master key was provided")
+			}
+
+			var err error
+			token, err = oldCipher.decrypt(secretFieldToken, storedToken)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		newToken := token
+		if newCipher != nil {
+			newToken = newCipher.encryptDeterministic(secretFieldToken, token)
+		}
+
+		if newToken == storedToken {
+			continue
+		}
+
+		err := tx.DeleteToken(storedToken)
+		if err != nil {
+			return 0, err
+		}
+
+		err = tx.SetToken(newToken, tokenData)
+		if err != nil {
+			return 0, err
+		}
+
+		changed++
+	}
+
+	for domain, storedTun := range tx.GetTunnels() {
+
+		// Nothing to do if the secrets are already the way they should
+		// end up. Tunnels only need checking for leftover plaintext when
+		// the key isn't changing.
+		if newCipher == nil && !tunnelHasEncryptedSecrets(storedTun) {
+			continue
+		}
+		if newCipher != nil && newCipher == oldCipher && tunnelSecretsEncrypted(storedTun) {
+			continue
+		}
+
+		tun := storedTun
+		if tunnelHasEncryptedSecrets(storedTun) {
+			if oldCipher == nil {
+				return 0, errors.New("Database is encrypted, but no master key was provided")
+			}
+
+			var err error
+			tun, err = decryptTunnel(oldCipher, storedTun)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if newCipher != nil {
+			var err error
+			tun, err = encryptTunnel(newCipher, tun)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		err := tx.SetTunnel(domain, tun)
+		if err != nil {
+			return 0, err
+		}
+
+		changed++
+	}
+
+	return changed, nil
+}
+
+// RekeyDatabase re-encrypts the secrets in the database in dbDir, which are
+// currently encrypted with oldKey, with newKey. A nil oldKey encrypts a
+// plaintext database, and a nil newKey decrypts it. The database is backed up
+// first. It returns the number of tokens and tunnels changed.
+func RekeyDatabase(dbDir, backend string, oldKey, newKey []byte) (int, error) {
+
+	if oldKey == nil && newKey == nil {
+		return 0, errors.New("Need an old key, a new key or both")
+	}
+
+	if bytes.Equal(oldKey, newKey) {
+		return 0, errors.New("Old and new keys are the same")
+	}
+
+	DBFolderPath = dbDir
+
+	fileName, err := storeFileName(backend)
+	if err != nil {
+		return 0, err
+	}
+
+	dbPath := dbDir + fileName
+
+	_, err = os.Stat(dbPath)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to open database: %v", err)
+	}
+
+	// Locked, since the server would overwrite the rekeyed secrets with ones
+	// encrypted with the old key.
+	store, err := openLockedStore(dbDir, backend)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+
+	var oldCipher, newCipher *secretCipher
+
+	if oldKey != nil {
+		oldCipher, err = newSecretCipher(oldKey)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if newKey != nil {
+		newCipher, err = newSecretCipher(newKey)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = backupStore(store, fileName)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to back up database: %v", err)
+	}
+
+	changed := 0
+	err = store.Update(func(tx StoreTx) error {
+		var err error
+		changed, err = rekeySecrets(tx, oldCipher, newCipher)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return changed, nil
+}
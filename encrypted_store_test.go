@@ -0,0 +1,225 @@
+package boringproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func testMasterKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, masterKeySize)
+}
+
+// readStoreFile returns the raw database file, to check what's stored on disk
+func readStoreFile(t *testing.T, dir, backend string) []byte {
+	t.Helper()
+
+	fileName, err := storeFileName(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(dir + fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestEncryptRekeyRoundTrip(t *testing.T) {
+
+	const privKey = "test-private-key"
+	const password = "test-password"
+
+	keyA := testMasterKey(1)
+	keyB := testMasterKey(2)
+
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+
+			dir := t.TempDir() + "/"
+
+			db, err := NewDatabase(dir, backend, keyA)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = db.AddUser("alice", RoleMember)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = db.SetTunnel("app.example.com", Tunnel{
+				Domain:           "app.example.com",
+				Owner:            "alice",
+				TunnelPrivateKey: privKey,
+				AuthPassword:     password,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := db.AddToken(TokenData{Owner: "alice"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db.Close()
+
+			data := readStoreFile(t, dir, backend)
+			for _, secret := range []string{privKey, password, tokenId(token)} {
+				if bytes.Contains(data, []byte(secret)) {
+					t.Errorf("%q is stored in plaintext", secret)
+				}
+			}
+
+			// Checks the database opens with key and has the original secrets
+			checkOpens := func(key []byte) {
+				t.Helper()
+
+				db, err := NewDatabase(dir, backend, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer db.Close()
+
+				tun, _ := db.GetTunnel("app.example.com")
+				if tun.TunnelPrivateKey != privKey || tun.AuthPassword != password {
+					t.Errorf("Got secrets %q and %q back", tun.TunnelPrivateKey, tun.AuthPassword)
+				}
+
+				tokenData, err := db.ValidateToken(token)
+				if err != nil || tokenData.Owner != "alice" {
+					t.Errorf("Token didn't validate: %+v, %v", tokenData, err)
+				}
+			}
+
+			checkOpens(keyA)
+
+			tests := []struct {
+				name    string
+				oldKey  []byte
+				newKey  []byte
+				goodKey []byte
+				badKey  []byte
+			}{
+				{"rekey", keyA, keyB, keyB, keyA},
+				// Opening a plaintext database with a key encrypts it, so
+				// any key works after decrypting
+				{"decrypt", keyB, nil, nil, nil},
+				{"encrypt", nil, keyA, keyA, nil},
+			}
+
+			for _, test := range tests {
+
+				changed, err := RekeyDatabase(dir, backend, test.oldKey, test.newKey)
+				if err != nil {
+					t.Fatalf("%s: %v", test.name, err)
+				}
+
+				// A token and a tunnel
+				if changed != 2 {
+					t.Errorf("%s: changed %d, want 2", test.name, changed)
+				}
+
+				if test.newKey != nil {
+					_, err = NewDatabase(dir, backend, test.badKey)
+					if err == nil {
+						t.Errorf("%s: opened with the old key", test.name)
+					}
+				}
+
+				checkOpens(test.goodKey)
+
+				plaintext := bytes.Contains(readStoreFile(t, dir, backend), []byte(privKey))
+				if plaintext != (test.newKey == nil) {
+					t.Errorf("%s: private key stored in plaintext %v", test.name, plaintext)
+				}
+			}
+		})
+	}
+}
+
+func TestRekeyDatabaseRefusesWrongKey(t *testing.T) {
+
+	dir := t.TempDir() + "/"
+
+	db, err := NewDatabase(dir, StoreBackendJson, testMasterKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddUser("alice", RoleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AddToken(TokenData{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	before := readStoreFile(t, dir, StoreBackendJson)
+
+	tests := []struct {
+		name   string
+		oldKey []byte
+		newKey []byte
+	}{
+		{"wrong old key", testMasterKey(3), testMasterKey(2)},
+		{"no old key", nil, testMasterKey(2)},
+		{"same key", testMasterKey(1), testMasterKey(1)},
+		{"no keys", nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := RekeyDatabase(dir, StoreBackendJson, test.oldKey, test.newKey)
+			if err == nil {
+				t.Error("Rekey succeeded")
+			}
+
+			if !bytes.Equal(readStoreFile(t, dir, StoreBackendJson), before) {
+				t.Error("Failed rekey changed the database")
+			}
+		})
+	}
+}
+
+func TestLoadMasterKey(t *testing.T) {
+
+	dir := t.TempDir() + "/"
+
+	tests := []struct {
+		name    string
+		content string
+		ok      bool
+	}{
+		{"valid", "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=\n", true},
+		{"not base64", "not a key", false},
+		{"too short", "AQEBAQ==", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := dir + test.name
+
+			err := ioutil.WriteFile(path, []byte(test.content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key, err := LoadMasterKey(path)
+			if (err == nil) != test.ok {
+				t.Fatalf("Got error %v, want success %v", err, test.ok)
+			}
+
+			if test.ok && !bytes.Equal(key, testMasterKey(1)) {
+				t.Errorf("Got key %v", key)
+			}
+		})
+	}
+}
@@ -5,10 +5,48 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-func proxyRequest(w http.ResponseWriter, r *http.Request, tunnel Tunnel, httpClient *http.Client, address string, port int, behindProxy bool) {
+// HttpProxy forwards HTTP requests to tunnel upstreams. All requests share a
+// single transport, which keeps a pool of idle connections for each upstream
+// address, and copy buffers are reused across requests.
+type HttpProxy struct {
+	transport  *http.Transport
+	bufferPool httputil.BufferPool
+}
+
+func NewHttpProxy() *HttpProxy {
+
+	transport := &http.Transport{
+		// Upstreams are always reached directly, never through the
+		// system HTTP proxy.
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          1024,
+		MaxIdleConnsPerHost:   64,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &HttpProxy{
+		transport:  transport,
+		bufferPool: newBufferPool(32 * 1024),
+	}
+}
+
+// ProxyRequest forwards a request for tunnel to the upstream at address:port.
+// Hop-by-hop headers are removed, protocol upgrades (ie WebSockets) and
+// trailers are passed through, and streaming responses are flushed as they
+// arrive.
+func (p *HttpProxy) ProxyRequest(w http.ResponseWriter, r *http.Request, tunnel Tunnel, address string, port int, behindProxy bool) {
 
 	if tunnel.AuthUsername != "" || tunnel.AuthPassword != "" {
 		username, password, ok := r.BasicAuth()
@@ -27,102 +65,113 @@ func proxyRequest(w http.ResponseWriter, r *http.Request, tunnel Tunnel, httpCli
 		}
 	}
 
-	downstreamReqHeaders := r.Header.Clone()
-
-	upstreamAddr := fmt.Sprintf("%s:%d", address, port)
-	upstreamUrl := fmt.Sprintf("http://%s%s", upstreamAddr, r.URL.RequestURI())
-
-	upstreamReq, err := http.NewRequest(r.Method, upstreamUrl, r.Body)
+	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		errMessage := fmt.Sprintf("%s", err)
 		w.WriteHeader(500)
-		io.WriteString(w, errMessage)
+		io.WriteString(w, err.Error())
 		return
 	}
 
-	// ContentLength needs to be set manually because otherwise it is
-	// stripped by golang. See:
-	// https://golang.org/pkg/net/http/#Request.Write
-	upstreamReq.ContentLength = r.ContentLength
+	upstreamAddr := net.JoinHostPort(address, strconv.Itoa(port))
+
+	reverseProxy := &httputil.ReverseProxy{
+		Director: func(upstreamReq *http.Request) {
+			upstreamReq.URL.Scheme = "http"
+			upstreamReq.URL.Host = upstreamAddr
+
+			// TODO: This might need to be more generic, but using
+			// r.Host. However, I think that may have security
+			// implications for things like DNS rebinding attacks.
+			// Not sure.
+			upstreamReq.Host = tunnel.Domain
+
+			setForwardedHeaders(upstreamReq, r, remoteHost, behindProxy)
+		},
+		Transport:  p.transport,
+		BufferPool: p.bufferPool,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			w.WriteHeader(502)
+			io.WriteString(w, err.Error())
+		},
+	}
+
+	// Responses with an unknown length and Server-Sent Events are always
+	// flushed immediately. This extends it to every response.
+	if tunnel.DisableBuffering {
+		reverseProxy.FlushInterval = -1
+	}
+
+	reverseProxy.ServeHTTP(w, r)
+}
 
-	upstreamReq.Header = downstreamReqHeaders
+// setForwardedHeaders fills in the Forwarded and X-Forwarded-* headers.
+// Headers sent by the client are only trusted (and extended) when we're
+// running behind another reverse proxy, otherwise clients could spoof them.
+func setForwardedHeaders(upstreamReq, downstreamReq *http.Request, remoteHost string, behindProxy bool) {
 
 	scheme := "https"
-	if r.TLS == nil {
+	if downstreamReq.TLS == nil {
 		scheme = "http"
 	}
-	upstreamReq.Header["X-Forwarded-Proto"] = []string{scheme}
 
-	upstreamReq.Header["X-Forwarded-Host"] = []string{r.Host}
+	header := upstreamReq.Header
 
-	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		errMessage := fmt.Sprintf("%s", err)
-		w.WriteHeader(500)
-		io.WriteString(w, errMessage)
-		return
+	if !behindProxy {
+		header.Del("Forwarded")
+		header.Del("X-Forwarded-For")
+		header.Del("X-Forwarded-Host")
+		header.Del("X-Forwarded-Proto")
 	}
 
-	xForwardedFor := remoteHost
+	// httputil.ReverseProxy appends remoteHost to any existing
+	// X-Forwarded-For chain.
 
-	if behindProxy {
-		xForwardedFor := downstreamReqHeaders.Get("X-Forwarded-For")
-		if xForwardedFor != "" {
-			xForwardedFor = xForwardedFor + ", " + remoteHost
-		}
+	if header.Get("X-Forwarded-Proto") == "" {
+		header.Set("X-Forwarded-Proto", scheme)
 	}
 
-	upstreamReq.Header.Set("X-Forwarded-For", xForwardedFor)
-	upstreamReq.Header.Set("Forwarded", fmt.Sprintf("for=%s", remoteHost))
-
-	// TODO: This might need to be more generic, but using r.Host. However,
-	// I think that may have security implications for things like DNS
-	// rebinding attacks. Not sure.
-	upstreamReq.Host = tunnel.Domain
-
-	upstreamRes, err := httpClient.Do(upstreamReq)
-	if err != nil {
-		errMessage := fmt.Sprintf("%s", err)
-		w.WriteHeader(502)
-		io.WriteString(w, errMessage)
-		return
+	if header.Get("X-Forwarded-Host") == "" {
+		header.Set("X-Forwarded-Host", downstreamReq.Host)
 	}
-	defer upstreamRes.Body.Close()
 
-	var forwardHeaders map[string][]string
+	forwarded := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(remoteHost), quoteForwarded(downstreamReq.Host), scheme)
 
-	if r.ProtoMajor > 1 {
-		forwardHeaders = stripConnectionHeaders(upstreamRes.Header)
-	} else {
-		forwardHeaders = upstreamRes.Header
+	prior := strings.Join(header.Values("Forwarded"), ", ")
+	if prior != "" {
+		forwarded = prior + ", " + forwarded
 	}
 
-	downstreamResHeaders := w.Header()
+	header.Set("Forwarded", forwarded)
+}
 
-	for k, v := range forwardHeaders {
-		downstreamResHeaders[k] = v
+// See https://datatracker.ietf.org/doc/html/rfc7239#section-6
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf(`"[%s]"`, ip)
 	}
-
-	w.WriteHeader(upstreamRes.StatusCode)
-	io.Copy(w, upstreamRes.Body)
+	return ip
 }
 
-// Need to strip out headers that shouldn't be forwarded from HTTP/1.1 to
-// HTTP/2. See https://tools.ietf.org/html/rfc7540#section-8.1.2.2
-var connectionHeaders = []string{
-	"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade",
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]") {
+		return strconv.Quote(value)
+	}
+	return value
 }
 
-func stripConnectionHeaders(headers map[string][]string) map[string][]string {
-	forwardHeaders := make(map[string][]string)
-
-	for k, v := range headers {
-		if stringInArray(k, connectionHeaders) {
-			continue
-		}
+type bufferPool struct {
+	pool *sync.Pool
+}
 
-		forwardHeaders[k] = v
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		pool: &sync.Pool{
+			New: func() interface{} {
+				return make([]byte, size)
+			},
+		},
 	}
-
-	return forwardHeaders
 }
+
+func (b *bufferPool) Get() []byte    { return b.pool.Get().([]byte) }
+func (b *bufferPool) Put(buf []byte) { b.pool.Put(buf) }
@@ -0,0 +1,114 @@
+package boringproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+const benchmarkBodySize = 64 * 1024
+
+func newBenchmarkUpstream(b *testing.B) (string, int) {
+	b.Helper()
+
+	body := bytes.Repeat([]byte("x"), benchmarkBodySize)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	}))
+	b.Cleanup(upstream.Close)
+
+	host, portStr, err := net.SplitHostPort(upstream.Listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return host, port
+}
+
+// discardResponseWriter counts what's written instead of keeping it, so the
+// benchmarks only measure the proxy.
+type discardResponseWriter struct {
+	header http.Header
+	code   int
+	n      int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = 200
+	}
+	w.n += len(p)
+	return len(p), nil
+}
+
+func benchmarkProxy(b *testing.B, handler http.HandlerFunc) {
+
+	serve := func(b *testing.B) {
+		req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		w := &discardResponseWriter{header: make(http.Header)}
+
+		handler(w, req)
+
+		if w.code != 200 || w.n != benchmarkBodySize {
+			// Not Fatalf, since it can't be used from RunParallel
+			b.Errorf("Got status %d with %d bytes", w.code, w.n)
+		}
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(benchmarkBodySize)
+
+		for i := 0; i < b.N; i++ {
+			serve(b)
+		}
+	})
+
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(benchmarkBodySize)
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				serve(b)
+			}
+		})
+	})
+}
+
+// BenchmarkProxyRequest measures forwarding a response through HttpProxy.
+// Run it with
+//
+//	go test -run '^$' -bench Proxy -benchmem -cpu 1,8
+func BenchmarkProxyRequest(b *testing.B) {
+
+	address, port := newBenchmarkUpstream(b)
+	tunnel := Tunnel{Domain: "app.example.com"}
+
+	httpProxy := NewHttpProxy()
+	defer httpProxy.transport.CloseIdleConnections()
+
+	benchmarkProxy(b, func(w http.ResponseWriter, r *http.Request) {
+		httpProxy.ProxyRequest(w, r, tunnel, address, port, false)
+	})
+}
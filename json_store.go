@@ -0,0 +1,375 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// jsonStore keeps everything in memory and saves the whole database to a
+// single JSON file after every update. Simple, and easy to inspect or edit by
+// hand, but slow with a lot of data.
+type jsonStore struct {
+	path  string
+	mutex *sync.RWMutex
+	data  *jsonStoreData
+}
+
+// jsonStoreData is the layout of boringproxy_db.json
+type jsonStoreData struct {
+	SchemaVersion  int                      `json:"schema_version"`
+	AdminDomain    string                   `json:"admin_domain"`
+	Tokens         map[string]TokenData     `json:"tokens"`
+	Tunnels        map[string]Tunnel        `json:"tunnels"`
+	Users          map[string]User          `json:"users"`
+	Orgs           map[string]Org           `json:"orgs"`
+	DomainRequests map[string]DomainRequest `json:"domain_requests"`
+}
+
+type jsonStoreTx struct {
+	data     *jsonStoreData
+	writable bool
+}
+
+func openJsonStore(path string) (*jsonStore, error) {
+
+	var data *jsonStoreData
+
+	exists := false
+
+	dbJson, err := ioutil.ReadFile(path)
+	if err == nil {
+		exists = true
+
+		// Older versions created the file world readable
+		err = os.Chmod(path, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set permissions on database %s: %v", path, err)
+		}
+
+		// Never start over an existing database we can't read, since the
+		// first write would wipe out everything in it.
+		err = json.Unmarshal(dbJson, &data)
+		if err != nil {
+			return nil, fmt.Errorf("Database %s is corrupt: %v. Restore it from one of the backups or move it out of the way to start with an empty database", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to read database %s: %v", path, err)
+	}
+
+	if data == nil {
+		data = &jsonStoreData{}
+	}
+
+	if data.Tokens == nil {
+		data.Tokens = make(map[string]TokenData)
+	}
+
+	if data.Tunnels == nil {
+		data.Tunnels = make(map[string]Tunnel)
+	}
+
+	if data.Users == nil {
+		data.Users = make(map[string]User)
+	}
+
+	if data.Orgs == nil {
+		data.Orgs = make(map[string]Org)
+	}
+
+	if data.DomainRequests == nil {
+		data.DomainRequests = make(map[string]DomainRequest)
+	}
+
+	s := &jsonStore{
+		path:  path,
+		mutex: &sync.RWMutex{},
+		data:  data,
+	}
+
+	// Create the file right away, so problems with the directory show up
+	// at startup.
+	if !exists {
+		err = saveJson(data, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *jsonStore) View(fn func(tx StoreTx) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return fn(&jsonStoreTx{data: s.data, writable: false})
+}
+
+// Update runs fn against a copy of the data, which replaces the current data
+// once it's been saved. Copying the maps is no more expensive than encoding
+// them, which has to happen anyway.
+func (s *jsonStore) Update(fn func(tx StoreTx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data := s.data.copy()
+
+	err := fn(&jsonStoreTx{data: data, writable: true})
+	if err != nil {
+		return err
+	}
+
+	err = saveJson(data, s.path)
+	if err != nil {
+		return err
+	}
+
+	s.data = data
+
+	return nil
+}
+
+func (s *jsonStore) Backup(w io.Writer) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	dbJson, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(dbJson)
+	return err
+}
+
+func (s *jsonStore) Close() error {
+	return nil
+}
+
+func (d *jsonStoreData) copy() *jsonStoreData {
+
+	c := &jsonStoreData{
+		SchemaVersion:  d.SchemaVersion,
+		AdminDomain:    d.AdminDomain,
+		Tokens:         make(map[string]TokenData, len(d.Tokens)),
+		Tunnels:        make(map[string]Tunnel, len(d.Tunnels)),
+		Users:          make(map[string]User, len(d.Users)),
+		Orgs:           make(map[string]Org, len(d.Orgs)),
+		DomainRequests: make(map[string]DomainRequest, len(d.DomainRequests)),
+	}
+
+	for k, v := range d.Tokens {
+		c.Tokens[k] = v
+	}
+
+	for k, v := range d.Tunnels {
+		c.Tunnels[k] = v
+	}
+
+	// Users are copied when they're modified, so sharing them here is fine
+	for k, v := range d.Users {
+		c.Users[k] = v
+	}
+
+	// Same for orgs
+	for k, v := range d.Orgs {
+		c.Orgs[k] = v
+	}
+
+	for k, v := range d.DomainRequests {
+		c.DomainRequests[k] = v
+	}
+
+	return c
+}
+
+func (tx *jsonStoreTx) GetSchemaVersion() int {
+	return tx.data.SchemaVersion
+}
+
+func (tx *jsonStoreTx) SetSchemaVersion(version int) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	tx.data.SchemaVersion = version
+	return nil
+}
+
+func (tx *jsonStoreTx) GetAdminDomain() string {
+	return tx.data.AdminDomain
+}
+
+func (tx *jsonStoreTx) SetAdminDomain(adminDomain string) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	tx.data.AdminDomain = adminDomain
+	return nil
+}
+
+func (tx *jsonStoreTx) GetTokens() map[string]TokenData {
+	tokens := make(map[string]TokenData)
+	for k, v := range tx.data.Tokens {
+		tokens[k] = v
+	}
+	return tokens
+}
+
+func (tx *jsonStoreTx) GetToken(token string) (TokenData, bool) {
+	tokenData, exists := tx.data.Tokens[token]
+	return tokenData, exists
+}
+
+func (tx *jsonStoreTx) SetToken(token string, tokenData TokenData) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	tx.data.Tokens[token] = tokenData
+	return nil
+}
+
+func (tx *jsonStoreTx) DeleteToken(token string) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	delete(tx.data.Tokens, token)
+	return nil
+}
+
+func (tx *jsonStoreTx) GetTunnels() map[string]Tunnel {
+	tunnels := make(map[string]Tunnel)
+	for k, v := range tx.data.Tunnels {
+		tunnels[k] = v
+	}
+	return tunnels
+}
+
+func (tx *jsonStoreTx) GetTunnel(domain string) (Tunnel, bool) {
+	tun, exists := tx.data.Tunnels[domain]
+	return tun, exists
+}
+
+func (tx *jsonStoreTx) SetTunnel(domain string, tun Tunnel) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	tx.data.Tunnels[domain] = tun
+	return nil
+}
+
+func (tx *jsonStoreTx) DeleteTunnel(domain string) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	delete(tx.data.Tunnels, domain)
+	return nil
+}
+
+func (tx *jsonStoreTx) GetUsers() map[string]User {
+	users := make(map[string]User)
+	for k, v := range tx.data.Users {
+		users[k] = copyUser(v)
+	}
+	return users
+}
+
+func (tx *jsonStoreTx) GetUser(username string) (User, bool) {
+	user, exists := tx.data.Users[username]
+	if !exists {
+		return User{}, false
+	}
+	return copyUser(user), true
+}
+
+func (tx *jsonStoreTx) SetUser(username string, user User) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	tx.data.Users[username] = copyUser(user)
+	return nil
+}
+
+func (tx *jsonStoreTx) DeleteUser(username string) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	delete(tx.data.Users, username)
+	return nil
+}
+
+func (tx *jsonStoreTx) GetOrgs() map[string]Org {
+	orgs := make(map[string]Org)
+	for k, v := range tx.data.Orgs {
+		orgs[k] = copyOrg(v)
+	}
+	return orgs
+}
+
+func (tx *jsonStoreTx) GetOrg(name string) (Org, bool) {
+	org, exists := tx.data.Orgs[name]
+	if !exists {
+		return Org{}, false
+	}
+	return copyOrg(org), true
+}
+
+func (tx *jsonStoreTx) SetOrg(name string, org Org) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	tx.data.Orgs[name] = copyOrg(org)
+	return nil
+}
+
+func (tx *jsonStoreTx) DeleteOrg(name string) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	delete(tx.data.Orgs, name)
+	return nil
+}
+
+func (tx *jsonStoreTx) GetDomainRequests() map[string]DomainRequest {
+	reqs := make(map[string]DomainRequest)
+	for k, v := range tx.data.DomainRequests {
+		reqs[k] = v
+	}
+	return reqs
+}
+
+func (tx *jsonStoreTx) GetDomainRequest(requestId string) (DomainRequest, bool) {
+	req, exists := tx.data.DomainRequests[requestId]
+	return req, exists
+}
+
+func (tx *jsonStoreTx) SetDomainRequest(requestId string, req DomainRequest) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	tx.data.DomainRequests[requestId] = req
+	return nil
+}
+
+func (tx *jsonStoreTx) DeleteDomainRequest(requestId string) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	delete(tx.data.DomainRequests, requestId)
+	return nil
+}
@@ -0,0 +1,184 @@
+package boringproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// migration upgrades the database from one schema version to the next.
+type migration struct {
+	description string
+	migrate     func(tx StoreTx) error
+}
+
+// migrations holds every schema change, in order. Migration i upgrades a
+// database from version i to version i+1, so the current schema version is
+// len(migrations). Only ever append to this list.
+var migrations = []migration{
+	{
+		description: "Fill in fields added to users and tunnels before the schema was versioned",
+		migrate:     migrateUnversionedFields,
+	},
+	{
+		description: "Store tokens hashed, under an id",
+		migrate:     migrateHashTokens,
+	},
+	{
+		description: "Give users a role, based on whether they're an admin",
+		migrate:     migrateUserRoles,
+	},
+}
+
+var currentSchemaVersion = len(migrations)
+
+// Returned from the transaction in a dry run, so nothing is saved.
+var errMigrationDryRun = errors.New("Dry run")
+
+// MigrateDatabase upgrades the database in dbDir to the current schema
+// version, after taking a backup. With dryRun, the migrations are run but not
+// saved. It returns the descriptions of the migrations which were (or would
+// be) applied. masterKey is needed if the database secrets are encrypted.
+func MigrateDatabase(dbDir, backend string, masterKey []byte, dryRun bool) ([]string, error) {
+
+	db, existed, err := openDatabase(dbDir, backend, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if !existed {
+		return nil, fmt.Errorf("No database found in %s", dbDir)
+	}
+
+	if !dryRun {
+		err = db.encryptSecrets()
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.backup()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to back up database: %v", err)
+		}
+	}
+
+	return db.migrate(dryRun)
+}
+
+// migrate runs all pending migrations in a single transaction, so a failure
+// leaves the database at its original version.
+func (d *Database) migrate(dryRun bool) ([]string, error) {
+
+	applied := []string{}
+
+	err := d.Update(func(tx StoreTx) error {
+
+		version := tx.GetSchemaVersion()
+
+		if version > currentSchemaVersion {
+			return fmt.Errorf("Database schema version %d is newer than this version of boringproxy supports (%d). Upgrade boringproxy or restore a backup", version, currentSchemaVersion)
+		}
+
+		for ; version < currentSchemaVersion; version++ {
+			m := migrations[version]
+
+			err := m.migrate(tx)
+			if err != nil {
+				return fmt.Errorf("Migration to schema version %d failed: %v", version+1, err)
+			}
+
+			applied = append(applied, fmt.Sprintf("%d: %s", version+1, m.description))
+		}
+
+		if dryRun {
+			return errMigrationDryRun
+		}
+
+		if len(applied) == 0 {
+			return nil
+		}
+
+		return tx.SetSchemaVersion(version)
+	})
+	if err != nil && err != errMigrationDryRun {
+		return nil, err
+	}
+
+	if !dryRun {
+		for _, desc := range applied {
+			log.Printf("Applied database migration %s", desc)
+		}
+	}
+
+	return applied, nil
+}
+
+func migrateUnversionedFields(tx StoreTx) error {
+
+	// Users created before clients were tracked don't have the map.
+	// GetUser fills it in.
+	for username, user := range tx.GetUsers() {
+		err := tx.SetUser(username, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	for domain, tun := range tx.GetTunnels() {
+		if tun.ClientAddress == "" {
+			tun.ClientAddress = "127.0.0.1"
+
+			err := tx.SetTunnel(domain, tun)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateHashTokens replaces tokens stored in plaintext with their hash. They
+// have no id, so they're stored under one derived from the token, which
+// tokenId finds them by.
+func migrateHashTokens(tx StoreTx) error {
+
+	for token, tokenData := range tx.GetTokens() {
+		if tokenData.Hash != "" {
+			continue
+		}
+
+		err := tx.DeleteToken(token)
+		if err != nil {
+			return err
+		}
+
+		tokenData.Hash = hashToken(token)
+
+		err = tx.SetToken(tokenId(token), tokenData)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrateUserRoles(tx StoreTx) error {
+
+	for username, user := range tx.GetUsers() {
+		if user.IsAdmin {
+			user.Role = RoleAdmin
+		} else {
+			user.Role = RoleMember
+		}
+
+		err := tx.SetUser(username, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
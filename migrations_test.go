@@ -0,0 +1,159 @@
+package boringproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// A database written by boringproxy before the schema was versioned
+const unversionedJsonDb = `{
+	"admin_domain": "bp.example.com",
+	"tokens": {
+		"admin-token": {"owner": "admin"},
+		"client-token": {"owner": "alice", "client": "laptop"}
+	},
+	"tunnels": {
+		"app.example.com": {"domain": "app.example.com", "owner": "alice", "tunnel_port": 9001}
+	},
+	"users": {
+		"admin": {"is_admin": true},
+		"alice": {"is_admin": false, "clients": {"laptop": {}}}
+	}
+}`
+
+func writeUnversionedDb(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir() + "/"
+
+	err := ioutil.WriteFile(dir+"boringproxy_db.json", []byte(unversionedJsonDb), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestMigrateUnversionedDatabase(t *testing.T) {
+
+	dir := writeUnversionedDb(t)
+
+	db, err := NewDatabase(dir, StoreBackendJson, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var version int
+	db.view(func(tx StoreTx) {
+		version = tx.GetSchemaVersion()
+	})
+
+	if version != currentSchemaVersion {
+		t.Errorf("Got schema version %d, want %d", version, currentSchemaVersion)
+	}
+
+	for username, role := range map[string]string{"admin": RoleAdmin, "alice": RoleMember} {
+		user, exists := db.GetUser(username)
+		if !exists || user.Role != role {
+			t.Errorf("Got user %s %+v, want role %s", username, user, role)
+		}
+	}
+
+	admin, _ := db.GetUser("admin")
+	if admin.Clients == nil {
+		t.Error("Users' clients weren't filled in")
+	}
+
+	tun, _ := db.GetTunnel("app.example.com")
+	if tun.ClientAddress != "127.0.0.1" {
+		t.Errorf("Got client address %q, want 127.0.0.1", tun.ClientAddress)
+	}
+
+	tests := []struct {
+		token  string
+		owner  string
+		client string
+	}{
+		{"admin-token", "admin", ""},
+		{"client-token", "alice", "laptop"},
+	}
+
+	for _, test := range tests {
+		tokenData, err := db.ValidateToken(test.token)
+		if err != nil {
+			t.Errorf("Token %s: %v", test.token, err)
+			continue
+		}
+
+		if tokenData.Owner != test.owner || tokenData.Client != test.client {
+			t.Errorf("Token %s: got %+v", test.token, tokenData)
+		}
+	}
+
+	for id, tokenData := range db.GetTokens() {
+		if strings.Contains(id, "token") || tokenData.Hash == "" {
+			t.Errorf("Token stored in plaintext under %s", id)
+		}
+	}
+}
+
+func TestMigrateDatabaseDryRun(t *testing.T) {
+
+	dir := writeUnversionedDb(t)
+
+	applied, err := MigrateDatabase(dir, StoreBackendJson, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != currentSchemaVersion {
+		t.Errorf("Got migrations %v, want %d", applied, currentSchemaVersion)
+	}
+
+	data, err := ioutil.ReadFile(dir + "boringproxy_db.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != unversionedJsonDb {
+		t.Error("Dry run changed the database")
+	}
+
+	applied, err = MigrateDatabase(dir, StoreBackendJson, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != currentSchemaVersion {
+		t.Errorf("Got migrations %v, want %d", applied, currentSchemaVersion)
+	}
+
+	applied, err = MigrateDatabase(dir, StoreBackendJson, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != 0 {
+		t.Errorf("Migrations ran twice: %v", applied)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+
+	dir := t.TempDir() + "/"
+
+	db := fmt.Sprintf(`{"schema_version": %d}`, currentSchemaVersion+1)
+
+	err := ioutil.WriteFile(dir+"boringproxy_db.json", []byte(db), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDatabase(dir, StoreBackendJson, nil)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Got error %v, want one about the newer schema", err)
+	}
+}
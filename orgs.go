@@ -0,0 +1,365 @@
+package boringproxy
+
+import (
+	"net/url"
+	"sort"
+)
+
+// Orgs let a group of users share tunnels and clients. A tunnel owned by an
+// org can be managed by any of its members, as far as their roles allow, and
+// clients registered to the org can be run by any of them. Admins create orgs
+// and manage their members.
+//
+// Users and orgs together are called accounts, since either can own tunnels
+// and clients.
+
+// Account returns who the token acts for. That's its org if it's limited to
+// one, otherwise its owner.
+func (t TokenData) Account() string {
+	if t.Org != "" {
+		return t.Org
+	}
+	return t.Owner
+}
+
+func (d *Database) GetOrgs() map[string]Org {
+	var orgs map[string]Org
+	d.view(func(tx StoreTx) {
+		orgs = tx.GetOrgs()
+	})
+	return orgs
+}
+
+func (d *Database) GetOrg(name string) (Org, bool) {
+	var org Org
+	var exists bool
+	d.view(func(tx StoreTx) {
+		org, exists = tx.GetOrg(name)
+	})
+	return org, exists
+}
+
+func (d *Database) AddOrg(name string) error {
+	return d.Update(func(tx StoreTx) error {
+		_, exists := tx.GetOrg(name)
+		if exists {
+			return conflict("Org exists")
+		}
+
+		_, exists = tx.GetUser(name)
+		if exists {
+			return conflict("Name is already used by a user")
+		}
+
+		return tx.SetOrg(name, Org{
+			Members: make(map[string]OrgMember),
+			Clients: make(map[string]DbClient),
+		})
+	})
+}
+
+// DeleteOrg deletes an org along with the tokens limited to it. Orgs which
+// still own tunnels can't be deleted.
+func (d *Database) DeleteOrg(name string) error {
+	return d.Update(func(tx StoreTx) error {
+		_, exists := tx.GetOrg(name)
+		if !exists {
+			return notFound("Org doesn't exist")
+		}
+
+		for domain, tun := range tx.GetTunnels() {
+			if tun.Owner == name {
+				return conflict("Org still owns tunnel %s. Delete it first", domain)
+			}
+		}
+
+		err := deleteOrgTokens(tx, name, "")
+		if err != nil {
+			return err
+		}
+
+		return tx.DeleteOrg(name)
+	})
+}
+
+func (d *Database) SetOrgMember(name, username string) error {
+	return d.Update(func(tx StoreTx) error {
+		org, exists := tx.GetOrg(name)
+		if !exists {
+			return notFound("Org doesn't exist")
+		}
+
+		_, exists = tx.GetUser(username)
+		if !exists {
+			return notFound("User doesn't exist")
+		}
+
+		org.Members[username] = OrgMember{}
+
+		return tx.SetOrg(name, org)
+	})
+}
+
+// DeleteOrgMember removes a user from an org, and deletes their tokens which
+// are limited to it.
+func (d *Database) DeleteOrgMember(name, username string) error {
+	return d.Update(func(tx StoreTx) error {
+		return removeOrgMember(tx, name, username)
+	})
+}
+
+func removeOrgMember(tx StoreTx, name, username string) error {
+
+	org, exists := tx.GetOrg(name)
+	if !exists {
+		return notFound("Org doesn't exist")
+	}
+
+	if _, exists := org.Members[username]; !exists {
+		return notFound("User %s isn't a member of org %s", username, name)
+	}
+
+	delete(org.Members, username)
+
+	err := tx.SetOrg(name, org)
+	if err != nil {
+		return err
+	}
+
+	return deleteOrgTokens(tx, name, username)
+}
+
+// leaveOrgs removes a user from every org they're a member of, ie before
+// deleting them.
+func leaveOrgs(tx StoreTx, username string) error {
+	for name, org := range tx.GetOrgs() {
+		if _, exists := org.Members[username]; exists {
+			err := removeOrgMember(tx, name, username)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteOrgTokens deletes the tokens limited to an org, or only the ones
+// owned by username if it isn't empty.
+func deleteOrgTokens(tx StoreTx, name, username string) error {
+	for id, tokenData := range tx.GetTokens() {
+		if tokenData.Org != name {
+			continue
+		}
+
+		if username != "" && tokenData.Owner != username {
+			continue
+		}
+
+		err := tx.DeleteToken(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateClients runs fn on the clients of a user or org, then saves them.
+func updateClients(tx StoreTx, owner string, fn func(clients map[string]DbClient) error) error {
+
+	if user, exists := tx.GetUser(owner); exists {
+		err := fn(user.Clients)
+		if err != nil {
+			return err
+		}
+		return tx.SetUser(owner, user)
+	}
+
+	if org, exists := tx.GetOrg(owner); exists {
+		err := fn(org.Clients)
+		if err != nil {
+			return err
+		}
+		return tx.SetOrg(owner, org)
+	}
+
+	return notFound("User or org doesn't exist")
+}
+
+// accounts returns the users and orgs a token acts for. Tokens act for their
+// owner and the orgs their owner is a member of, unless they're limited to
+// an org, in which case they only act for it.
+func (a *Api) accounts(tokenData TokenData) map[string]bool {
+
+	accounts := make(map[string]bool)
+
+	if tokenData.Org != "" {
+		org, exists := a.db.GetOrg(tokenData.Org)
+		if exists {
+			// Checked here as well, in case the token outlived the
+			// membership
+			if _, member := org.Members[tokenData.Owner]; member {
+				accounts[tokenData.Org] = true
+			}
+		}
+		return accounts
+	}
+
+	accounts[tokenData.Owner] = true
+
+	for name, org := range a.db.GetOrgs() {
+		if _, member := org.Members[tokenData.Owner]; member {
+			accounts[name] = true
+		}
+	}
+
+	return accounts
+}
+
+// actsFor reports whether the token acts for owner, which is a user or an
+// org.
+func (a *Api) actsFor(tokenData TokenData, owner string) bool {
+	return a.accounts(tokenData)[owner]
+}
+
+// GetOrgs returns the orgs the token acts for, or all of them for users who
+// can see everything.
+func (a *Api) GetOrgs(tokenData TokenData) map[string]Org {
+
+	orgs := a.db.GetOrgs()
+
+	if a.canViewAll(tokenData) {
+		return orgs
+	}
+
+	accounts := a.accounts(tokenData)
+
+	for name := range orgs {
+		if !accounts[name] {
+			delete(orgs, name)
+		}
+	}
+
+	return orgs
+}
+
+// GetClients returns the clients of a user or org visible to the token.
+func (a *Api) GetClients(tokenData TokenData, owner string) (map[string]DbClient, bool) {
+
+	if user, exists := a.GetUsers(tokenData, nil)[owner]; exists {
+		return user.Clients, true
+	}
+
+	if org, exists := a.GetOrgs(tokenData)[owner]; exists {
+		return org.Clients, true
+	}
+
+	return nil, false
+}
+
+func (a *Api) CreateOrg(tokenData TokenData, sourceIp string, params url.Values) error {
+	err := a.createOrg(tokenData, params)
+	a.audit(tokenData, sourceIp, AuditOrgCreate, params.Get("name"), err)
+	return err
+}
+
+func (a *Api) createOrg(tokenData TokenData, params url.Values) error {
+
+	err := a.authorize(tokenData, resourceOrgs, "")
+	if err != nil {
+		return err
+	}
+
+	// Same as for usernames, since they share a namespace
+	name := params.Get("name")
+	minNameLen := 6
+	if len(name) < minNameLen {
+		return badRequest("Org name must be at least %d characters", minNameLen)
+	}
+
+	return a.db.AddOrg(name)
+}
+
+func (a *Api) DeleteOrg(tokenData TokenData, sourceIp string, params url.Values) error {
+	err := a.deleteOrg(tokenData, params)
+	a.audit(tokenData, sourceIp, AuditOrgDelete, params.Get("name"), err)
+	return err
+}
+
+func (a *Api) deleteOrg(tokenData TokenData, params url.Values) error {
+
+	err := a.authorize(tokenData, resourceOrgs, "")
+	if err != nil {
+		return err
+	}
+
+	name := params.Get("name")
+	if name == "" {
+		return badRequest("Invalid name parameter")
+	}
+
+	return a.db.DeleteOrg(name)
+}
+
+func (a *Api) SetOrgMember(tokenData TokenData, sourceIp string, params url.Values) error {
+	err := a.setOrgMember(tokenData, params)
+	a.audit(tokenData, sourceIp, AuditOrgMemberSet, params.Get("name")+"/"+params.Get("username"), err)
+	return err
+}
+
+func (a *Api) setOrgMember(tokenData TokenData, params url.Values) error {
+
+	err := a.authorize(tokenData, resourceOrgs, "")
+	if err != nil {
+		return err
+	}
+
+	name := params.Get("name")
+	if name == "" {
+		return badRequest("Invalid name parameter")
+	}
+
+	username := params.Get("username")
+	if username == "" {
+		return badRequest("Invalid username parameter")
+	}
+
+	return a.db.SetOrgMember(name, username)
+}
+
+func (a *Api) DeleteOrgMember(tokenData TokenData, sourceIp string, params url.Values) error {
+	err := a.deleteOrgMember(tokenData, params)
+	a.audit(tokenData, sourceIp, AuditOrgMemberDelete, params.Get("name")+"/"+params.Get("username"), err)
+	return err
+}
+
+func (a *Api) deleteOrgMember(tokenData TokenData, params url.Values) error {
+
+	err := a.authorize(tokenData, resourceOrgs, "")
+	if err != nil {
+		return err
+	}
+
+	name := params.Get("name")
+	if name == "" {
+		return badRequest("Invalid name parameter")
+	}
+
+	username := params.Get("username")
+	if username == "" {
+		return badRequest("Invalid username parameter")
+	}
+
+	return a.db.DeleteOrgMember(name, username)
+}
+
+// orgNames returns the names of the orgs username is a member of, sorted.
+func orgNames(orgs map[string]Org, username string) []string {
+	names := []string{}
+	for name, org := range orgs {
+		if _, member := org.Members[username]; member {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
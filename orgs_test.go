@@ -0,0 +1,173 @@
+package boringproxy
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newTestOrgApi returns an Api with the org acme, which alice is a member of,
+// and a tunnel owned by each of acme, alice and bob.
+func newTestOrgApi(t *testing.T) *Api {
+	t.Helper()
+
+	api := newTestApi(t)
+
+	for username, role := range map[string]string{
+		"adam":   RoleAdmin,
+		"alice":  RoleMember,
+		"bob":    RoleMember,
+		"audrey": RoleAuditor,
+	} {
+		err := api.db.AddUser(username, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := api.db.AddOrg("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = api.db.SetOrgMember("acme", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, owner := range []string{"acme", "alice", "bob"} {
+		domain := owner + ".example.com"
+		err := api.db.SetTunnel(domain, Tunnel{Domain: domain, Owner: owner})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return api
+}
+
+func tunnelDomains(tunnels map[string]Tunnel) string {
+	domains := []string{}
+	for domain := range tunnels {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return strings.Join(domains, ",")
+}
+
+func TestOrgVisibility(t *testing.T) {
+
+	api := newTestOrgApi(t)
+
+	tests := []struct {
+		name    string
+		token   TokenData
+		tunnels string
+		orgs    int
+	}{
+		{"member", TokenData{Owner: "alice"}, "acme.example.com,alice.example.com", 1},
+		{"member's org token", TokenData{Owner: "alice", Org: "acme"}, "acme.example.com", 1},
+		{"non-member", TokenData{Owner: "bob"}, "bob.example.com", 0},
+		{"non-member's org token", TokenData{Owner: "bob", Org: "acme"}, "", 0},
+		{"auditor", TokenData{Owner: "audrey"}, "acme.example.com,alice.example.com,bob.example.com", 1},
+		{"admin's org token", TokenData{Owner: "adam", Org: "acme"}, "", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tunnels := tunnelDomains(api.GetTunnels(test.token))
+			if tunnels != test.tunnels {
+				t.Errorf("Got tunnels %q, want %q", tunnels, test.tunnels)
+			}
+
+			orgs := api.GetOrgs(test.token)
+			if len(orgs) != test.orgs {
+				t.Errorf("Got orgs %v, want %d", orgs, test.orgs)
+			}
+
+			_, err := api.GetTunnel(test.token, url.Values{"domain": {"acme.example.com"}})
+			canGet := strings.Contains(test.tunnels, "acme.example.com")
+			if (err == nil) != canGet {
+				t.Errorf("Getting the org's tunnel: got error %v, want success %v", err, canGet)
+			}
+		})
+	}
+}
+
+func TestOrgMemberRemoved(t *testing.T) {
+
+	api := newTestOrgApi(t)
+
+	orgToken, err := api.db.AddToken(TokenData{Owner: "alice", Org: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := api.db.AddToken(TokenData{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = api.db.DeleteOrgMember("acme", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = api.db.ValidateToken(orgToken)
+	if err == nil {
+		t.Error("Token limited to the org outlived the membership")
+	}
+
+	_, err = api.db.ValidateToken(token)
+	if err != nil {
+		t.Errorf("Member's own token was deleted: %v", err)
+	}
+
+	tunnels := tunnelDomains(api.GetTunnels(TokenData{Owner: "alice"}))
+	if tunnels != "alice.example.com" {
+		t.Errorf("Got tunnels %q after leaving the org", tunnels)
+	}
+
+	err = api.authorize(TokenData{Owner: "alice"}, resourceTunnels, "acme")
+	if err == nil {
+		t.Error("Former member can still change the org's tunnels")
+	}
+}
+
+func TestDeleteAccountsWithTunnels(t *testing.T) {
+
+	api := newTestOrgApi(t)
+
+	tests := []struct {
+		name   string
+		delete func() error
+		ok     bool
+	}{
+		{"org with tunnels", func() error { return api.db.DeleteOrg("acme") }, false},
+		{"user with tunnels", func() error { return api.db.DeleteUser("bob") }, false},
+		{"last admin", func() error { return api.db.DeleteUser("adam") }, false},
+		{"missing user", func() error { return api.db.DeleteUser("nobody") }, false},
+		{"user without tunnels", func() error { return api.db.DeleteUser("audrey") }, true},
+		{"tunnels deleted", func() error {
+			err := api.db.DeleteTunnel("acme.example.com")
+			if err != nil {
+				return err
+			}
+			return api.db.DeleteOrg("acme")
+		}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.delete()
+			if (err == nil) != test.ok {
+				t.Errorf("Got error %v, want success %v", err, test.ok)
+			}
+		})
+	}
+
+	if _, exists := api.db.GetUser("bob"); !exists {
+		t.Error("Refused delete removed the user")
+	}
+}
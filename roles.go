@@ -0,0 +1,170 @@
+package boringproxy
+
+// User roles. A user's role decides what they can do. Token scopes can limit
+// a token further, but never give it more than its owner's role allows.
+const (
+	// Can do anything
+	RoleAdmin = "admin"
+	// Manages everyone's tunnels and clients, but not users or their tokens
+	RoleOperator = "operator"
+	// Manages their own tunnels, clients and tokens
+	RoleMember = "member"
+	// Can see everything, including the audit log, but can't change
+	// anything
+	RoleAuditor = "auditor"
+)
+
+// Tunnel ports below this need PermPrivilegedPorts
+const minUnprivilegedPort = 1024
+
+var userRoles = []string{
+	RoleAdmin,
+	RoleOperator,
+	RoleMember,
+	RoleAuditor,
+}
+
+// Permissions granted by roles. The :own permissions cover things which
+// belong to the user, and :all covers everyone's.
+const (
+	PermTunnelsOwn = "tunnels:own"
+	PermTunnelsAll = "tunnels:all"
+	PermClientsOwn = "clients:own"
+	PermClientsAll = "clients:all"
+	PermTokensOwn  = "tokens:own"
+	PermTokensAll  = "tokens:all"
+	PermUsersAll   = "users:all"
+	// See every user, tunnel, client and token
+	PermViewAll   = "view:all"
+	PermAuditRead = "audit:read"
+	// Use tunnel ports below 1024, which the server binds itself
+	PermPrivilegedPorts = "ports:privileged"
+)
+
+var rolePermissions = map[string][]string{
+	RoleAdmin: {
+		PermTunnelsOwn, PermTunnelsAll,
+		PermClientsOwn, PermClientsAll,
+		PermTokensOwn, PermTokensAll,
+		PermUsersAll,
+		PermViewAll,
+		PermAuditRead,
+		PermPrivilegedPorts,
+	},
+	RoleOperator: {
+		PermTunnelsOwn, PermTunnelsAll,
+		PermClientsOwn, PermClientsAll,
+		PermTokensOwn,
+		PermViewAll,
+	},
+	RoleMember: {
+		PermTunnelsOwn,
+		PermClientsOwn,
+		PermTokensOwn,
+	},
+	RoleAuditor: {
+		PermViewAll,
+		PermAuditRead,
+	},
+}
+
+// Kinds of things which can be changed through the API, along with the token
+// scope and role permissions needed to change them.
+const (
+	resourceTunnels = "tunnels"
+	resourceClients = "clients"
+	resourceTokens  = "tokens"
+	resourceUsers   = "users"
+	resourceOrgs    = "orgs"
+)
+
+var resourcePermissions = map[string]struct {
+	scope string
+	own   string
+	all   string
+}{
+	resourceTunnels: {ScopeTunnelsWrite, PermTunnelsOwn, PermTunnelsAll},
+	resourceClients: {ScopeClientsWrite, PermClientsOwn, PermClientsAll},
+	resourceTokens:  {ScopeTokensWrite, PermTokensOwn, PermTokensAll},
+	// Users don't own themselves
+	resourceUsers: {ScopeUsersAdmin, "", PermUsersAll},
+	// Org members can manage what the org owns, but not the org itself
+	resourceOrgs: {ScopeUsersAdmin, "", PermUsersAll},
+}
+
+func validRole(role string) bool {
+	_, exists := rolePermissions[role]
+	return exists
+}
+
+// Can reports whether the user's role grants perm.
+func (u User) Can(perm string) bool {
+	for _, p := range rolePermissions[u.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize returns an error unless the token is allowed to change a
+// resource which belongs to owner, a user or an org. It checks the token's
+// scopes and org, and its owner's role. Every change made through the API is
+// checked here.
+func (a *Api) authorize(tokenData TokenData, resource, owner string) error {
+
+	perms := resourcePermissions[resource]
+
+	err := requireScope(tokenData, perms.scope)
+	if err != nil {
+		return err
+	}
+
+	user, exists := a.db.GetUser(tokenData.Owner)
+	if !exists {
+		return errUnauthorized
+	}
+
+	if perms.own != "" && user.Can(perms.own) && a.actsFor(tokenData, owner) {
+		return nil
+	}
+
+	// Tokens limited to an org can't be used for anything else, even by
+	// admins
+	if tokenData.Org == "" && user.Can(perms.all) {
+		return nil
+	}
+
+	return errUnauthorized
+}
+
+// canViewAll reports whether the token can see things which belong to other
+// users and orgs.
+func (a *Api) canViewAll(tokenData TokenData) bool {
+	if tokenData.Org != "" {
+		return false
+	}
+
+	user, _ := a.db.GetUser(tokenData.Owner)
+	return user.Can(PermViewAll)
+}
+
+// checkTunnelPort returns an error unless the token can use port for a
+// tunnel.
+func (a *Api) checkTunnelPort(tokenData TokenData, port int) error {
+
+	if port < 1 || port > 65535 {
+		return badRequest("Invalid tunnel-port parameter")
+	}
+
+	if port >= minUnprivilegedPort {
+		return nil
+	}
+
+	user, _ := a.db.GetUser(tokenData.Owner)
+	if tokenData.Org != "" || !user.Can(PermPrivilegedPorts) {
+		return forbidden("Only admins can use tunnel ports below %d", minUnprivilegedPort)
+	}
+
+	return nil
+}
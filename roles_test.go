@@ -0,0 +1,156 @@
+package boringproxy
+
+import (
+	"testing"
+)
+
+// Users with each role, along with bob, whose things the others try to change
+var testRoleUsers = map[string]string{
+	"adam":   RoleAdmin,
+	"oscar":  RoleOperator,
+	"alice":  RoleMember,
+	"audrey": RoleAuditor,
+	"bob":    RoleMember,
+}
+
+func newTestRolesApi(t *testing.T) *Api {
+	t.Helper()
+
+	api := newTestApi(t)
+
+	for username, role := range testRoleUsers {
+		err := api.db.AddUser(username, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return api
+}
+
+func TestAuthorizeByRole(t *testing.T) {
+
+	api := newTestRolesApi(t)
+
+	// Whether each user can change their own and bob's resources
+	type access struct{ own, other bool }
+
+	tests := []struct {
+		user      string
+		resources map[string]access
+	}{
+		{"adam", map[string]access{
+			resourceTunnels: {true, true},
+			resourceClients: {true, true},
+			resourceTokens:  {true, true},
+			resourceUsers:   {true, true},
+			resourceOrgs:    {true, true},
+		}},
+		{"oscar", map[string]access{
+			resourceTunnels: {true, true},
+			resourceClients: {true, true},
+			resourceTokens:  {true, false},
+			resourceUsers:   {false, false},
+			resourceOrgs:    {false, false},
+		}},
+		{"alice", map[string]access{
+			resourceTunnels: {true, false},
+			resourceClients: {true, false},
+			resourceTokens:  {true, false},
+			resourceUsers:   {false, false},
+			resourceOrgs:    {false, false},
+		}},
+		{"audrey", map[string]access{
+			resourceTunnels: {false, false},
+			resourceClients: {false, false},
+			resourceTokens:  {false, false},
+			resourceUsers:   {false, false},
+			resourceOrgs:    {false, false},
+		}},
+	}
+
+	for _, test := range tests {
+		tokenData := TokenData{Owner: test.user}
+
+		for resource, want := range test.resources {
+			err := api.authorize(tokenData, resource, test.user)
+			if (err == nil) != want.own {
+				t.Errorf("%s (%s) changing own %s: got error %v, want success %v", test.user, testRoleUsers[test.user], resource, err, want.own)
+			}
+
+			err = api.authorize(tokenData, resource, "bob")
+			if (err == nil) != want.other {
+				t.Errorf("%s (%s) changing bob's %s: got error %v, want success %v", test.user, testRoleUsers[test.user], resource, err, want.other)
+			}
+		}
+	}
+}
+
+func TestAuthorizeLimitedTokens(t *testing.T) {
+
+	api := newTestRolesApi(t)
+
+	err := api.db.AddOrg("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"alice", "adam"} {
+		err := api.db.SetOrgMember("acme", username)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		token    TokenData
+		resource string
+		owner    string
+		ok       bool
+	}{
+		{"matching scope", TokenData{Owner: "alice", Scopes: []string{ScopeTunnelsWrite}}, resourceTunnels, "alice", true},
+		{"other scope", TokenData{Owner: "alice", Scopes: []string{ScopeClientsWrite}}, resourceTunnels, "alice", false},
+		{"read-only", TokenData{Owner: "adam", Scopes: []string{ScopeReadOnly}}, resourceTunnels, "adam", false},
+		{"scope beyond role", TokenData{Owner: "alice", Scopes: []string{ScopeUsersAdmin}}, resourceUsers, "bob", false},
+		{"member for org", TokenData{Owner: "alice"}, resourceTunnels, "acme", true},
+		{"non-member for org", TokenData{Owner: "bob"}, resourceTunnels, "acme", false},
+		{"org token for org", TokenData{Owner: "alice", Org: "acme"}, resourceTunnels, "acme", true},
+		{"org token for owner", TokenData{Owner: "alice", Org: "acme"}, resourceTunnels, "alice", false},
+		{"admin org token for others", TokenData{Owner: "adam", Org: "acme"}, resourceTunnels, "bob", false},
+		{"org token of non-member", TokenData{Owner: "bob", Org: "acme"}, resourceTunnels, "acme", false},
+		{"deleted owner", TokenData{Owner: "nobody"}, resourceTunnels, "nobody", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := api.authorize(test.token, test.resource, test.owner)
+			if (err == nil) != test.ok {
+				t.Errorf("Got error %v, want success %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestCanViewAll(t *testing.T) {
+
+	api := newTestRolesApi(t)
+
+	tests := []struct {
+		token TokenData
+		ok    bool
+	}{
+		{TokenData{Owner: "adam"}, true},
+		{TokenData{Owner: "oscar"}, true},
+		{TokenData{Owner: "audrey"}, true},
+		{TokenData{Owner: "alice"}, false},
+		{TokenData{Owner: "adam", Org: "acme"}, false},
+		{TokenData{Owner: "nobody"}, false},
+	}
+
+	for _, test := range tests {
+		if api.canViewAll(test.token) != test.ok {
+			t.Errorf("canViewAll(%+v) = %v, want %v", test.token, !test.ok, test.ok)
+		}
+	}
+}
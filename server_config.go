@@ -0,0 +1,167 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ServerConfig holds the server settings. It can be loaded from a JSON or YAML
+// file with -config, in which case any flags given on the command line take
+// precedence over the file.
+//
+// Only the ACME, behind-proxy, allow-http, shutdown timeout and logging
+// settings are applied when the config is reloaded with SIGHUP. Everything
+// else requires a restart.
+type ServerConfig struct {
+	ConfigFile      string `json:"-" yaml:"-"`
+	PrintLogin      bool   `json:"-" yaml:"-"`
+	AdminDomain     string `json:"adminDomain,omitempty" yaml:"adminDomain,omitempty"`
+	SshServerPort   int    `json:"sshServerPort,omitempty" yaml:"sshServerPort,omitempty"`
+	DbDir           string `json:"dbDir,omitempty" yaml:"dbDir,omitempty"`
+	DbBackend       string `json:"dbBackend,omitempty" yaml:"dbBackend,omitempty"`
+	CertDir         string `json:"certDir,omitempty" yaml:"certDir,omitempty"`
+	HttpPort        int    `json:"httpPort,omitempty" yaml:"httpPort,omitempty"`
+	HttpsPort       int    `json:"httpsPort,omitempty" yaml:"httpsPort,omitempty"`
+	AllowHttp       bool   `json:"allowHttp,omitempty" yaml:"allowHttp,omitempty"`
+	PublicIp        string `json:"publicIp,omitempty" yaml:"publicIp,omitempty"`
+	BehindProxy     bool   `json:"behindProxy,omitempty" yaml:"behindProxy,omitempty"`
+	AcmeEmail       string `json:"acmeEmail,omitempty" yaml:"acmeEmail,omitempty"`
+	AcmeUseStaging  bool   `json:"acmeUseStaging,omitempty" yaml:"acmeUseStaging,omitempty"`
+	AcceptCATerms   bool   `json:"acceptCATerms,omitempty" yaml:"acceptCATerms,omitempty"`
+	AcmeCa          string `json:"acmeCa,omitempty" yaml:"acmeCa,omitempty"`
+	ShutdownTimeout int    `json:"shutdownTimeout,omitempty" yaml:"shutdownTimeout,omitempty"`
+	// Log to this file instead of stderr. It's reopened on SIGHUP, so it
+	// can be rotated.
+	LogFile string `json:"logFile,omitempty" yaml:"logFile,omitempty"`
+	// Don't log a line for every HTTP request
+	DisableRequestLog bool `json:"disableRequestLog,omitempty" yaml:"disableRequestLog,omitempty"`
+	// File containing the key used to encrypt secrets in the database. If
+	// not set, the BORINGPROXY_MASTER_KEY environment variable is used.
+	MasterKeyFile string `json:"masterKeyFile,omitempty" yaml:"masterKeyFile,omitempty"`
+}
+
+// Not 22, so the embedded SSH server doesn't clash with OpenSSH.
+const defaultSshServerPort = 2222
+
+func newServerFlagSet(config *ServerConfig) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flagSet.StringVar(&config.ConfigFile, "config", "", "Config file (JSON or YAML). Flags override values from the file")
+	flagSet.BoolVar(&config.PrintLogin, "print-login", false, "Creates an admin token and prints login information. The token printed by the previous start stops working")
+	flagSet.StringVar(&config.AdminDomain, "admin-domain", "", "Admin Domain")
+	flagSet.IntVar(&config.SshServerPort, "ssh-server-port", defaultSshServerPort, "Port for the embedded SSH server clients connect to")
+	flagSet.StringVar(&config.DbDir, "db-dir", "", "Database file directory")
+	flagSet.StringVar(&config.DbBackend, "db-backend", StoreBackendJson, "Database storage backend (json or bolt). Use 'boringproxy db convert' to switch an existing database")
+	flagSet.StringVar(&config.MasterKeyFile, "master-key-file", "", "File containing a base64 encoded 32 byte key for encrypting secrets in the database. Defaults to the "+masterKeyEnvVar+" environment variable")
+	flagSet.StringVar(&config.CertDir, "cert-dir", "", "TLS cert directory")
+	flagSet.IntVar(&config.HttpPort, "http-port", 80, "HTTP (insecure) port")
+	flagSet.IntVar(&config.HttpsPort, "https-port", 443, "HTTPS (secure) port")
+	flagSet.BoolVar(&config.AllowHttp, "allow-http", false, "Allow unencrypted (HTTP) requests")
+	flagSet.StringVar(&config.PublicIp, "public-ip", "", "Public IP")
+	flagSet.BoolVar(&config.BehindProxy, "behind-proxy", false, "Whether we're running behind another reverse proxy")
+	flagSet.StringVar(&config.AcmeEmail, "acme-email", "", "Email for ACME (ie Let's Encrypt)")
+	flagSet.BoolVar(&config.AcmeUseStaging, "acme-use-staging", false, "Use ACME (ie Let's Encrypt) staging servers")
+	flagSet.BoolVar(&config.AcceptCATerms, "accept-ca-terms", false, "Automatically accept CA terms")
+	flagSet.StringVar(&config.AcmeCa, "acme-certificate-authority", "", "URI for ACME Certificate Authority")
+	flagSet.IntVar(&config.ShutdownTimeout, "shutdown-timeout", 30, "Seconds to wait for open connections to finish when shutting down")
+	flagSet.StringVar(&config.LogFile, "log-file", "", "Log to this file instead of stderr")
+	flagSet.BoolVar(&config.DisableRequestLog, "disable-request-log", false, "Don't log every HTTP request")
+	return flagSet
+}
+
+// LoadServerConfig parses the server flags in args, merging in the config file
+// if one is given with -config.
+func LoadServerConfig(args []string) (*ServerConfig, error) {
+
+	config := &ServerConfig{}
+	flagSet := newServerFlagSet(config)
+
+	err := flagSet.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ConfigFile == "" {
+		return config, nil
+	}
+
+	// The file is loaded on top of the flag defaults, then the flags are
+	// parsed again so the ones given explicitly win.
+	err = readConfigFile(config.ConfigFile, config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = flagSet.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// readConfigFile unmarshals a config file into v. Files ending in .yaml or .yml
+// are parsed as YAML, everything else as JSON.
+func readConfigFile(path string, v interface{}) error {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(data, v)
+	} else {
+		err = json.Unmarshal(data, v)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to parse config file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// restartRequired lists the settings which differ between a and b but can't be
+// changed by reloading.
+func (a *ServerConfig) restartRequired(b *ServerConfig) []string {
+
+	changed := []string{}
+
+	if a.AdminDomain != b.AdminDomain {
+		changed = append(changed, "adminDomain")
+	}
+	if a.SshServerPort != b.SshServerPort {
+		changed = append(changed, "sshServerPort")
+	}
+	if a.DbDir != b.DbDir {
+		changed = append(changed, "dbDir")
+	}
+	if a.DbBackend != b.DbBackend {
+		changed = append(changed, "dbBackend")
+	}
+	if a.MasterKeyFile != b.MasterKeyFile {
+		changed = append(changed, "masterKeyFile")
+	}
+	if a.CertDir != b.CertDir {
+		changed = append(changed, "certDir")
+	}
+	if a.HttpPort != b.HttpPort {
+		changed = append(changed, "httpPort")
+	}
+	if a.HttpsPort != b.HttpsPort {
+		changed = append(changed, "httpsPort")
+	}
+	if a.PublicIp != b.PublicIp {
+		changed = append(changed, "publicIp")
+	}
+
+	return changed
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/tls"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -52,25 +53,41 @@ func readClientHello(reader io.Reader) (*tls.ClientHelloInfo, error) {
 }
 
 type PassthroughListener struct {
-	ch chan net.Conn
+	ch        chan net.Conn
+	done      chan struct{}
+	closeOnce *sync.Once
 }
 
 func NewPassthroughListener() *PassthroughListener {
 	return &PassthroughListener{
-		ch: make(chan net.Conn),
+		ch:        make(chan net.Conn),
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
 	}
 }
 func (f *PassthroughListener) Accept() (net.Conn, error) {
-	return <-f.ch, nil
+	select {
+	case conn := <-f.ch:
+		return conn, nil
+	case <-f.done:
+		return nil, net.ErrClosed
+	}
 }
 func (f *PassthroughListener) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.done)
+	})
 	return nil
 }
 func (f *PassthroughListener) Addr() net.Addr {
 	return nil
 }
 func (f *PassthroughListener) PassConn(conn net.Conn) {
-	f.ch <- conn
+	select {
+	case f.ch <- conn:
+	case <-f.done:
+		conn.Close()
+	}
 }
 
 // This type creates a new net.Conn that's the same as an old one, except a new
@@ -90,7 +107,9 @@ func NewProxyConn(conn net.Conn, reader io.Reader) *ProxyConn {
 		reader,
 	}
 }
-func (c ProxyConn) CloseWrite() error           { return c.conn.(*net.TCPConn).CloseWrite() }
+func (c ProxyConn) CloseWrite() error {
+	return c.conn.(interface{ CloseWrite() error }).CloseWrite()
+}
 func (c ProxyConn) Read(p []byte) (int, error)  { return c.reader.Read(p) }
 func (c ProxyConn) Write(p []byte) (int, error) { return c.conn.Write(p) }
 
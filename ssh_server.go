@@ -0,0 +1,538 @@
+package boringproxy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// How long a replaced connection is kept open for the forwarded connections
+// it's still carrying to finish.
+const replacedConnTimeout = 60 * time.Second
+
+// SshServer is a minimal SSH server which only supports what boringproxy
+// clients need, ie remote port forwarding (ssh -R). Keys are authenticated
+// directly against the tunnels stored in the database, and each key is only
+// allowed to forward its own tunnel port.
+type SshServer struct {
+	db        *Database
+	sshConfig *ssh.ServerConfig
+	hostKey   ssh.Signer
+	mutex     *sync.Mutex
+	conns     map[string]map[*sshConn]bool
+	// Maps tunnel private keys to their marshaled public keys, so we don't
+	// have to parse every private key on every login.
+	pubKeys map[string][]byte
+	// Maps the usernames of tunnels from before the embedded server to
+	// their domains. Rebuilt when usernamesChanges is closed.
+	usernames        map[string][]string
+	usernamesChanges <-chan struct{}
+}
+
+// sshConn is a client connection, along with the ports it's forwarding.
+type sshConn struct {
+	*ssh.ServerConn
+	mutex     *sync.Mutex
+	listeners map[string]net.Listener
+	// Goroutines accepting forwarded connections
+	accepting *sync.WaitGroup
+	// Forwarded connections which are still open
+	active int
+	// Set once another connection for the same tunnel has taken over
+	replaced bool
+}
+
+type tcpipForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type tcpipForwardResponse struct {
+	BindPort uint32
+}
+
+type forwardedTcpipPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+func NewSshServer(db *Database) (*SshServer, error) {
+
+	hostKey, err := loadOrCreateHostKey(DBFolderPath + "boringproxy_ssh_host_key")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SshServer{
+		db:      db,
+		hostKey: hostKey,
+		mutex:   &sync.Mutex{},
+		conns:   make(map[string]map[*sshConn]bool),
+		pubKeys: make(map[string][]byte),
+	}
+
+	s.sshConfig = &ssh.ServerConfig{
+		PublicKeyCallback: s.authenticate,
+	}
+	s.sshConfig.AddHostKey(hostKey)
+
+	return s, nil
+}
+
+func (s *SshServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// Close disconnects all clients. It doesn't stop Serve; close the listener
+// for that.
+func (s *SshServer) Close() {
+	s.mutex.Lock()
+	allConns := s.conns
+	s.conns = make(map[string]map[*sshConn]bool)
+	s.mutex.Unlock()
+
+	for _, conns := range allConns {
+		for conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// AuthorizedKey returns the server's public host key in authorized_keys
+// format, so clients can verify they're talking to the right server.
+func (s *SshServer) AuthorizedKey() string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.hostKey.PublicKey())))
+}
+
+// CloseTunnel disconnects every client currently connected with the key for
+// the given tunnel, which also closes any ports they were forwarding.
+func (s *SshServer) CloseTunnel(domain string) {
+	s.mutex.Lock()
+	conns := s.conns[domain]
+	delete(s.conns, domain)
+	s.mutex.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
+func (s *SshServer) authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+
+	keyBytes := key.Marshal()
+
+	// Tunnels created by the embedded server use the domain as the SSH
+	// username, so check that first.
+	if tun, exists := s.db.GetTunnel(meta.User()); exists {
+		if bytes.Equal(s.tunnelPublicKey(tun), keyBytes) {
+			return tunnelPermissions(tun), nil
+		}
+	}
+
+	// Older tunnels use the system username, so fall back to checking the
+	// tunnels with that username.
+	for _, domain := range s.usernameTunnels(meta.User()) {
+		tun, exists := s.db.GetTunnel(domain)
+		if exists && bytes.Equal(s.tunnelPublicKey(tun), keyBytes) {
+			return tunnelPermissions(tun), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown public key for %s", meta.User())
+}
+
+// usernameTunnels returns the domains of the tunnels which have username set
+// as their SSH username.
+func (s *SshServer) usernameTunnels(username string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.usernamesChanges:
+	default:
+		if s.usernames != nil {
+			return s.usernames[username]
+		}
+	}
+
+	// Get the channel before reading the tunnels, so changes made in
+	// between aren't missed.
+	s.usernamesChanges = s.db.Changes()
+
+	s.usernames = make(map[string][]string)
+	for domain, tun := range s.db.GetTunnels() {
+		if tun.Username != "" {
+			s.usernames[tun.Username] = append(s.usernames[tun.Username], domain)
+		}
+	}
+
+	return s.usernames[username]
+}
+
+func (s *SshServer) tunnelPublicKey(tun Tunnel) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if pubKey, exists := s.pubKeys[tun.TunnelPrivateKey]; exists {
+		return pubKey
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(tun.TunnelPrivateKey))
+	if err != nil {
+		log.Printf("Invalid private key for tunnel %s: %v", tun.Domain, err)
+		return nil
+	}
+
+	pubKey := signer.PublicKey().Marshal()
+	s.pubKeys[tun.TunnelPrivateKey] = pubKey
+
+	return pubKey
+}
+
+func tunnelPermissions(tun Tunnel) *ssh.Permissions {
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"domain": tun.Domain,
+		},
+	}
+}
+
+func (s *SshServer) handleConn(netConn net.Conn) {
+
+	serverConn, chans, reqs, err := ssh.NewServerConn(netConn, s.sshConfig)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+
+	conn := &sshConn{
+		ServerConn: serverConn,
+		mutex:      &sync.Mutex{},
+		listeners:  make(map[string]net.Listener),
+		accepting:  &sync.WaitGroup{},
+	}
+	defer conn.Close()
+	defer conn.closeListeners()
+
+	domain := conn.Permissions.Extensions["domain"]
+
+	s.mutex.Lock()
+	if s.conns[domain] == nil {
+		s.conns[domain] = make(map[*sshConn]bool)
+	}
+	s.conns[domain][conn] = true
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns[domain], conn)
+		if len(s.conns[domain]) == 0 {
+			delete(s.conns, domain)
+		}
+		s.mutex.Unlock()
+	}()
+
+	go func() {
+		for newChan := range chans {
+			newChan.Reject(ssh.Prohibited, "This key permits tunnels only")
+		}
+	}()
+
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			var fwdReq tcpipForwardRequest
+			err := ssh.Unmarshal(req.Payload, &fwdReq)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			// Only one connection per tunnel can hold the tunnel
+			// port. If a client reconnects before the server
+			// notices the old connection is dead, or restarts a
+			// tunnel, the new one wins. Its ports are free again
+			// once this returns.
+			s.replaceConns(domain, conn)
+
+			listener, err := s.listenForTunnel(domain, fwdReq)
+			if err != nil {
+				log.Printf("Rejected forward for %s: %v", domain, err)
+				req.Reply(false, nil)
+				continue
+			}
+
+			key := net.JoinHostPort(fwdReq.BindAddr, strconv.Itoa(int(fwdReq.BindPort)))
+			if !conn.addListener(key, listener) {
+				// Replaced in the meantime
+				listener.Close()
+				req.Reply(false, nil)
+				continue
+			}
+
+			conn.accepting.Add(1)
+			go func() {
+				s.acceptForwards(conn, listener, fwdReq)
+				conn.accepting.Done()
+			}()
+
+			req.Reply(true, ssh.Marshal(tcpipForwardResponse{fwdReq.BindPort}))
+		case "cancel-tcpip-forward":
+			var fwdReq tcpipForwardRequest
+			err := ssh.Unmarshal(req.Payload, &fwdReq)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			key := net.JoinHostPort(fwdReq.BindAddr, strconv.Itoa(int(fwdReq.BindPort)))
+			conn.removeListener(key)
+
+			req.Reply(true, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// replaceConns makes every other connection for domain give up its ports, so
+// conn can take them over. They stay open until the connections they're
+// forwarding have finished, so restarting a tunnel doesn't cut off requests
+// in flight.
+func (s *SshServer) replaceConns(domain string, conn *sshConn) {
+	s.mutex.Lock()
+	oldConns := []*sshConn{}
+	for oldConn := range s.conns[domain] {
+		if oldConn != conn {
+			oldConns = append(oldConns, oldConn)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, oldConn := range oldConns {
+		if oldConn.replace() {
+			log.Printf("Replacing existing SSH connection for %s", domain)
+		}
+	}
+}
+
+func (s *SshServer) listenForTunnel(domain string, fwdReq tcpipForwardRequest) (net.Listener, error) {
+
+	tun, exists := s.db.GetTunnel(domain)
+	if !exists {
+		return nil, errors.New("Tunnel doesn't exist")
+	}
+
+	if int(fwdReq.BindPort) != tun.TunnelPort {
+		return nil, fmt.Errorf("Port %d not permitted", fwdReq.BindPort)
+	}
+
+	bindAddr := "127.0.0.1"
+	if tun.AllowExternalTcp {
+		bindAddr = "0.0.0.0"
+	}
+
+	if fwdReq.BindAddr != bindAddr {
+		return nil, fmt.Errorf("Address %s not permitted", fwdReq.BindAddr)
+	}
+
+	return net.Listen("tcp", net.JoinHostPort(bindAddr, strconv.Itoa(tun.TunnelPort)))
+}
+
+func (s *SshServer) acceptForwards(conn *sshConn, listener net.Listener, fwdReq tcpipForwardRequest) {
+	for {
+		tcpConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		conn.forwardStarted()
+
+		go func() {
+			defer conn.forwardDone()
+			defer tcpConn.Close()
+
+			originAddr, originPortStr, _ := net.SplitHostPort(tcpConn.RemoteAddr().String())
+			originPort, _ := strconv.Atoi(originPortStr)
+
+			payload := forwardedTcpipPayload{
+				Addr:       fwdReq.BindAddr,
+				Port:       fwdReq.BindPort,
+				OriginAddr: originAddr,
+				OriginPort: uint32(originPort),
+			}
+
+			channel, reqs, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(payload))
+			if err != nil {
+				return
+			}
+			defer channel.Close()
+
+			go ssh.DiscardRequests(reqs)
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+
+			go func() {
+				io.Copy(channel, tcpConn)
+				channel.CloseWrite()
+				wg.Done()
+			}()
+			go func() {
+				io.Copy(tcpConn, channel)
+				tcpConn.(*net.TCPConn).CloseWrite()
+				wg.Done()
+			}()
+
+			wg.Wait()
+		}()
+	}
+}
+
+// addListener records a listener forwarding to the connection. It returns
+// false if the connection has been replaced, since it can't forward anything
+// after that.
+func (c *sshConn) addListener(key string, listener net.Listener) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.replaced {
+		return false
+	}
+
+	c.listeners[key] = listener
+	return true
+}
+
+func (c *sshConn) removeListener(key string) {
+	c.mutex.Lock()
+	listener, exists := c.listeners[key]
+	delete(c.listeners, key)
+	c.mutex.Unlock()
+
+	if exists {
+		listener.Close()
+	}
+}
+
+// closeListeners stops forwarding anything. The ports are free to listen on
+// again once it returns.
+func (c *sshConn) closeListeners() {
+	c.mutex.Lock()
+	listeners := c.listeners
+	c.listeners = make(map[string]net.Listener)
+	c.mutex.Unlock()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
+// replace closes the connection's listeners, then closes the connection
+// itself once it's idle, or after replacedConnTimeout. It returns false if
+// the connection was already replaced.
+func (c *sshConn) replace() bool {
+	c.mutex.Lock()
+	if c.replaced {
+		c.mutex.Unlock()
+		return false
+	}
+	c.replaced = true
+	c.mutex.Unlock()
+
+	c.closeListeners()
+
+	// Connections which were accepted just before the listeners closed
+	// are counted once this returns.
+	c.accepting.Wait()
+
+	c.mutex.Lock()
+	idle := c.active == 0
+	c.mutex.Unlock()
+
+	if idle {
+		c.Close()
+	} else {
+		time.AfterFunc(replacedConnTimeout, func() {
+			c.Close()
+		})
+	}
+
+	return true
+}
+
+func (c *sshConn) forwardStarted() {
+	c.mutex.Lock()
+	c.active++
+	c.mutex.Unlock()
+}
+
+func (c *sshConn) forwardDone() {
+	c.mutex.Lock()
+	c.active--
+	idle := c.replaced && c.active == 0
+	c.mutex.Unlock()
+
+	if idle {
+		c.Close()
+	}
+}
+
+func loadOrCreateHostKey(path string) (ssh.Signer, error) {
+
+	keyBytes, err := ioutil.ReadFile(path)
+	if err == nil {
+		return ssh.ParsePrivateKey(keyBytes)
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Printf("Generating SSH host key %s", path)
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	err = ioutil.WriteFile(path, keyBytes, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(keyBytes)
+}
@@ -0,0 +1,211 @@
+package boringproxy
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSshServer(t *testing.T, db *Database) string {
+	t.Helper()
+
+	sshServer, err := NewSshServer(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go sshServer.Serve(listener)
+
+	t.Cleanup(func() {
+		listener.Close()
+		sshServer.Close()
+	})
+
+	return listener.Addr().String()
+}
+
+func newTestTunnel(t *testing.T, db *Database, domain string) Tunnel {
+	t.Helper()
+
+	_, privKey, err := MakeSSHKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := randomOpenPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tun := Tunnel{
+		Domain:           domain,
+		Owner:            "alice",
+		TunnelPort:       port,
+		TunnelPrivateKey: privKey,
+	}
+
+	err = db.SetTunnel(domain, tun)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tun
+}
+
+func dialTestSshServer(addr, user, privKey string) (*ssh.Client, error) {
+
+	signer, err := ssh.ParsePrivateKey([]byte(privKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+}
+
+func TestSshServerAuthentication(t *testing.T) {
+
+	db := newTestDatabase(t)
+
+	app := newTestTunnel(t, db, "app.example.com")
+	other := newTestTunnel(t, db, "other.example.com")
+
+	legacy := newTestTunnel(t, db, "legacy.example.com")
+	legacy.Username = "boringproxy"
+	err := db.SetTunnel(legacy.Domain, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := newTestSshServer(t, db)
+
+	tests := []struct {
+		name    string
+		user    string
+		privKey string
+		ok      bool
+	}{
+		{"tunnel's key", "app.example.com", app.TunnelPrivateKey, true},
+		{"other tunnel's key", "app.example.com", other.TunnelPrivateKey, false},
+		{"unknown tunnel", "missing.example.com", app.TunnelPrivateKey, false},
+		{"legacy username", "boringproxy", legacy.TunnelPrivateKey, true},
+		{"legacy username with other key", "boringproxy", app.TunnelPrivateKey, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := dialTestSshServer(addr, test.user, test.privKey)
+			if err == nil {
+				client.Close()
+			}
+
+			if (err == nil) != test.ok {
+				t.Errorf("Got error %v, want success %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestSshServerForwardRestrictions(t *testing.T) {
+
+	db := newTestDatabase(t)
+
+	app := newTestTunnel(t, db, "app.example.com")
+	other := newTestTunnel(t, db, "other.example.com")
+
+	addr := newTestSshServer(t, db)
+
+	client, err := dialTestSshServer(addr, app.Domain, app.TunnelPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		name string
+		addr string
+		ok   bool
+	}{
+		{"other tunnel's port", net.JoinHostPort("127.0.0.1", strconv.Itoa(other.TunnelPort)), false},
+		{"external address", net.JoinHostPort("0.0.0.0", strconv.Itoa(app.TunnelPort)), false},
+		{"tunnel's port", net.JoinHostPort("127.0.0.1", strconv.Itoa(app.TunnelPort)), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := client.Listen("tcp", test.addr)
+			if err == nil {
+				listener.Close()
+			}
+
+			if (err == nil) != test.ok {
+				t.Errorf("Got error %v, want success %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestSshServerForwardsConnections(t *testing.T) {
+
+	db := newTestDatabase(t)
+
+	app := newTestTunnel(t, db, "app.example.com")
+
+	addr := newTestSshServer(t, db)
+
+	client, err := dialTestSshServer(addr, app.Domain, app.TunnelPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	tunnelAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(app.TunnelPort))
+
+	listener, err := client.Listen("tcp", tunnelAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := net.Dial("tcp", tunnelAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "hello" {
+		t.Errorf("Got %q back, want %q", buf, "hello")
+	}
+}
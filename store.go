@@ -0,0 +1,225 @@
+package boringproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Store is a storage backend for Database. All access goes through
+// transactions, so backends can keep data on disk instead of in memory, and
+// only write what changed.
+type Store interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(tx StoreTx) error) error
+	// Update runs fn in a read-write transaction. Changes are only saved if
+	// fn returns nil.
+	Update(fn func(tx StoreTx) error) error
+	// Backup writes a consistent copy of the store, in the store's own file
+	// format, to w.
+	Backup(w io.Writer) error
+	Close() error
+}
+
+// StoreTx is a transaction on a Store. Values returned by the getters are
+// copies, so modifying them doesn't change the store until they're passed to
+// the matching setter.
+type StoreTx interface {
+	GetSchemaVersion() int
+	SetSchemaVersion(version int) error
+
+	GetAdminDomain() string
+	SetAdminDomain(adminDomain string) error
+
+	// Tokens are keyed by their id, not the token itself
+	GetTokens() map[string]TokenData
+	GetToken(token string) (TokenData, bool)
+	SetToken(token string, tokenData TokenData) error
+	DeleteToken(token string) error
+
+	GetTunnels() map[string]Tunnel
+	GetTunnel(domain string) (Tunnel, bool)
+	SetTunnel(domain string, tun Tunnel) error
+	DeleteTunnel(domain string) error
+
+	GetUsers() map[string]User
+	GetUser(username string) (User, bool)
+	SetUser(username string, user User) error
+	DeleteUser(username string) error
+
+	GetOrgs() map[string]Org
+	GetOrg(name string) (Org, bool)
+	SetOrg(name string, org Org) error
+	DeleteOrg(name string) error
+
+	// Domain requests are keyed by the namedrop request id
+	GetDomainRequests() map[string]DomainRequest
+	GetDomainRequest(requestId string) (DomainRequest, bool)
+	SetDomainRequest(requestId string, req DomainRequest) error
+	DeleteDomainRequest(requestId string) error
+}
+
+const (
+	StoreBackendJson = "json"
+	StoreBackendBolt = "bolt"
+)
+
+var errReadOnlyTx = errors.New("Cannot write in a read-only transaction")
+
+// storeFileName returns the file in DBFolderPath which holds the database for
+// a backend.
+func storeFileName(backend string) (string, error) {
+	switch backend {
+	case StoreBackendJson:
+		return "boringproxy_db.json", nil
+	case StoreBackendBolt:
+		return "boringproxy_db.bolt", nil
+	default:
+		return "", fmt.Errorf("Unknown database backend %s", backend)
+	}
+}
+
+// openStore opens the database file at path. Use openLockedStore instead,
+// unless the directory is already locked.
+func openStore(backend, path string) (Store, error) {
+	switch backend {
+	case StoreBackendJson:
+		return openJsonStore(path)
+	case StoreBackendBolt:
+		return openBoltStore(path)
+	default:
+		return nil, fmt.Errorf("Unknown database backend %s", backend)
+	}
+}
+
+// ConvertDatabase copies everything from the database in dbDir stored with
+// the from backend into a new database using the to backend. The source is
+// left untouched, and an existing destination is never overwritten. Encrypted
+// secrets are copied as they are, so the same master key works for both.
+func ConvertDatabase(dbDir, from, to string) error {
+
+	if from == to {
+		return errors.New("Source and destination backends are the same")
+	}
+
+	srcName, err := storeFileName(from)
+	if err != nil {
+		return err
+	}
+
+	dstName, err := storeFileName(to)
+	if err != nil {
+		return err
+	}
+
+	srcPath := dbDir + srcName
+	dstPath := dbDir + dstName
+
+	_, err = os.Stat(srcPath)
+	if err != nil {
+		return fmt.Errorf("Failed to open source database: %v", err)
+	}
+
+	_, err = os.Stat(dstPath)
+	if err == nil {
+		return fmt.Errorf("Destination database %s already exists", dstPath)
+	}
+
+	src, err := openLockedStore(dbDir, from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Covered by the source's lock, since it's in the same directory
+	dst, err := openStore(to, dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return src.View(func(srcTx StoreTx) error {
+		return dst.Update(func(dstTx StoreTx) error {
+			return copyStore(srcTx, dstTx)
+		})
+	})
+}
+
+func copyStore(src, dst StoreTx) error {
+
+	err := dst.SetSchemaVersion(src.GetSchemaVersion())
+	if err != nil {
+		return err
+	}
+
+	err = dst.SetAdminDomain(src.GetAdminDomain())
+	if err != nil {
+		return err
+	}
+
+	for token, tokenData := range src.GetTokens() {
+		err := dst.SetToken(token, tokenData)
+		if err != nil {
+			return err
+		}
+	}
+
+	for domain, tun := range src.GetTunnels() {
+		err := dst.SetTunnel(domain, tun)
+		if err != nil {
+			return err
+		}
+	}
+
+	for username, user := range src.GetUsers() {
+		err := dst.SetUser(username, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, org := range src.GetOrgs() {
+		err := dst.SetOrg(name, org)
+		if err != nil {
+			return err
+		}
+	}
+
+	for requestId, req := range src.GetDomainRequests() {
+		err := dst.SetDomainRequest(requestId, req)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyUser makes a deep copy of user, so callers can't modify the stored
+// Clients map.
+func copyUser(user User) User {
+	clients := make(map[string]DbClient)
+	for k, v := range user.Clients {
+		clients[k] = v
+	}
+	user.Clients = clients
+	return user
+}
+
+// copyOrg makes a deep copy of org, like copyUser.
+func copyOrg(org Org) Org {
+	members := make(map[string]OrgMember)
+	for k, v := range org.Members {
+		members[k] = v
+	}
+	org.Members = members
+
+	clients := make(map[string]DbClient)
+	for k, v := range org.Clients {
+		clients[k] = v
+	}
+	org.Clients = clients
+
+	return org
+}
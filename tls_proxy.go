@@ -3,16 +3,18 @@ package boringproxy
 import (
 	//"errors"
 	"crypto/tls"
-	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/caddyserver/certmagic"
 )
 
+// ProxyTcp copies data between conn and the upstream at addr:port, optionally
+// terminating TLS first. It blocks until the connection is finished.
 func ProxyTcp(conn net.Conn, addr string, port int, useTls bool, certConfig *certmagic.Config) error {
 
 	if useTls {
@@ -30,9 +32,9 @@ func ProxyTcp(conn net.Conn, addr string, port int, useTls bool, certConfig *cer
 			return nil
 		}
 
-		go handleConnection(tlsConn, addr, port)
+		handleConnection(tlsConn, addr, port)
 	} else {
-		go handleConnection(conn, addr, port)
+		handleConnection(conn, addr, port)
 	}
 
 	return nil
@@ -57,9 +59,9 @@ func handleConnection(conn net.Conn, upstreamAddr string, port int) {
 		tlsConfig := &tls.Config{
 			InsecureSkipVerify: true,
 		}
-		upstreamConn, err = tls.Dial("tcp", fmt.Sprintf("%s:%d", addr, port), tlsConfig)
+		upstreamConn, err = tls.Dial("tcp", net.JoinHostPort(addr, strconv.Itoa(port)), tlsConfig)
 	} else {
-		upstreamConn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", addr, port))
+		upstreamConn, err = net.Dial("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
 	}
 
 	if err != nil {
@@ -0,0 +1,149 @@
+package boringproxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Token scopes. A token without scopes can do anything its owner can. A token
+// with scopes can read anything its owner can, but only make the changes its
+// scopes allow. Scopes never give a token more access than its owner has.
+const (
+	// Can't change anything. Only needed to create a token with no other
+	// scopes.
+	ScopeReadOnly     = "read-only"
+	ScopeTunnelsWrite = "tunnels:write"
+	ScopeClientsWrite = "clients:write"
+	ScopeTokensWrite  = "tokens:write"
+	ScopeUsersAdmin   = "users:admin"
+)
+
+var tokenScopes = []string{
+	ScopeReadOnly,
+	ScopeTunnelsWrite,
+	ScopeClientsWrite,
+	ScopeTokensWrite,
+	ScopeUsersAdmin,
+}
+
+// Tokens look like <id>.<secret>. Only the id and a hash of the whole token
+// are stored, so the database can't be used to recover tokens.
+const tokenIdLength = 8
+const tokenSecretLength = 32
+const tokenSeparator = "."
+
+// LastUsedAt is only saved if it's older than this, so using a token doesn't
+// mean a database write for every request.
+const tokenLastUsedInterval = 5 * time.Minute
+
+var errInvalidToken = errors.New("Invalid token")
+var errExpiredToken = errors.New("Token expired")
+
+func generateToken() (string, string, error) {
+	id, err := genRandomCode(tokenIdLength)
+	if err != nil {
+		return "", "", err
+	}
+
+	secret, err := genRandomCode(tokenSecretLength)
+	if err != nil {
+		return "", "", err
+	}
+
+	return id + tokenSeparator + secret, id, nil
+}
+
+// tokenId returns the id a token is stored under. Tokens created before they
+// were hashed have no id, so theirs is derived from the token.
+func tokenId(token string) string {
+	i := strings.Index(token, tokenSeparator)
+	if i > 0 {
+		return token[:i]
+	}
+
+	return hashToken(token)[:16]
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// checkToken reports whether token matches tokenData, and hasn't expired.
+func checkToken(token string, tokenData TokenData, now time.Time) error {
+	hash := hashToken(token)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(tokenData.Hash)) != 1 {
+		return errInvalidToken
+	}
+
+	if tokenData.Expired(now) {
+		return errExpiredToken
+	}
+
+	return nil
+}
+
+// Expired reports whether the token has an expiry time that's passed.
+func (t TokenData) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// HasScope reports whether the token is allowed to do what scope covers.
+func (t TokenData) HasScope(scope string) bool {
+	if len(t.Scopes) == 0 {
+		return true
+	}
+
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireScope returns an error if the token doesn't have scope.
+func requireScope(tokenData TokenData, scope string) error {
+	if !tokenData.HasScope(scope) {
+		return forbidden("Token doesn't have the %s scope", scope)
+	}
+	return nil
+}
+
+// parseScopes validates the scope parameters for a new token. A token can't
+// create tokens with scopes it doesn't have itself.
+func parseScopes(tokenData TokenData, scopes []string) ([]string, error) {
+
+	parsed := []string{}
+
+	for _, scope := range scopes {
+		valid := false
+		for _, s := range tokenScopes {
+			if scope == s {
+				valid = true
+				break
+			}
+		}
+
+		if !valid {
+			return nil, badRequest("Invalid scope %s", scope)
+		}
+
+		if !tokenData.HasScope(scope) && scope != ScopeReadOnly {
+			return nil, forbidden("Can't create a token with the %s scope without having it", scope)
+		}
+
+		parsed = append(parsed, scope)
+	}
+
+	if len(parsed) == 0 && len(tokenData.Scopes) != 0 {
+		return nil, forbidden("Tokens with scopes can only create tokens with scopes")
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,174 @@
+package boringproxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokensStoredHashed(t *testing.T) {
+
+	db := newTestDatabase(t)
+
+	err := db.AddUser("alice", RoleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := db.AddToken(TokenData{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := tokenId(token)
+	if !strings.HasPrefix(token, id+tokenSeparator) {
+		t.Errorf("Token %s doesn't start with its id %s", token, id)
+	}
+
+	tokens := db.GetTokens()
+	if len(tokens) != 1 {
+		t.Fatalf("Got %d tokens, want 1", len(tokens))
+	}
+
+	tokenData, exists := tokens[id]
+	if !exists {
+		t.Fatalf("Token isn't stored under its id")
+	}
+
+	if tokenData.Hash != hashToken(token) || strings.Contains(tokenData.Hash, token) {
+		t.Errorf("Got hash %s", tokenData.Hash)
+	}
+
+	if tokenData.CreatedAt.IsZero() {
+		t.Error("Creation time wasn't set")
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"token", token, true},
+		{"wrong secret", id + tokenSeparator + "wrong", false},
+		{"id only", id, false},
+		{"empty", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokenData, err := db.ValidateToken(test.token)
+			if (err == nil) != test.ok {
+				t.Fatalf("Got error %v, want success %v", err, test.ok)
+			}
+
+			if test.ok && tokenData.Owner != "alice" {
+				t.Errorf("Got owner %s", tokenData.Owner)
+			}
+		})
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+
+	const token = "abcd1234.secret"
+
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		token     string
+		expiresAt time.Time
+		err       error
+	}{
+		{"no expiry", token, time.Time{}, nil},
+		{"expires later", token, now.Add(time.Minute), nil},
+		{"expires now", token, now, errExpiredToken},
+		{"expired", token, now.Add(-time.Minute), errExpiredToken},
+		{"wrong token", "abcd1234.other", time.Time{}, errInvalidToken},
+		{"wrong expired token", "abcd1234.other", now.Add(-time.Minute), errInvalidToken},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokenData := TokenData{
+				Hash:      hashToken(token),
+				ExpiresAt: test.expiresAt,
+			}
+
+			err := checkToken(test.token, tokenData, now)
+			if err != test.err {
+				t.Errorf("Got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestValidateTokenRejectsExpired(t *testing.T) {
+
+	db := newTestDatabase(t)
+
+	err := db.AddUser("alice", RoleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := db.AddToken(TokenData{
+		Owner:     "alice",
+		ExpiresAt: time.Now().UTC().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.ValidateToken(token)
+	if err != errExpiredToken {
+		t.Errorf("Got error %v, want %v", err, errExpiredToken)
+	}
+}
+
+func TestTokenIdForLegacyTokens(t *testing.T) {
+
+	tests := []struct {
+		token string
+		id    string
+	}{
+		{"abcd1234.secret", "abcd1234"},
+		{"legacytoken", hashToken("legacytoken")[:16]},
+		// A leading separator isn't an id
+		{".secret", hashToken(".secret")[:16]},
+	}
+
+	for _, test := range tests {
+		id := tokenId(test.token)
+		if id != test.id {
+			t.Errorf("tokenId(%q) = %s, want %s", test.token, id, test.id)
+		}
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		scopes []string
+		create []string
+		ok     bool
+	}{
+		{"unscoped creates unscoped", nil, nil, true},
+		{"unscoped creates scoped", nil, []string{ScopeTunnelsWrite}, true},
+		{"invalid scope", nil, []string{"tunnels:everything"}, false},
+		{"scoped creates unscoped", []string{ScopeTunnelsWrite}, nil, false},
+		{"scoped creates same scope", []string{ScopeTunnelsWrite}, []string{ScopeTunnelsWrite}, true},
+		{"scoped creates other scope", []string{ScopeTunnelsWrite}, []string{ScopeUsersAdmin}, false},
+		{"scoped creates read-only", []string{ScopeTunnelsWrite}, []string{ScopeReadOnly}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseScopes(TokenData{Scopes: test.scopes}, test.create)
+			if (err == nil) != test.ok {
+				t.Errorf("Got error %v, want success %v", err, test.ok)
+			}
+		})
+	}
+}
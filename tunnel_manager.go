@@ -7,36 +7,28 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
-	"fmt"
 	"github.com/caddyserver/certmagic"
 	"golang.org/x/crypto/ssh"
-	"io/ioutil"
 	"log"
-	"os"
-	"os/user"
 	"strings"
-	"sync"
 )
 
 type TunnelManager struct {
 	config     *Config
 	db         *Database
-	mutex      *sync.Mutex
 	certConfig *certmagic.Config
-	user       *user.User
+	sshServer  *SshServer
 }
 
-func NewTunnelManager(config *Config, db *Database, certConfig *certmagic.Config) *TunnelManager {
+// Attempts at finding a random tunnel port that isn't used by another tunnel
+const maxRandomPortAttempts = 10
 
-	user, err := user.Current()
-	if err != nil {
-		log.Fatalf("Unable to get current user: %v", err)
-	}
+func NewTunnelManager(config *Config, db *Database, certConfig *certmagic.Config, sshServer *SshServer) *TunnelManager {
 
 	if config.autoCerts {
 		for domainName, tun := range db.GetTunnels() {
 			if tun.TlsTermination == "server" || tun.TlsTermination == "server-tls" {
-				err = certConfig.ManageSync(context.Background(), []string{domainName})
+				err := certConfig.ManageSync(context.Background(), []string{domainName})
 				if err != nil {
 					log.Println("CertMagic error at startup")
 					log.Println(err)
@@ -45,8 +37,7 @@ func NewTunnelManager(config *Config, db *Database, certConfig *certmagic.Config
 		}
 	}
 
-	mutex := &sync.Mutex{}
-	return &TunnelManager{config, db, mutex, certConfig, user}
+	return &TunnelManager{config, db, certConfig, sshServer}
 }
 
 func (m *TunnelManager) GetTunnels() map[string]Tunnel {
@@ -56,11 +47,11 @@ func (m *TunnelManager) GetTunnels() map[string]Tunnel {
 func (m *TunnelManager) RequestCreateTunnel(tunReq Tunnel) (Tunnel, error) {
 
 	if tunReq.Domain == "" {
-		return Tunnel{}, errors.New("Domain required")
+		return Tunnel{}, badRequest("Domain required")
 	}
 
 	if tunReq.Owner == "" {
-		return Tunnel{}, errors.New("Owner required")
+		return Tunnel{}, badRequest("Owner required")
 	}
 
 	if tunReq.TlsTermination == "server" || tunReq.TlsTermination == "server-tls" {
@@ -72,85 +63,165 @@ func (m *TunnelManager) RequestCreateTunnel(tunReq Tunnel) (Tunnel, error) {
 		}
 	}
 
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	_, privKey, err := MakeSSHKeyPair()
+	if err != nil {
+		return Tunnel{}, err
+	}
 
-	if tunReq.TunnelPort == 0 {
-		var err error
-		tunReq.TunnelPort, err = randomOpenPort()
-		if err != nil {
-			return Tunnel{}, err
-		}
+	// There's no SSH server when tunnels are managed offline. The key is
+	// filled in when tunnels are fetched anyway.
+	if m.sshServer != nil {
+		tunReq.ServerPublicKey = m.sshServer.AuthorizedKey()
 	}
+	// The embedded SSH server looks up tunnels by username
+	tunReq.Username = tunReq.Domain
+	tunReq.TunnelPrivateKey = privKey
+
+	randomPort := tunReq.TunnelPort == 0
 
-	for _, tun := range m.db.GetTunnels() {
-		if tunReq.Domain == tun.Domain {
-			return Tunnel{}, errors.New("Tunnel domain already in use")
+	// The checks and the write happen in one transaction, so two requests
+	// can't both claim the same domain or port.
+	err = m.db.Update(func(tx StoreTx) error {
+
+		tunnels := tx.GetTunnels()
+
+		if _, exists := tunnels[tunReq.Domain]; exists {
+			return conflict("Tunnel domain already in use")
 		}
 
-		if tunReq.TunnelPort == tun.TunnelPort {
-			return Tunnel{}, errors.New("Tunnel port already in use")
+		if randomPort {
+			port, err := randomTunnelPort(tunnels)
+			if err != nil {
+				return err
+			}
+			tunReq.TunnelPort = port
+		} else if tunnelPortInUse(tunnels, tunReq.TunnelPort, tunReq.Domain) {
+			return conflict("Tunnel port already in use")
 		}
-	}
 
-	privKey, err := m.addToAuthorizedKeys(tunReq.Domain, tunReq.TunnelPort, tunReq.AllowExternalTcp)
+		return tx.SetTunnel(tunReq.Domain, tunReq)
+	})
 	if err != nil {
 		return Tunnel{}, err
 	}
 
-	tunReq.ServerPublicKey = ""
-	tunReq.Username = m.user.Username
-	tunReq.TunnelPrivateKey = privKey
-
-	m.db.SetTunnel(tunReq.Domain, tunReq)
-
 	return tunReq, nil
 }
 
-func (m *TunnelManager) DeleteTunnel(domain string) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// UpdateTunnel changes the settings of the existing tunnel tunReq.Domain. The
+// owner and SSH server address can't be changed. The SSH key is only replaced
+// if rotateKey is set, and the tunnel port only if tunReq.TunnelPort differs
+// from the current one. A TunnelPort of 0 picks a new random port.
+func (m *TunnelManager) UpdateTunnel(tunReq Tunnel, rotateKey bool) (Tunnel, error) {
 
-	tunnel, exists := m.db.GetTunnel(domain)
+	old, exists := m.db.GetTunnel(tunReq.Domain)
 	if !exists {
-		return errors.New("Tunnel doesn't exist")
+		return Tunnel{}, notFound("Tunnel doesn't exist")
 	}
 
-	m.db.DeleteTunnel(domain)
-
-	authKeysPath := fmt.Sprintf("%s/.ssh/authorized_keys", m.user.HomeDir)
+	if tunReq.TlsTermination != old.TlsTermination && (tunReq.TlsTermination == "server" || tunReq.TlsTermination == "server-tls") {
+		if m.config.autoCerts {
+			err := m.certConfig.ManageSync(context.Background(), []string{tunReq.Domain})
+			if err != nil {
+				return Tunnel{}, errors.New("Failed to get cert")
+			}
+		}
+	}
 
-	akBytes, err := ioutil.ReadFile(authKeysPath)
-	if err != nil {
-		return err
+	var privKey string
+	if rotateKey {
+		var err error
+		_, privKey, err = MakeSSHKeyPair()
+		if err != nil {
+			return Tunnel{}, err
+		}
 	}
 
-	akStr := string(akBytes)
+	var tun Tunnel
+
+	err := m.db.Update(func(tx StoreTx) error {
 
-	lines := strings.Split(akStr, "\n")
+		var exists bool
+		tun, exists = tx.GetTunnel(tunReq.Domain)
+		if !exists {
+			return notFound("Tunnel doesn't exist")
+		}
 
-	tunnelId := fmt.Sprintf("boringproxy-%s-%d", domain, tunnel.TunnelPort)
+		// Compare against what's actually being replaced below
+		old = tun
 
-	outLines := []string{}
+		tunnels := tx.GetTunnels()
 
-	for _, line := range lines {
-		if strings.Contains(line, tunnelId) {
-			continue
+		if tunReq.TunnelPort == 0 {
+			port, err := randomTunnelPort(tunnels)
+			if err != nil {
+				return err
+			}
+			tun.TunnelPort = port
+		} else if tunReq.TunnelPort != tun.TunnelPort {
+			if tunnelPortInUse(tunnels, tunReq.TunnelPort, tunReq.Domain) {
+				return conflict("Tunnel port already in use")
+			}
+			tun.TunnelPort = tunReq.TunnelPort
 		}
 
-		outLines = append(outLines, line)
+		if rotateKey {
+			tun.TunnelPrivateKey = privKey
+		}
+
+		tun.ClientName = tunReq.ClientName
+		tun.ClientAddress = tunReq.ClientAddress
+		tun.ClientPort = tunReq.ClientPort
+		tun.AllowExternalTcp = tunReq.AllowExternalTcp
+		tun.TlsTermination = tunReq.TlsTermination
+		tun.DisableBuffering = tunReq.DisableBuffering
+		tun.AuthUsername = tunReq.AuthUsername
+		tun.AuthPassword = tunReq.AuthPassword
+
+		return tx.SetTunnel(tun.Domain, tun)
+	})
+	if err != nil {
+		return Tunnel{}, err
 	}
 
-	outStr := strings.Join(outLines, "\n")
+	// The SSH server binds the tunnel port when the client connects, so
+	// make the client connect again if anything that affects it changed.
+	// Other changes only matter to the client, which restarts the tunnel
+	// when it sees them.
+	reconnect := tun.TunnelPort != old.TunnelPort || rotateKey || tun.AllowExternalTcp != old.AllowExternalTcp
+	if reconnect && m.sshServer != nil {
+		m.sshServer.CloseTunnel(tun.Domain)
+	}
+
+	return tun, nil
+}
 
-	err = ioutil.WriteFile(authKeysPath, []byte(outStr), 0600)
+func (m *TunnelManager) DeleteTunnel(domain string) error {
+	err := m.db.Update(func(tx StoreTx) error {
+		_, exists := tx.GetTunnel(domain)
+		if !exists {
+			return notFound("Tunnel doesn't exist")
+		}
+
+		return tx.DeleteTunnel(domain)
+	})
 	if err != nil {
 		return err
 	}
 
+	if m.sshServer != nil {
+		m.sshServer.CloseTunnel(domain)
+	}
+
 	return nil
 }
 
+// ServerPublicKey returns the SSH host key clients should expect when
+// connecting to the server.
+func (m *TunnelManager) ServerPublicKey() string {
+	return m.sshServer.AuthorizedKey()
+}
+
 func (m *TunnelManager) GetPort(domain string) (int, error) {
 	tunnel, exists := m.db.GetTunnel(domain)
 
@@ -161,60 +232,31 @@ func (m *TunnelManager) GetPort(domain string) (int, error) {
 	return tunnel.TunnelPort, nil
 }
 
-func (m *TunnelManager) addToAuthorizedKeys(domain string, port int, allowExternalTcp bool) (string, error) {
-
-	authKeysPath := fmt.Sprintf("%s/.ssh/authorized_keys", m.user.HomeDir)
-
-	akFile, err := os.OpenFile(authKeysPath, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return "", err
-	}
-	defer akFile.Close()
-
-	akBytes, err := ioutil.ReadAll(akFile)
-	if err != nil {
-		return "", err
-	}
-
-	akStr := string(akBytes)
-
-	var privKey string
-	var pubKey string
-
-	pubKey, privKey, err = MakeSSHKeyPair()
-	if err != nil {
-		return "", err
-	}
-
-	pubKey = strings.TrimSpace(pubKey)
-
-	bindAddr := "127.0.0.1"
-	if allowExternalTcp {
-		bindAddr = "0.0.0.0"
+// tunnelPortInUse returns whether port belongs to a tunnel other than domain.
+func tunnelPortInUse(tunnels map[string]Tunnel, port int, domain string) bool {
+	for tunDomain, tun := range tunnels {
+		if tunDomain != domain && port == tun.TunnelPort {
+			return true
+		}
 	}
+	return false
+}
 
-	options := fmt.Sprintf(`command="echo This key permits tunnels only",permitopen="fakehost:1",permitlisten="%s:%d"`, bindAddr, port)
-
-	tunnelId := fmt.Sprintf("boringproxy-%s-%d", domain, port)
-
-	newAk := fmt.Sprintf("%s%s %s %s\n", akStr, options, pubKey, tunnelId)
-
-	// Clear the file
-	err = akFile.Truncate(0)
-	if err != nil {
-		return "", err
-	}
-	_, err = akFile.Seek(0, 0)
-	if err != nil {
-		return "", err
-	}
+func randomTunnelPort(tunnels map[string]Tunnel) (int, error) {
+	// A port can be free on the machine but still belong to a tunnel
+	// whose client isn't connected.
+	for i := 0; i < maxRandomPortAttempts; i++ {
+		port, err := randomOpenPort()
+		if err != nil {
+			return 0, err
+		}
 
-	_, err = akFile.Write([]byte(newAk))
-	if err != nil {
-		return "", err
+		if !tunnelPortInUse(tunnels, port, "") {
+			return port, nil
+		}
 	}
 
-	return privKey, nil
+	return 0, errors.New("Failed to find a free tunnel port")
 }
 
 // Adapted from https://stackoverflow.com/a/34347463/943814
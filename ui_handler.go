@@ -9,14 +9,15 @@ import (
 	"html/template"
 	"io"
 	"net/http"
-	//"net/url"
+	"net/url"
 	//"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
-//go:embed logo.png templates
+//go:embed logo.png templates openapi.json
 var fs embed.FS
 
 type WebUiHandler struct {
@@ -83,8 +84,8 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	tokenData, exists := h.db.GetTokenData(token)
-	if !exists {
+	tokenData, err := h.db.ValidateToken(token)
+	if err != nil {
 		h.sendLoginPage(w, r, 403)
 		return
 	}
@@ -113,6 +114,20 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 		h.confirmDeleteUser(w, r)
 	case "/delete-user":
 		h.deleteUser(w, r, tokenData)
+	case "/set-user-role":
+		h.setUserRole(w, r, tokenData)
+	case "/orgs":
+		h.handleOrgs(w, r, tokenData, user)
+	case "/confirm-delete-org":
+		h.confirmDeleteOrg(w, r)
+	case "/delete-org":
+		h.deleteOrg(w, r, tokenData)
+	case "/add-org-member":
+		h.addOrgMember(w, r, tokenData)
+	case "/confirm-remove-org-member":
+		h.confirmRemoveOrgMember(w, r)
+	case "/remove-org-member":
+		h.removeOrgMember(w, r, tokenData)
 	case "/logo.png":
 
 		logoPngBytes, err := fs.ReadFile("logo.png")
@@ -156,26 +171,24 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 
 		domain := r.Form.Get("domain")
 
-		var users map[string]User
-
-		// TODO: handle security checks in api
-		if user.IsAdmin {
-			users = h.db.GetUsers()
+		// New tunnels can belong to the user or one of their orgs
+		owners := []string{tokenData.Owner}
+		if tokenData.Org != "" {
+			owners = []string{tokenData.Org}
 		} else {
-			users = make(map[string]User)
-			users[tokenData.Owner] = user
+			owners = append(owners, sortedOrgNames(h.api.GetOrgs(tokenData))...)
 		}
 
 		templateData := struct {
-			Domain string
-			UserId string
-			User   User
-			Users  map[string]User
+			Domain  string
+			User    User
+			Owners  []string
+			Clients map[string]map[string]DbClient
 		}{
-			Domain: domain,
-			UserId: tokenData.Owner,
-			User:   user,
-			Users:  users,
+			Domain:  domain,
+			User:    user,
+			Owners:  owners,
+			Clients: h.accountClients(tokenData),
 		}
 
 		err = h.tmpl.ExecuteTemplate(w, "edit_tunnel.tmpl", templateData)
@@ -189,7 +202,7 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 
 		r.ParseForm()
 
-		err := h.api.DeleteTunnel(tokenData, r.Form)
+		err := h.api.DeleteTunnel(tokenData, sourceIp(r), r.Form)
 		if err != nil {
 			w.WriteHeader(400)
 			h.alertDialog(w, r, err.Error(), "/tunnels")
@@ -209,6 +222,12 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 			return
 		}
 
+		if tun.TunnelPrivateKey == "" {
+			w.WriteHeader(403)
+			h.alertDialog(w, r, "Not allowed to download the private key for this tunnel", "/tunnels")
+			return
+		}
+
 		w.Header().Set("Content-Disposition", "attachment; filename=id_rsa")
 		io.WriteString(w, tun.TunnelPrivateKey)
 
@@ -219,12 +238,24 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 
 		addTokenUser, _ := h.db.GetUser(owner)
 
+		// The orgs the new token can be limited to
+		orgs := h.api.GetOrgs(tokenData)
+		for name, org := range orgs {
+			if _, member := org.Members[owner]; !member {
+				delete(orgs, name)
+			}
+		}
+
 		templateData := struct {
-			Owner string
-			User  User
+			Owner  string
+			User   User
+			Orgs   map[string]Org
+			Scopes []string
 		}{
-			Owner: owner,
-			User:  addTokenUser,
+			Owner:  owner,
+			User:   addTokenUser,
+			Orgs:   orgs,
+			Scopes: tokenScopes,
 		}
 
 		err := h.tmpl.ExecuteTemplate(w, "add_token_client.tmpl", templateData)
@@ -235,6 +266,8 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 		}
 	case "/tokens":
 		h.handleTokens(w, r, user, tokenData)
+	case "/audit":
+		h.handleAudit(w, r, tokenData, user)
 	case "/clients":
 		h.handleClients(w, r, user, tokenData)
 	case "/confirm-delete-token":
@@ -283,6 +316,17 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 
 		namedropLink := h.config.namedropClient.DomainRequestLink()
 
+		// namedrop uses the request id as the OAuth state
+		linkUrl, err := url.Parse(namedropLink)
+		if err == nil {
+			err = h.db.SetDomainRequestOwner(linkUrl.Query().Get("state"), tokenData.Account())
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			h.alertDialog(w, r, err.Error(), "/tunnels")
+			return
+		}
+
 		http.Redirect(w, r, namedropLink, 303)
 	default:
 		if strings.HasPrefix(r.URL.Path, "/tunnels/") {
@@ -291,6 +335,11 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 
 			parts := strings.Split(r.URL.Path, "/")
 
+			if len(parts) == 4 && parts[3] == "edit" {
+				h.handleUpdateTunnel(w, r, tokenData, user, parts[2])
+				return
+			}
+
 			if len(parts) != 3 {
 				w.WriteHeader(400)
 				h.alertDialog(w, r, "Invalid path", "/tunnels")
@@ -336,54 +385,20 @@ func (h *WebUiHandler) handleTokens(w http.ResponseWriter, r *http.Request, user
 
 	switch r.Method {
 	case "GET":
-		var tokens map[string]TokenData
-		var users map[string]User
-
-		// TODO: handle security checks in api
-		if user.IsAdmin {
-			tokens = h.db.GetTokens()
-			users = h.db.GetUsers()
-		} else {
-			tokens = make(map[string]TokenData)
-
-			for token, td := range h.db.GetTokens() {
-				if tokenData.Owner == td.Owner {
-					tokens[token] = td
-				}
-
-			}
-
-			users = make(map[string]User)
-			users[tokenData.Owner] = user
-		}
+		tokens := h.api.GetTokens(tokenData, r.Form)
 
-		qrCodes := make(map[string]template.URL)
-		for token := range tokens {
-			adminDomain := h.db.GetAdminDomain()
-			loginUrl := fmt.Sprintf("https://%s/login?access_token=%s", adminDomain, token)
-
-			var png []byte
-			png, err := qrcode.Encode(loginUrl, qrcode.Medium, 256)
-			if err != nil {
-				w.WriteHeader(500)
-				h.alertDialog(w, r, err.Error(), "/tokens")
-				return
-			}
-
-			data := base64.StdEncoding.EncodeToString(png)
-			qrCodes[token] = template.URL("data:image/png;base64," + data)
-		}
+		users := h.api.GetUsers(tokenData, nil)
 
 		templateData := struct {
-			Tokens  map[string]TokenData
-			User    User
-			Users   map[string]User
-			QrCodes map[string]template.URL
+			Tokens map[string]TokenData
+			User   User
+			Users  map[string]User
+			Now    time.Time
 		}{
-			Tokens:  tokens,
-			User:    user,
-			Users:   users,
-			QrCodes: qrCodes,
+			Tokens: tokens,
+			User:   user,
+			Users:  users,
+			Now:    time.Now().UTC(),
 		}
 
 		err := h.tmpl.ExecuteTemplate(w, "tokens.tmpl", templateData)
@@ -393,14 +408,49 @@ func (h *WebUiHandler) handleTokens(w http.ResponseWriter, r *http.Request, user
 			return
 		}
 	case "POST":
-		_, err := h.api.CreateToken(tokenData, r.Form)
+		token, err := h.api.CreateToken(tokenData, sourceIp(r), r.Form)
 		if err != nil {
 			w.WriteHeader(500)
 			h.alertDialog(w, r, err.Error(), "/tokens")
 			return
 		}
 
-		http.Redirect(w, r, "/tokens", 303)
+		// Only the hash is stored, so this is the only chance to see
+		// the token.
+		newTokenData, _ := h.db.GetTokenData(tokenId(token))
+
+		adminDomain := h.db.GetAdminDomain()
+		loginUrl := fmt.Sprintf("https://%s/login?access_token=%s", adminDomain, token)
+
+		png, err := qrcode.Encode(loginUrl, qrcode.Medium, 256)
+		if err != nil {
+			w.WriteHeader(500)
+			h.alertDialog(w, r, err.Error(), "/tokens")
+			return
+		}
+
+		data := base64.StdEncoding.EncodeToString(png)
+
+		templateData := struct {
+			Token     string
+			TokenData TokenData
+			User      User
+			LoginUrl  string
+			QrCode    template.URL
+		}{
+			Token:     token,
+			TokenData: newTokenData,
+			User:      user,
+			LoginUrl:  loginUrl,
+			QrCode:    template.URL("data:image/png;base64," + data),
+		}
+
+		err = h.tmpl.ExecuteTemplate(w, "new_token.tmpl", templateData)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
 	default:
 		w.WriteHeader(405)
 		h.alertDialog(w, r, "Invalid method for tokens", "/tokens")
@@ -408,39 +458,70 @@ func (h *WebUiHandler) handleTokens(w http.ResponseWriter, r *http.Request, user
 	}
 }
 
-func (h *WebUiHandler) handleClients(w http.ResponseWriter, r *http.Request, user User, tokenData TokenData) {
+func (h *WebUiHandler) handleAudit(w http.ResponseWriter, r *http.Request, tokenData TokenData, user User) {
+
+	if !user.Can(PermAuditRead) {
+		w.WriteHeader(403)
+		h.alertDialog(w, r, "Only admins and auditors can view the audit log", "/tunnels")
+		return
+	}
 
 	r.ParseForm()
 
-	switch r.Method {
-	case "GET":
-		var users map[string]User
+	entries, err := h.api.GetAuditEntries(tokenData, r.Form)
+	if err != nil {
+		w.WriteHeader(400)
+		h.alertDialog(w, r, err.Error(), "/audit")
+		return
+	}
 
-		// TODO: handle security checks in api
-		if user.IsAdmin {
-			users = h.db.GetUsers()
-		} else {
-			user, _ := h.db.GetUser(tokenData.Owner)
-			users = make(map[string]User)
-			users[tokenData.Owner] = user
-		}
+	templateData := struct {
+		User    User
+		Entries []AuditEntry
+		Actions []string
+		Filter  url.Values
+	}{
+		User:    user,
+		Entries: entries,
+		Actions: []string{
+			AuditTunnelCreate,
+			AuditTunnelUpdate,
+			AuditTunnelDelete,
+			AuditTokenCreate,
+			AuditTokenDelete,
+			AuditUserCreate,
+			AuditUserUpdate,
+			AuditUserDelete,
+			AuditClientSet,
+			AuditClientDelete,
+			AuditOrgCreate,
+			AuditOrgDelete,
+			AuditOrgMemberSet,
+			AuditOrgMemberDelete,
+		},
+		Filter: r.Form,
+	}
+
+	err = h.tmpl.ExecuteTemplate(w, "audit.tmpl", templateData)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+}
 
-		clients := make(map[string]DbClient)
+func (h *WebUiHandler) handleClients(w http.ResponseWriter, r *http.Request, user User, tokenData TokenData) {
 
-		for _, user := range users {
-			for clientName, client := range user.Clients {
-				clients[clientName] = client
-			}
-		}
+	r.ParseForm()
 
+	switch r.Method {
+	case "GET":
 		templateData := struct {
 			User    User
-			Users   map[string]User
-			Clients map[string]DbClient
+			Clients map[string]map[string]DbClient
 		}{
 			User:    user,
-			Users:   users,
-			Clients: clients,
+			Clients: h.accountClients(tokenData),
 		}
 
 		err := h.tmpl.ExecuteTemplate(w, "clients.tmpl", templateData)
@@ -454,7 +535,7 @@ func (h *WebUiHandler) handleClients(w http.ResponseWriter, r *http.Request, use
 		owner := r.Form.Get("owner")
 		clientName := r.Form.Get("client-name")
 
-		err := h.api.SetClient(tokenData, r.Form, owner, clientName)
+		err := h.api.SetClient(tokenData, sourceIp(r), r.Form, owner, clientName)
 		if err != nil {
 			w.WriteHeader(500)
 			h.alertDialog(w, r, err.Error(), "/clients")
@@ -511,12 +592,27 @@ func (h *WebUiHandler) handleTunnels(w http.ResponseWriter, r *http.Request, tok
 	case "GET":
 		tunnels := h.api.GetTunnels(tokenData)
 
+		r.ParseForm()
+
+		owner := r.Form.Get("owner")
+		if owner != "" {
+			for domain, tun := range tunnels {
+				if tun.Owner != owner {
+					delete(tunnels, domain)
+				}
+			}
+		}
+
 		templateData := struct {
-			User    User
-			Tunnels map[string]Tunnel
+			User           User
+			Owner          string
+			Tunnels        map[string]Tunnel
+			DomainRequests map[string]DomainRequest
 		}{
-			User:    user,
-			Tunnels: tunnels,
+			User:           user,
+			Owner:          owner,
+			Tunnels:        tunnels,
+			DomainRequests: h.api.GetDomainRequests(tokenData),
 		}
 
 		err := h.tmpl.ExecuteTemplate(w, "tunnels.tmpl", templateData)
@@ -532,6 +628,63 @@ func (h *WebUiHandler) handleTunnels(w http.ResponseWriter, r *http.Request, tok
 	}
 }
 
+// handleUpdateTunnel serves /tunnels/{domain}/edit
+func (h *WebUiHandler) handleUpdateTunnel(w http.ResponseWriter, r *http.Request, tokenData TokenData, user User, domain string) {
+
+	switch r.Method {
+	case "GET":
+		params := url.Values{}
+		params.Set("domain", domain)
+
+		tunnel, err := h.api.GetTunnel(tokenData, params)
+		if err != nil {
+			w.WriteHeader(400)
+			h.alertDialog(w, r, err.Error(), "/tunnels")
+			return
+		}
+
+		clients, _ := h.api.GetClients(tokenData, tunnel.Owner)
+
+		templateData := struct {
+			User    User
+			Tunnel  Tunnel
+			Clients map[string]DbClient
+		}{
+			User:    user,
+			Tunnel:  tunnel,
+			Clients: clients,
+		}
+
+		err = h.tmpl.ExecuteTemplate(w, "update_tunnel.tmpl", templateData)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+	case "POST":
+		r.ParseForm()
+
+		// Browsers leave out unchecked boxes, which would mean no change
+		for _, name := range []string{"allow-external-tcp", "disable-buffering", "password-protect", "rotate-key"} {
+			if r.Form.Get(name) == "" {
+				r.Form.Set(name, "off")
+			}
+		}
+
+		_, err := h.api.UpdateTunnel(tokenData, sourceIp(r), domain, r.Form)
+		if err != nil {
+			w.WriteHeader(400)
+			h.alertDialog(w, r, err.Error(), "/tunnels/"+domain+"/edit")
+			return
+		}
+
+		http.Redirect(w, r, "/tunnels/"+domain, 303)
+	default:
+		w.WriteHeader(405)
+		h.alertDialog(w, r, "Invalid method for /tunnels/{domain}/edit", "/tunnels")
+	}
+}
+
 func (h *WebUiHandler) handleCreateTunnel(w http.ResponseWriter, r *http.Request, tokenData TokenData) {
 
 	pendingId, err := genRandomCode(16)
@@ -549,7 +702,7 @@ func (h *WebUiHandler) handleCreateTunnel(w http.ResponseWriter, r *http.Request
 
 		r.ParseForm()
 
-		_, err := h.api.CreateTunnel(tokenData, r.Form)
+		_, err := h.api.CreateTunnel(tokenData, sourceIp(r), r.Form)
 
 		doneSignal <- ReqResult{err, "/tunnels"}
 	}()
@@ -608,22 +761,16 @@ func (h *WebUiHandler) handleUsers(w http.ResponseWriter, r *http.Request, token
 
 	switch r.Method {
 	case "GET":
-		var users map[string]User
-
-		// TODO: handle security checks in api
-		if user.IsAdmin {
-			users = h.db.GetUsers()
-		} else {
-			users = make(map[string]User)
-			users[tokenData.Owner] = user
-		}
+		users := h.api.GetUsers(tokenData, nil)
 
 		templateData := struct {
 			User  User
 			Users map[string]User
+			Roles []string
 		}{
 			User:  user,
 			Users: users,
+			Roles: userRoles,
 		}
 
 		err := h.tmpl.ExecuteTemplate(w, "users.tmpl", templateData)
@@ -633,7 +780,7 @@ func (h *WebUiHandler) handleUsers(w http.ResponseWriter, r *http.Request, token
 			return
 		}
 	case "POST":
-		err := h.api.CreateUser(tokenData, r.Form)
+		err := h.api.CreateUser(tokenData, sourceIp(r), r.Form)
 		if err != nil {
 			w.WriteHeader(500)
 			h.alertDialog(w, r, err.Error(), "/users")
@@ -677,7 +824,27 @@ func (h *WebUiHandler) deleteUser(w http.ResponseWriter, r *http.Request, tokenD
 
 	r.ParseForm()
 
-	err := h.api.DeleteUser(tokenData, r.Form)
+	err := h.api.DeleteUser(tokenData, sourceIp(r), r.Form)
+	if err != nil {
+		w.WriteHeader(500)
+		h.alertDialog(w, r, err.Error(), "/users")
+		return
+	}
+
+	http.Redirect(w, r, "/users", 303)
+}
+
+func (h *WebUiHandler) setUserRole(w http.ResponseWriter, r *http.Request, tokenData TokenData) {
+
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		h.alertDialog(w, r, "Invalid method for set-user-role", "/users")
+		return
+	}
+
+	r.ParseForm()
+
+	err := h.api.SetUserRole(tokenData, sourceIp(r), r.Form)
 	if err != nil {
 		w.WriteHeader(500)
 		h.alertDialog(w, r, err.Error(), "/users")
@@ -687,21 +854,175 @@ func (h *WebUiHandler) deleteUser(w http.ResponseWriter, r *http.Request, tokenD
 	http.Redirect(w, r, "/users", 303)
 }
 
+func (h *WebUiHandler) handleOrgs(w http.ResponseWriter, r *http.Request, tokenData TokenData, user User) {
+
+	r.ParseForm()
+
+	switch r.Method {
+	case "GET":
+		templateData := struct {
+			User  User
+			Orgs  map[string]Org
+			Users map[string]User
+		}{
+			User:  user,
+			Orgs:  h.api.GetOrgs(tokenData),
+			Users: h.api.GetUsers(tokenData, nil),
+		}
+
+		err := h.tmpl.ExecuteTemplate(w, "orgs.tmpl", templateData)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+	case "POST":
+		err := h.api.CreateOrg(tokenData, sourceIp(r), r.Form)
+		if err != nil {
+			w.WriteHeader(500)
+			h.alertDialog(w, r, err.Error(), "/orgs")
+			return
+		}
+
+		http.Redirect(w, r, "/orgs", 303)
+	default:
+		w.WriteHeader(405)
+		h.alertDialog(w, r, "Invalid method for orgs", "/orgs")
+	}
+}
+
+func (h *WebUiHandler) confirmDeleteOrg(w http.ResponseWriter, r *http.Request) {
+
+	r.ParseForm()
+
+	name := r.Form.Get("name")
+
+	data := &ConfirmData{
+		Head:       h.headHtml,
+		Message:    fmt.Sprintf("Are you sure you want to delete org %s?", name),
+		ConfirmUrl: fmt.Sprintf("/delete-org?name=%s", name),
+		CancelUrl:  "/orgs",
+	}
+
+	err := h.tmpl.ExecuteTemplate(w, "confirm.tmpl", data)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+}
+
+func (h *WebUiHandler) deleteOrg(w http.ResponseWriter, r *http.Request, tokenData TokenData) {
+
+	r.ParseForm()
+
+	err := h.api.DeleteOrg(tokenData, sourceIp(r), r.Form)
+	if err != nil {
+		w.WriteHeader(500)
+		h.alertDialog(w, r, err.Error(), "/orgs")
+		return
+	}
+
+	http.Redirect(w, r, "/orgs", 303)
+}
+
+func (h *WebUiHandler) addOrgMember(w http.ResponseWriter, r *http.Request, tokenData TokenData) {
+
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		h.alertDialog(w, r, "Invalid method for add-org-member", "/orgs")
+		return
+	}
+
+	r.ParseForm()
+
+	err := h.api.SetOrgMember(tokenData, sourceIp(r), r.Form)
+	if err != nil {
+		w.WriteHeader(500)
+		h.alertDialog(w, r, err.Error(), "/orgs")
+		return
+	}
+
+	http.Redirect(w, r, "/orgs", 303)
+}
+
+func (h *WebUiHandler) confirmRemoveOrgMember(w http.ResponseWriter, r *http.Request) {
+
+	r.ParseForm()
+
+	name := r.Form.Get("name")
+	username := r.Form.Get("username")
+
+	data := &ConfirmData{
+		Head:       h.headHtml,
+		Message:    fmt.Sprintf("Are you sure you want to remove %s from org %s? Their tokens for the org will be deleted.", username, name),
+		ConfirmUrl: fmt.Sprintf("/remove-org-member?name=%s&username=%s", name, username),
+		CancelUrl:  "/orgs",
+	}
+
+	err := h.tmpl.ExecuteTemplate(w, "confirm.tmpl", data)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+}
+
+func (h *WebUiHandler) removeOrgMember(w http.ResponseWriter, r *http.Request, tokenData TokenData) {
+
+	r.ParseForm()
+
+	err := h.api.DeleteOrgMember(tokenData, sourceIp(r), r.Form)
+	if err != nil {
+		w.WriteHeader(500)
+		h.alertDialog(w, r, err.Error(), "/orgs")
+		return
+	}
+
+	http.Redirect(w, r, "/orgs", 303)
+}
+
+// accountClients returns the clients of the users and orgs visible to the
+// token, keyed by owner.
+func (h *WebUiHandler) accountClients(tokenData TokenData) map[string]map[string]DbClient {
+
+	clients := make(map[string]map[string]DbClient)
+
+	for username, user := range h.api.GetUsers(tokenData, nil) {
+		clients[username] = user.Clients
+	}
+
+	for name, org := range h.api.GetOrgs(tokenData) {
+		clients[name] = org.Clients
+	}
+
+	return clients
+}
+
+func sortedOrgNames(orgs map[string]Org) []string {
+	names := []string{}
+	for name := range orgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (h *WebUiHandler) confirmDeleteToken(w http.ResponseWriter, r *http.Request) {
 
 	r.ParseForm()
 
-	if len(r.Form["token"]) != 1 {
+	if len(r.Form["id"]) != 1 {
 		w.WriteHeader(400)
-		w.Write([]byte("Invalid token parameter"))
+		w.Write([]byte("Invalid id parameter"))
 		return
 	}
-	token := r.Form["token"][0]
+	id := r.Form["id"][0]
 
 	data := &ConfirmData{
 		Head:       h.headHtml,
-		Message:    fmt.Sprintf("Are you sure you want to delete token %s?", token),
-		ConfirmUrl: fmt.Sprintf("/delete-token?token=%s", token),
+		Message:    fmt.Sprintf("Are you sure you want to delete token %s?", id),
+		ConfirmUrl: fmt.Sprintf("/delete-token?id=%s", id),
 		CancelUrl:  "/tokens",
 	}
 
@@ -715,7 +1036,7 @@ func (h *WebUiHandler) confirmDeleteToken(w http.ResponseWriter, r *http.Request
 func (h *WebUiHandler) deleteToken(w http.ResponseWriter, r *http.Request, tokenData TokenData) {
 
 	r.ParseForm()
-	err := h.api.DeleteToken(tokenData, r.Form)
+	err := h.api.DeleteToken(tokenData, sourceIp(r), r.Form)
 	if err != nil {
 		w.WriteHeader(500)
 		h.alertDialog(w, r, err.Error(), "/tokens")
@@ -734,7 +1055,7 @@ func (h *WebUiHandler) confirmDeleteClient(w http.ResponseWriter, r *http.Reques
 
 	data := &ConfirmData{
 		Head:       h.headHtml,
-		Message:    fmt.Sprintf("Are you sure you want to delete client %s for user %s?", clientName, owner),
+		Message:    fmt.Sprintf("Are you sure you want to delete client %s for %s?", clientName, owner),
 		ConfirmUrl: fmt.Sprintf("/delete-client?owner=%s&client-name=%s", owner, clientName),
 		CancelUrl:  "/clients",
 	}
@@ -753,7 +1074,7 @@ func (h *WebUiHandler) deleteClient(w http.ResponseWriter, r *http.Request, toke
 	owner := r.Form.Get("owner")
 	clientName := r.Form.Get("client-name")
 
-	err := h.api.DeleteClient(tokenData, owner, clientName)
+	err := h.api.DeleteClient(tokenData, sourceIp(r), owner, clientName)
 	if err != nil {
 		w.WriteHeader(500)
 		h.alertDialog(w, r, err.Error(), "/clients")
@@ -4,10 +4,13 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/big"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -15,13 +18,70 @@ import (
 func saveJson(data interface{}, filePath string) error {
 	jsonStr, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {
-		return errors.New("Error serializing JSON")
-	} else {
-		err := ioutil.WriteFile(filePath, jsonStr, 0644)
-		if err != nil {
-			return errors.New("Error saving JSON")
-		}
+		return fmt.Errorf("Error serializing JSON: %v", err)
+	}
+
+	err = writeFileAtomic(filePath, jsonStr, 0600)
+	if err != nil {
+		return fmt.Errorf("Error saving JSON: %v", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to filePath, syncs it
+// to disk, then renames it over filePath. Readers (and crashes) only ever
+// see either the old or the new contents.
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+
+	dir := filepath.Dir(filePath)
+
+	tmpFile, err := ioutil.TempFile(dir, filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := tmpFile.Name()
+
+	// Clean up if anything fails before the rename
+	defer os.Remove(tmpPath)
+
+	_, err = tmpFile.Write(data)
+	if err != nil {
+		tmpFile.Close()
+		return err
 	}
+
+	err = tmpFile.Chmod(perm)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	err = tmpFile.Sync()
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the rename itself is on disk. Not all platforms support
+	// syncing directories, so errors are ignored.
+	dirFile, err := os.Open(dir)
+	if err == nil {
+		dirFile.Sync()
+		dirFile.Close()
+	}
+
 	return nil
 }
 
@@ -42,8 +102,11 @@ func extractToken(tokenName string, r *http.Request) (string, error) {
 
 	authHeader := r.Header.Get("Authorization")
 	if authHeader != "" {
-		tokenHeader := strings.Split(authHeader, " ")[1]
-		return tokenHeader, nil
+		parts := strings.Fields(authHeader)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+			return "", errors.New("Invalid Authorization header")
+		}
+		return parts[1], nil
 	}
 
 	tokenCookie, err := r.Cookie(tokenName)